@@ -3,11 +3,16 @@ package cli
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/pkg/docker"
 	"github.com/vishvananda/wormhole/utils"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -44,12 +49,19 @@ func ping(args []string, c *client.Client) {
 func tunnelCreate(args []string, c *client.Client) {
 	host := ""
 	udp := false
+	driver := ""
 	filtered := make([]string, 0)
-	for _, arg := range args {
-		if arg == "--udp" {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--udp" {
 			udp = true
+		} else if args[i] == "--driver" {
+			if i+1 == len(args) {
+				log.Fatalf("Argument DRIVER is required for --driver")
+			}
+			i++
+			driver = args[i]
 		} else {
-			filtered = append(filtered, arg)
+			filtered = append(filtered, args[i])
 		}
 	}
 	args = filtered
@@ -65,7 +77,7 @@ func tunnelCreate(args []string, c *client.Client) {
 		log.Fatalf("%v", err)
 	}
 
-	src, dst, err := c.CreateTunnel(host, udp)
+	src, dst, err := c.CreateTunnel(host, udp, driver)
 	if err != nil {
 		log.Fatalf("client.CreateTunnel failed: %v", err)
 	}
@@ -93,6 +105,59 @@ func tunnelDelete(args []string, c *client.Client) {
 	}
 }
 
+func tunnelList(args []string, c *client.Client) {
+	asJson := false
+	keys := false
+	for _, arg := range args {
+		if arg == "--json" {
+			asJson = true
+		} else if arg == "--show-keys" {
+			keys = true
+		} else {
+			log.Fatalf("Unknown args for tunnel-list: %v", arg)
+		}
+	}
+
+	infos, err := c.ListTunnels(keys)
+	if err != nil {
+		log.Fatalf("client.ListTunnels failed: %v", err)
+	}
+	if asJson {
+		printJson(infos)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	header := "HOST\tSRC\tDST\tREQID\tDRIVER\tCIPHER\tPORTS\tORIGIN\tSTATUS"
+	if keys {
+		header += "\tAUTH KEY\tENC KEY"
+	}
+	fmt.Fprintln(w, header)
+	for _, info := range infos {
+		ports := "-"
+		if info.SrcPort != 0 || info.DstPort != 0 {
+			ports = fmt.Sprintf("%d:%d", info.SrcPort, info.DstPort)
+		}
+		origin := "created"
+		if info.Discovered {
+			origin = "discovered"
+		}
+		cipher := "-"
+		if info.DriverName() == client.DriverXfrm {
+			cipher = info.CipherName()
+		}
+		status := info.Status
+		if info.Rebuilds > 0 {
+			status = fmt.Sprintf("%s (rebuilt %d)", status, info.Rebuilds)
+		}
+		fmt.Fprintf(w, "%s\t%v\t%v\t%d\t%s\t%s\t%s\t%s\t%s", info.Host, info.Src, info.Dst, info.Reqid, info.DriverName(), cipher, ports, origin, status)
+		if keys {
+			fmt.Fprintf(w, "\t%x\t%x", info.AuthKey, info.EncKey)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
 func segmentCreate(args []string, c *client.Client) {
 	id, init, trig, err := parseSegment(args)
 	if err != nil {
@@ -107,26 +172,257 @@ func segmentCreate(args []string, c *client.Client) {
 }
 
 func segmentDelete(args []string, c *client.Client) {
+	id, drain, force, err := parseDelete(args)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	err = c.DeleteSegment(id, drain, force)
+	if err != nil {
+		log.Fatalf("client.DeleteSegment failed: %v", err)
+	}
+}
+
+// parseDelete parses the arguments of delete. Flags may come before or
+// after the id.
+func parseDelete(args []string) (string, time.Duration, bool, error) {
 	id := ""
+	var drain time.Duration
+	force := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--force":
+			force = true
+		case arg == "--drain" || strings.HasPrefix(arg, "--drain="):
+			value := strings.TrimPrefix(arg, "--drain=")
+			if arg == "--drain" {
+				if i+1 == len(args) {
+					return "", 0, false, fmt.Errorf("Argument TIMEOUT is required for --drain")
+				}
+				i++
+				value = args[i]
+			}
+			var err error
+			drain, err = time.ParseDuration(value)
+			if err != nil {
+				return "", 0, false, fmt.Errorf("Unable to parse drain timeout: %v", value)
+			}
+		case strings.HasPrefix(arg, "-"), id != "":
+			return "", 0, false, fmt.Errorf("Unknown args for delete: %v", arg)
+		default:
+			id = arg
+		}
+	}
+	if id == "" {
+		return "", 0, false, fmt.Errorf("Argument id is required for delete")
+	}
+	return id, drain, force, nil
+}
+
+func segmentList(args []string, c *client.Client) {
+	asJson := false
+	for _, arg := range args {
+		if arg == "--json" {
+			asJson = true
+		} else {
+			log.Fatalf("Unknown args for list: %v", arg)
+		}
+	}
+
+	infos, err := c.ListSegments()
+	if err != nil {
+		log.Fatalf("client.ListSegments failed: %v", err)
+	}
+	if asJson {
+		printJson(infos)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHEAD\tTAIL\tTRIGGERED\tCHILD")
+	for _, info := range infos {
+		tails := make([]string, 0)
+		children := make([]string, 0)
+		for _, tail := range info.Tails {
+			tails = append(tails, tail.String())
+			if child := childString(&tail); child != "" {
+				children = append(children, child)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", info.Id, info.Head, strings.Join(tails, ","), info.Triggered, strings.Join(children, ","))
+	}
+	w.Flush()
+}
+
+func segmentShow(args []string, c *client.Client) {
+	asJson := false
+	filtered := make([]string, 0)
+	for _, arg := range args {
+		if arg == "--json" {
+			asJson = true
+		} else {
+			filtered = append(filtered, arg)
+		}
+	}
+	args = filtered
 	if len(args) > 1 {
-		log.Fatalf("Unknown args for delete: %v", args[1:])
+		log.Fatalf("Unknown args for show: %v", args[1:])
+	} else if len(args) == 0 {
+		log.Fatalf("Argument id is required for show")
 	}
-	if len(args) == 1 {
-		id = args[0]
-	} else {
-		log.Fatalf("Argument id is required for delete")
+
+	info, err := c.GetSegment(args[0])
+	if err != nil {
+		log.Fatalf("client.GetSegment failed: %v", err)
 	}
+	if asJson {
+		printJson(info)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Id:\t%s\n", info.Id)
+	fmt.Fprintf(w, "Head:\t%s\n", info.Head)
+	if info.Head.Ns != "" {
+		fmt.Fprintf(w, "Head Namespace:\t%s\n", info.Head.Ns)
+	}
+	for i, tail := range info.Tails {
+		label := "Tail"
+		if len(info.Tails) > 1 {
+			label = fmt.Sprintf("Tail %d", i)
+		}
+		fmt.Fprintf(w, "%s:\t%s\n", label, tail)
+		if tail.Ns != "" {
+			fmt.Fprintf(w, "%s Namespace:\t%s\n", label, tail.Ns)
+		}
+		if tail.Weight != 0 {
+			fmt.Fprintf(w, "%s Weight:\t%d\n", label, tail.Weight)
+		}
+		if tail.ChildId != "" {
+			fmt.Fprintf(w, "%s Child:\t%s\n", label, childString(&tail))
+		}
+		if tail.Health != "" {
+			health := tail.Health
+			if tail.HealthError != "" {
+				health += ": " + tail.HealthError
+			}
+			fmt.Fprintf(w, "%s Health:\t%s\n", label, health)
+		}
+	}
+	if len(info.Tails) > 1 {
+		fmt.Fprintf(w, "Balance:\t%s\n", info.Balance)
+	}
+	fmt.Fprintf(w, "Triggered:\t%v\n", info.Triggered)
+	fmt.Fprintf(w, "Init:\t%s\n", commandsString(info.Init, false))
+	fmt.Fprintf(w, "Trigger:\t%s\n", commandsString(info.Trig, true))
+	fmt.Fprintf(w, "Docker Ids:\t%s\n", strings.Join(info.DockerIds, " "))
+	w.Flush()
+}
 
-	err := c.DeleteSegment(id)
+func segmentStats(args []string, c *client.Client) {
+	asJson := false
+	filtered := make([]string, 0)
+	for _, arg := range args {
+		if arg == "--json" {
+			asJson = true
+		} else {
+			filtered = append(filtered, arg)
+		}
+	}
+	args = filtered
+	if len(args) > 1 {
+		log.Fatalf("Unknown args for stats: %v", args[1:])
+	} else if len(args) == 0 {
+		log.Fatalf("Argument id is required for stats")
+	}
+
+	stats, err := c.GetSegmentStats(args[0])
 	if err != nil {
-		log.Fatalf("client.DeleteSegment failed: %v", err)
+		log.Fatalf("client.GetSegmentStats failed: %v", err)
+	}
+	if asJson {
+		printJson(stats)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Id:\t%s\n", stats.Id)
+	fmt.Fprintf(w, "Triggers:\t%d (avg %v, %d failed)\n", stats.Triggers, average(stats.TriggerTime, stats.Triggers), stats.TriggerErrors)
+	fmt.Fprintln(w, "\tACCEPTED\tACTIVE\tFAILED\tBYTES IN\tBYTES OUT\tDIALS\tAVG DIAL\tMAX DIAL")
+	fmt.Fprintf(w, "Total\t%s\n", statsString(&stats.Stats))
+	for i := range stats.Tails {
+		fmt.Fprintf(w, "Tail %d\t%s\n", i, statsString(&stats.Tails[i]))
+	}
+	w.Flush()
+}
+
+func statsString(stats *client.Stats) string {
+	return fmt.Sprintf("%d\t%d\t%d\t%d\t%d\t%d\t%v\t%v", stats.Accepted, stats.Active,
+		stats.Failed, stats.BytesIn, stats.BytesOut, stats.Dials,
+		average(stats.DialTime, stats.Dials), stats.MaxDialTime)
+}
+
+func average(total time.Duration, count uint64) time.Duration {
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+func childString(info *client.TailInfo) string {
+	if info.ChildId == "" {
+		return ""
+	}
+	if info.ChildHost == "" {
+		return info.ChildId
+	}
+	return fmt.Sprintf("%s@%s", info.ChildId, info.ChildHost)
+}
+
+// commandsString formats commands in the same form they are given to create.
+// Trigger commands always modify the tail so tail is omitted for them.
+func commandsString(commands []client.SegmentCommand, trigger bool) string {
+	parts := make([]string, 0)
+	tail := trigger
+	index := 0
+	for _, command := range commands {
+		if command.TailIndex > index {
+			parts = append(parts, "next")
+			if trigger {
+				parts = append(parts, "trigger")
+			}
+			index = command.TailIndex
+			tail = true
+		}
+		if command.Tail && !tail {
+			parts = append(parts, "tail")
+			tail = true
+		}
+		parts = append(parts, client.CommandName[command.Type])
+		if command.Arg != "" {
+			parts = append(parts, command.Arg)
+		}
+		if len(command.ChildInit) != 0 {
+			parts = append(parts, commandsString(command.ChildInit, false))
+		}
+		if len(command.ChildTrig) != 0 {
+			parts = append(parts, "trigger", commandsString(command.ChildTrig, true))
+		}
 	}
+	return strings.Join(parts, " ")
+}
+
+func printJson(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode json: %v", err)
+	}
+	fmt.Println(string(b))
 }
 
 func parseSegment(args []string) (string, []client.SegmentCommand, []client.SegmentCommand, error) {
 	id := utils.Uuid()
 	s := client.SegmentCommand{}
 	chain, tail, trigger := false, false, false
+	index := 0
 	command := ""
 	cur := &s
 	for len(args) > 0 {
@@ -157,6 +453,24 @@ func parseSegment(args []string) (string, []client.SegmentCommand, []client.Segm
 		case "udptunnel":
 			action = parseUdptunnel(&args)
 			chain = true
+		case "ready":
+			action = parseReady(&args)
+		case "idle":
+			action = parseIdle(&args)
+		case "balance":
+			action = parseBalance(&args)
+		case "weight":
+			action = parseWeight(tail, &args)
+		case "affinity":
+			action = parseAffinity(&args)
+		case "health":
+			action = parseHealth(&args)
+		case "next":
+			// start another tail of the top level wormhole
+			cur = &s
+			index++
+			chain, trigger, tail = false, false, true
+			continue
 		case "tail":
 			tail = true
 			continue
@@ -167,6 +481,9 @@ func parseSegment(args []string) (string, []client.SegmentCommand, []client.Segm
 		default:
 			log.Fatalf("Action %s not recognized", command)
 		}
+		if cur == &s {
+			action.TailIndex = index
+		}
 		if trigger {
 			cur.AddTrig(action)
 			if chain {
@@ -203,13 +520,10 @@ func parseUrl(tail bool, args *[]string) *client.SegmentCommand {
 	}
 
 	url := (*args)[0]
-	proto, _, _, _, err := utils.ParseUrl(url)
+	_, _, _, _, err := utils.ParseUrl(url)
 	if err != nil {
 		createFail(fmt.Sprintf("Unable to parse URL: %v", url))
 	}
-	if proto != "" && proto != "tcp" && proto != "udp" {
-		createFail("Only tcp and udp protocols are currently supported.")
-	}
 	*args = (*args)[1:]
 	return &client.SegmentCommand{Type: client.URL, Tail: tail, Arg: url}
 }
@@ -229,9 +543,99 @@ func parseDockerRun(tail bool, args *[]string) *client.SegmentCommand {
 	}
 	var run string
 	run, *args = (*args)[0], (*args)[1:]
+	_, err := docker.ParseRun(run)
+	if err != nil {
+		createFail(fmt.Sprintf("Unable to parse ARGS: %v", err))
+	}
 	return &client.SegmentCommand{Type: client.DOCKER_RUN, Tail: tail, Arg: run}
 }
 
+func parseReady(args *[]string) *client.SegmentCommand {
+	if len(*args) < 2 {
+		createFail("Arguments TIMEOUT and POLICY are required for ready")
+	}
+	var timeout, policy string
+	timeout, policy, *args = (*args)[0], (*args)[1], (*args)[2:]
+	_, err := time.ParseDuration(timeout)
+	if err != nil {
+		createFail(fmt.Sprintf("Unable to parse TIMEOUT: %v", timeout))
+	}
+	if policy != "health" && policy != "tcp" && !strings.HasPrefix(policy, "log:") {
+		createFail(fmt.Sprintf("Unknown POLICY: %v", policy))
+	}
+	return &client.SegmentCommand{Type: client.READY, Arg: timeout + " " + policy}
+}
+
+func parseIdle(args *[]string) *client.SegmentCommand {
+	if len(*args) < 2 {
+		createFail("Arguments TIMEOUT and ACTION are required for idle")
+	}
+	var timeout, action string
+	timeout, action, *args = (*args)[0], (*args)[1], (*args)[2:]
+	_, err := time.ParseDuration(timeout)
+	if err != nil {
+		createFail(fmt.Sprintf("Unable to parse TIMEOUT: %v", timeout))
+	}
+	if action != "stop" && action != "remove" {
+		createFail(fmt.Sprintf("Unknown ACTION: %v", action))
+	}
+	return &client.SegmentCommand{Type: client.IDLE, Arg: timeout + " " + action}
+}
+
+func parseBalance(args *[]string) *client.SegmentCommand {
+	if len(*args) == 0 {
+		createFail("Argument STRATEGY is required for balance")
+	}
+	var strategy string
+	strategy, *args = (*args)[0], (*args)[1:]
+	return &client.SegmentCommand{Type: client.BALANCE, Arg: strategy}
+}
+
+func parseAffinity(args *[]string) *client.SegmentCommand {
+	if len(*args) == 0 {
+		createFail("Argument TTL is required for affinity")
+	}
+	var ttl string
+	ttl, *args = (*args)[0], (*args)[1:]
+	_, err := time.ParseDuration(ttl)
+	if err != nil {
+		createFail(fmt.Sprintf("Unable to parse TTL: %v", ttl))
+	}
+	return &client.SegmentCommand{Type: client.AFFINITY, Arg: ttl}
+}
+
+func parseHealth(args *[]string) *client.SegmentCommand {
+	if len(*args) < 2 {
+		createFail("Arguments INTERVAL and CHECK are required for health")
+	}
+	var interval, check string
+	interval, check, *args = (*args)[0], (*args)[1], (*args)[2:]
+	_, err := time.ParseDuration(interval)
+	if err != nil {
+		createFail(fmt.Sprintf("Unable to parse INTERVAL: %v", interval))
+	}
+	if check != "tcp" && !strings.HasPrefix(check, "http:") && !strings.HasPrefix(check, "exec:") {
+		createFail(fmt.Sprintf("Unknown CHECK: %v", check))
+	}
+	return &client.SegmentCommand{Type: client.HEALTH, Arg: interval + " " + check}
+}
+
+func parseWeight(tail bool, args *[]string) *client.SegmentCommand {
+	if !tail {
+		createFail("Weight can only be set on a tail")
+	}
+	if len(*args) == 0 {
+		createFail("Argument WEIGHT is required for weight")
+	}
+	var weight string
+	weight, *args = (*args)[0], (*args)[1:]
+	n, err := strconv.Atoi(weight)
+	if err != nil || n <= 0 {
+		createFail(fmt.Sprintf("Invalid value for WEIGHT: %v", weight))
+	}
+	return &client.SegmentCommand{Type: client.WEIGHT, Tail: tail, Arg: weight}
+}
+
 func parseChild() *client.SegmentCommand {
 	return &client.SegmentCommand{Type: client.CHILD}
 }
@@ -253,27 +657,38 @@ func parseRemote(args *[]string) *client.SegmentCommand {
 }
 
 func parseTunnel(args *[]string) *client.SegmentCommand {
-	if len(*args) == 0 {
-		createFail("Argument HOST is required for tunnel")
-	}
-	host, err := utils.ValidateAddr((*args)[0])
-	if err != nil {
-		createFail(fmt.Sprintf("Unable to parse HOST: %v", host))
-	}
-	*args = (*args)[1:]
-	return &client.SegmentCommand{Type: client.TUNNEL, Arg: host}
+	return parseTunnelCommand(args, "tunnel", client.TUNNEL)
 }
 
 func parseUdptunnel(args *[]string) *client.SegmentCommand {
+	return parseTunnelCommand(args, "udptunnel", client.UDPTUNNEL)
+}
+
+// parseTunnelCommand parses [--driver DRIVER] HOST. The driver is appended
+// to the host in Arg and wormholed uses its -driver if it is missing.
+func parseTunnelCommand(args *[]string, name string, commandType int) *client.SegmentCommand {
+	driver := ""
+	if len(*args) > 0 && (*args)[0] == "--driver" {
+		if len(*args) < 2 {
+			createFail("Argument DRIVER is required for --driver")
+		}
+		driver, *args = (*args)[1], (*args)[2:]
+		if driver != client.DriverXfrm && driver != client.DriverWireguard {
+			createFail(fmt.Sprintf("Unknown DRIVER: %v", driver))
+		}
+	}
 	if len(*args) == 0 {
-		createFail("Argument HOST is required for udptunnel")
+		createFail(fmt.Sprintf("Argument HOST is required for %s", name))
 	}
 	host, err := utils.ValidateAddr((*args)[0])
 	if err != nil {
 		createFail(fmt.Sprintf("Unable to parse HOST: %v", host))
 	}
 	*args = (*args)[1:]
-	return &client.SegmentCommand{Type: client.UDPTUNNEL, Arg: host}
+	if driver != "" {
+		host += " " + driver
+	}
+	return &client.SegmentCommand{Type: commandType, Arg: host}
 }
 
 func createFail(msg string) {
@@ -285,7 +700,8 @@ func usage(command string) {
 	u := ""
 	if command == "" {
 		u = `Usage: %s [ OPTIONS ] [ help ] COMMAND { SUBCOMMAND ... }
-where  COMMAND := { ping | create | delete | tunnel-create | tunnel-delete }
+where  COMMAND := { ping | create | delete | list | show | stats |
+                   tunnel-create | tunnel-delete | tunnel-list }
        OPTIONS := { -K[eyfile] | -H[ost] }`
 	} else {
 		switch command {
@@ -296,15 +712,16 @@ Pings wormholed on HOST  and prints the latency in ms.`
 			u = `Usage: %s create { SUBCOMMAND ... }
 where  SUBCOMMAND := { url | name | docker-ns | docker-run | child |
                        child | chain | remote | tunnel | udptunnel |
-                       tail | trigger }
+                       ready | idle | balance | affinity | health |
+                       weight | tail | next | trigger }
 
 Creates a proxy wormhole. The wormhole has a head and a tail. The head
 represents where the proxy listens, and the tail represents where the
 proxy connects. Both the head and the tail have the following values:
 
-    protocol: the protocol of the connection (currently udp or tcp)
+    protocol: the protocol of the connection (tcp, udp or unix)
     namespace: the network namespace of the connection
-    host: hostname or ip address of the connection
+    host: hostname or ip address of the connection, or the socket path
     port: port of the connection
 
 Prints the id and the listen url of the wormhole.
@@ -315,6 +732,8 @@ SUBCOMMANDS
 url URL
     set the head data to values specified in URL
     URL is in the form {protocol://}{namespace@}{host}{:port}
+    or unix://PATH for a unix socket. PATH is inside the container when
+    used with docker-ns or docker-run
 
 id ID
     sets the id of the wormhole to ID
@@ -324,6 +743,15 @@ docker-ns ID
 
 docker-run ARGS
     docker-run using ARGS and set the namespace to the container's namespace
+    ARGS is quoted like a shell command: [ OPTIONS ] IMAGE [ COMMAND ... ]
+    where OPTIONS := { -d | -i | -t | -P | --privileged | --rm |
+                       -e ENV | -l LABEL | -v VOLUME | --volumes-from ID |
+                       --name NAME | -w WORKDIR | -u USER | -h HOSTNAME |
+                       --entrypoint CMD | -p [[IP:]HOSTPORT:]PORT[/PROTO] |
+                       --net NET | --link LINK | --dns IP | --add-host H:IP |
+                       --cap-add CAP | --cap-drop CAP | --restart POLICY |
+                       -m MEMORY | --ipc MODE | --pid MODE }
+    other docker run options are rejected
 
 child
     create a child wormhole using the current proxy values as a base
@@ -338,36 +766,111 @@ remote HOST
     create a child wormhole on HOST
     set the current wormhole's tail values to the child wormhole
 
-tunnel HOST
-    create an ipsec tunnel to HOST
+tunnel [--driver DRIVER] HOST
+    create a tunnel to HOST with DRIVER (xfrm or wireguard), which defaults
+    to the -driver of wormholed
     create a child wormhole on HOST
     set the current wormhole's tail values to the child wormhole
 
-udptunnel HOST
-    create an ipsec tunnel to HOST using espinudp encapsulation
+udptunnel [--driver DRIVER] HOST
+    create a tunnel to HOST like tunnel using espinudp encapsulation for
+    xfrm tunnels
     create a child wormhole on HOST
     set the current wormhole's tail values to the child wormhole
 
+ready TIMEOUT POLICY
+    wait up to TIMEOUT for the tail to be ready before proxying connections
+    to it. Connections are held while waiting. POLICY is one of:
+        health       the last docker-run container reports healthy
+        tcp          the tail accepts tcp connections
+        log:PATTERN  the last docker-run container logs a line matching PATTERN
+
+idle TIMEOUT ACTION
+    once the wormhole has been triggered and has had no connections for
+    TIMEOUT, undo the trigger commands so the next connection runs them
+    again. Child wormholes created by triggers are deleted and docker-run
+    containers started by triggers are handled according to ACTION:
+        stop    stop the containers and start them again on the next
+                connection. They are removed when the wormhole is deleted
+        remove  remove the containers
+
+balance STRATEGY
+    choose how connections are balanced when the wormhole has more than one
+    tail. STRATEGY is one of:
+        round-robin  use each tail in turn (default)
+        least-conn   use the tail with the fewest open connections
+        random-two   pick two random tails and use the one with fewer
+                     open connections
+        weighted     use each tail in proportion to its weight
+        consistent-hash
+                     send each client ip to the same tail. Most clients
+                     keep their tail when tails are added or removed
+
+health INTERVAL CHECK
+    check the tails every INTERVAL and stop sending connections to tails
+    that fail 3 checks in a row until they pass 2. CHECK is one of:
+        tcp           connect to the tail
+        http:PATH     GET PATH from the tail and expect a 2xx or 3xx status
+        exec:COMMAND  run COMMAND in the namespace of the tail and expect
+                      it to succeed. The tail address is in
+                      $WORMHOLE_ENDPOINT
+
+affinity TTL
+    send connections from the same client ip to the same tail until the
+    client has not connected for TTL, regardless of the balance strategy
+
+weight WEIGHT
+    set the weight of the tail for the weighted strategy (default 1)
+
 tail
     all following commands modify the tail instead of the head
 
+next
+    start another tail of the wormhole. All following commands modify the
+    new tail. Connections are balanced between the tails
+
 trigger
     all following commands modify the tail instead of the head
     all following commands are executed when something connects to the head
 
 `
 		case "delete":
-			u = `Usage: %s delete ID
-Deletes the proxy wormhole ID.`
+			u = `Usage: %s delete [--drain TIMEOUT [--force]] ID
+Deletes the proxy wormhole ID. If --drain is specified new connections
+are refused and open connections are given up to TIMEOUT to finish before
+the children and containers are removed. Connections still open after
+TIMEOUT are closed if --force is specified, otherwise the delete fails
+and the wormhole keeps draining until it is deleted again.`
+		case "list":
+			u = `Usage: %s list [--json]
+Lists the proxy wormholes on the server. If --json is specified the
+output is printed as json.`
+		case "show":
+			u = `Usage: %s show [--json] ID
+Shows the details of the proxy wormhole ID including pending init and
+trigger commands. If --json is specified the output is printed as json.`
+		case "stats":
+			u = `Usage: %s stats [--json] ID
+Shows the connection and traffic counters of the proxy wormhole ID and
+each of its tails. If --json is specified the output is printed as json.`
 		case "tunnel-create":
-			u = `Usage: %s tunnel-create [--udp] HOST
-Creates an ipsec tunnel to HOST and prints out the source and destination
-tunnel ip addresses. If --udp is specified the tunnel will use espinudp
-encapsulation. Wormholed must be running on HOST with the same key as the
-local wormholed.`
+			u = `Usage: %s tunnel-create [--udp] [--driver DRIVER] HOST
+Creates a tunnel to HOST and prints out the source and destination tunnel
+ip addresses. DRIVER is xfrm for an ipsec tunnel or wireguard for a
+wireguard link and defaults to the -driver of wormholed. If --udp is specified an xfrm tunnel will use
+espinudp encapsulation. Wormholed must be running on HOST with the same key
+as the local wormholed.`
 		case "tunnel-delete":
 			u = `Usage: %s tunnel-delete HOST
-Deletes an ipsec tunnel to HOST.`
+Deletes the tunnel to HOST.`
+		case "tunnel-list":
+			u = `Usage: %s tunnel-list [--json] [--show-keys]
+Lists the tunnels on the server with the external ip of each peer, the
+overlay ips, the reqid, the driver, the cipher, the local:remote udp ports,
+whether the tunnel was created by wormholed or discovered when it started
+and whether echoes through the tunnel succeed. Keys are only printed if
+--show-keys is specified. If --json is specified the output is printed as
+json.`
 		default:
 			log.Printf("Unknown command: %v", command)
 		}
@@ -405,10 +908,18 @@ func Main() {
 		segmentCreate(args, c)
 	case "delete":
 		segmentDelete(args, c)
+	case "list":
+		segmentList(args, c)
+	case "show":
+		segmentShow(args, c)
+	case "stats":
+		segmentStats(args, c)
 	case "tunnel-create":
 		tunnelCreate(args, c)
 	case "tunnel-delete":
 		tunnelDelete(args, c)
+	case "tunnel-list":
+		tunnelList(args, c)
 	default:
 		log.Printf("Unknown command: %v", command)
 		usage("")
@@ -2,7 +2,9 @@ package cli
 
 import (
 	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/utils"
 	"testing"
+	"time"
 )
 
 func validateBasicParse(t *testing.T, args []string, commandType int) {
@@ -106,3 +108,109 @@ func TestSegmentParseTrigger(t *testing.T) {
 		t.Fatalf("Types don't match, %v: %s != %s", args, client.CommandName[trig[0].Type], client.CommandName[client.DOCKER_RUN])
 	}
 }
+
+func TestCommandsString(t *testing.T) {
+	args := []string{"url", ":40", "remote", "bar", "trigger", "docker-run", "baz"}
+	_, init, _, err := parseSegment(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := commandsString(init, false)
+	if s != "url :40 remote tcp://bar:9999 trigger docker-run baz" {
+		t.Fatalf("Unexpected command string: %s", s)
+	}
+}
+
+func TestSegmentParseReady(t *testing.T) {
+	args := []string{"url", ":40", "trigger", "docker-run", "baz", "ready", "30s", "log:ready for connections"}
+	_, _, trig, err := parseSegment(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trig) != 2 || trig[1].Type != client.READY {
+		t.Fatalf("Ready not parsed as trigger action: %v", trig)
+	}
+	if trig[1].Arg != "30s log:ready for connections" {
+		t.Fatalf("Unexpected ready arg: %v", trig[1].Arg)
+	}
+}
+
+func TestSegmentParseIdle(t *testing.T) {
+	args := []string{"url", ":40", "idle", "10m", "remove", "trigger", "docker-run", "baz"}
+	_, init, trig, err := parseSegment(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(init) != 2 || init[1].Type != client.IDLE || init[1].Arg != "10m remove" {
+		t.Fatalf("Idle not parsed as init action: %v", init)
+	}
+	if len(trig) != 1 {
+		t.Fatalf("Wrong number of trigger actions: %v", trig)
+	}
+}
+
+func TestSegmentParseHealth(t *testing.T) {
+	args := []string{"url", ":40", "health", "5s", "http:/status", "tail", "url", ":41"}
+	_, init, _, err := parseSegment(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(init) != 3 || init[1].Type != client.HEALTH || init[1].Arg != "5s http:/status" {
+		t.Fatalf("Health not parsed as init action: %v", init)
+	}
+}
+
+func TestSegmentParseNext(t *testing.T) {
+	args := []string{"url", ":40", "balance", "least-conn", "tail", "url", ":41", "weight", "2",
+		"next", "remote", "foo", "url", ":42", "next", "trigger", "docker-run", "baz"}
+	_, init, trig, err := parseSegment(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(init) != 5 || init[4].Type != client.REMOTE || init[4].TailIndex != 1 {
+		t.Fatalf("Second tail not parsed: %v", init)
+	}
+	if len(init[4].ChildInit) != 1 {
+		t.Fatalf("Remote commands not chained: %v", init[4])
+	}
+	if len(trig) != 1 || trig[0].TailIndex != 2 || !trig[0].Tail {
+		t.Fatalf("Third tail not parsed: %v", trig)
+	}
+	s := commandsString(init, false)
+	if s != "url :40 balance least-conn tail url :41 weight 2 next remote tcp://foo:9999 url :42" {
+		t.Fatalf("Unexpected command string: %s", s)
+	}
+}
+
+func TestParseDelete(t *testing.T) {
+	for _, args := range [][]string{
+		{"--drain", "30s", "--force", "foo"},
+		{"foo", "--drain", "30s", "--force"},
+		{"--force", "foo", "--drain=30s"},
+	} {
+		id, drain, force, err := parseDelete(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "foo" || drain != 30*time.Second || !force {
+			t.Fatalf("Unexpected delete args for %v: %s %v %v", args, id, drain, force)
+		}
+	}
+	for _, args := range [][]string{{}, {"foo", "bar"}, {"foo", "--drain"}, {"foo", "--bogus"}, {"--drain", "soon", "foo"}} {
+		_, _, _, err := parseDelete(args)
+		if err == nil {
+			t.Fatalf("No error for %v", args)
+		}
+	}
+}
+
+func TestParseTunnelDriver(t *testing.T) {
+	_, init, _, err := parseSegment([]string{"tunnel", "--driver", "wireguard", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := utils.ValidateAddr("foo")
+	if len(init) != 1 || init[0].Type != client.TUNNEL || init[0].Arg != host+" wireguard" {
+		t.Fatalf("Tunnel parse failed: %v", init)
+	}
+}
@@ -2,10 +2,14 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/raff/tls-ext"
 	"github.com/vishvananda/wormhole/utils"
 	"net"
 	"net/rpc"
+	"strconv"
+	"time"
 )
 
 const (
@@ -18,6 +22,12 @@ const (
 	REMOTE     = iota
 	TUNNEL     = iota
 	UDPTUNNEL  = iota
+	READY      = iota
+	IDLE       = iota
+	BALANCE    = iota
+	WEIGHT     = iota
+	AFFINITY   = iota
+	HEALTH     = iota
 )
 
 var CommandName = []string{
@@ -28,29 +38,206 @@ var CommandName = []string{
 	CHAIN:      "chain",
 	REMOTE:     "remote",
 	TUNNEL:     "tunnel",
+	UDPTUNNEL:  "udptunnel",
 	URL:        "url",
+	READY:      "ready",
+	IDLE:       "idle",
+	BALANCE:    "balance",
+	WEIGHT:     "weight",
+	AFFINITY:   "affinity",
+	HEALTH:     "health",
+}
+
+// CommandType returns the command type for name.
+func CommandType(name string) (int, error) {
+	for t, n := range CommandName {
+		if n == name {
+			return t, nil
+		}
+	}
+	return NONE, fmt.Errorf("Command %s not recognized", name)
 }
 
+// SegmentCommand modifies the head of a segment or, if Tail is set, the tail
+// numbered TailIndex.
 type SegmentCommand struct {
 	Type      int
 	Tail      bool
+	TailIndex int
 	Arg       string
 	ChildInit []SegmentCommand
 	ChildTrig []SegmentCommand
 }
 
+// jsonSegmentCommand is the json schema for SegmentCommand. The type is
+// encoded by name so the schema does not depend on the constant values.
+type jsonSegmentCommand struct {
+	Type      string           `json:"type"`
+	Tail      bool             `json:"tail,omitempty"`
+	TailIndex int              `json:"tail_index,omitempty"`
+	Arg       string           `json:"arg,omitempty"`
+	ChildInit []SegmentCommand `json:"child_init,omitempty"`
+	ChildTrig []SegmentCommand `json:"child_trig,omitempty"`
+}
+
+func (s SegmentCommand) MarshalJSON() ([]byte, error) {
+	if s.Type < 0 || s.Type >= len(CommandName) {
+		return nil, fmt.Errorf("Command type %d not recognized", s.Type)
+	}
+	return json.Marshal(jsonSegmentCommand{CommandName[s.Type], s.Tail, s.TailIndex, s.Arg, s.ChildInit, s.ChildTrig})
+}
+
+func (s *SegmentCommand) UnmarshalJSON(b []byte) error {
+	j := jsonSegmentCommand{}
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	t, err := CommandType(j.Type)
+	if err != nil {
+		return err
+	}
+	*s = SegmentCommand{t, j.Tail, j.TailIndex, j.Arg, j.ChildInit, j.ChildTrig}
+	return nil
+}
+
+// Tunnel ciphers from strongest to weakest. The aead ciphers use EncKey
+// followed by a 4 byte salt as the key and have no AuthKey.
+const (
+	CipherAesGcm           = "rfc4106(gcm(aes))"
+	CipherChaCha20Poly1305 = "rfc7539esp(chacha20,poly1305)"
+	CipherAesCbc           = "hmac(sha256)+cbc(aes)"
+)
+
+// Ciphers lists the tunnel ciphers from strongest to weakest.
+var Ciphers = []string{CipherAesGcm, CipherChaCha20Poly1305, CipherAesCbc}
+
+// Tunnel drivers. Xfrm tunnels are ipsec tunnels programmed with xfrm
+// states and policies. Wireguard tunnels use a wireguard link per tunnel.
+const (
+	DriverXfrm      = "xfrm"
+	DriverWireguard = "wireguard"
+)
+
+// Tunnel describes one end of a tunnel. Tunnels without a Driver use
+// DriverXfrm. Tunnels without a Cipher were created by older versions and
+// use CipherAesCbc. Both directions use the same Spi, which is the Reqid
+// until the tunnel is rekeyed. KeyTime is when the keys were installed.
+//
+// Wireguard tunnels do not use the ipsec fields. PublicKey belongs to the
+// Src end and PeerKey to the Dst end. PrivateKey is the key of the local
+// end and is never sent to the peer.
 type Tunnel struct {
-	Reqid   int
-	AuthKey []byte
-	EncKey  []byte
-	Src     net.IP
-	Dst     net.IP
-	SrcPort int
-	DstPort int
+	Reqid      int       `json:"reqid"`
+	Driver     string    `json:"driver,omitempty"`
+	Spi        int       `json:"spi,omitempty"`
+	Cipher     string    `json:"cipher,omitempty"`
+	AuthKey    []byte    `json:"auth_key"`
+	EncKey     []byte    `json:"enc_key"`
+	PrivateKey []byte    `json:"private_key,omitempty"`
+	PublicKey  []byte    `json:"public_key,omitempty"`
+	PeerKey    []byte    `json:"peer_key,omitempty"`
+	Src        net.IP    `json:"src"`
+	Dst        net.IP    `json:"dst"`
+	SrcPort    int       `json:"src_port,omitempty"`
+	DstPort    int       `json:"dst_port,omitempty"`
+	KeyTime    time.Time `json:"key_time"`
+}
+
+// DriverName returns the driver of t.
+func (t Tunnel) DriverName() string {
+	if t.Driver == "" {
+		return DriverXfrm
+	}
+	return t.Driver
+}
+
+// SpiValue returns the spi of the states of t.
+func (t Tunnel) SpiValue() int {
+	if t.Spi == 0 {
+		return t.Reqid
+	}
+	return t.Spi
+}
+
+// CipherName returns the cipher of t.
+func (t Tunnel) CipherName() string {
+	if t.Cipher == "" {
+		return CipherAesCbc
+	}
+	return t.Cipher
 }
 
 func (t Tunnel) Equal(o *Tunnel) bool {
-	return t.Reqid == o.Reqid && bytes.Equal(t.AuthKey, o.AuthKey) && bytes.Equal(t.EncKey, o.EncKey) && t.Src.Equal(o.Src) && t.Dst.Equal(o.Dst) && t.SrcPort == o.SrcPort && t.DstPort == o.DstPort
+	return t.Reqid == o.Reqid && t.DriverName() == o.DriverName() && t.SpiValue() == o.SpiValue() && t.CipherName() == o.CipherName() &&
+		bytes.Equal(t.PublicKey, o.PublicKey) && bytes.Equal(t.PeerKey, o.PeerKey) && bytes.Equal(t.AuthKey, o.AuthKey) && bytes.Equal(t.EncKey, o.EncKey) && t.Src.Equal(o.Src) && t.Dst.Equal(o.Dst) && t.SrcPort == o.SrcPort && t.DstPort == o.DstPort
+}
+
+// ConnectionInfo describes one end of a segment. Ns is a description of
+// the namespace handle and is empty when the default namespace is used.
+type ConnectionInfo struct {
+	Proto    string `json:"proto"`
+	Ns       string `json:"ns,omitempty"`
+	Hostname string `json:"hostname"`
+	Port     int    `json:"port"`
+}
+
+func (c ConnectionInfo) String() string {
+	if c.Proto == "" {
+		return ""
+	}
+	if c.Proto == "unix" {
+		return "unix://" + c.Hostname
+	}
+	return fmt.Sprintf("%s://%s", c.Proto, net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port)))
+}
+
+// TailInfo is the externally visible state of one tail of a segment.
+// Health is empty unless the segment has a health check.
+type TailInfo struct {
+	ConnectionInfo
+	Weight      int    `json:"weight,omitempty"`
+	ChildHost   string `json:"child_host,omitempty"`
+	ChildId     string `json:"child_id,omitempty"`
+	Health      string `json:"health,omitempty"`
+	HealthError string `json:"health_error,omitempty"`
+}
+
+// SegmentInfo is the externally visible state of a segment.
+type SegmentInfo struct {
+	Id        string           `json:"id"`
+	Head      ConnectionInfo   `json:"head"`
+	Tails     []TailInfo       `json:"tails"`
+	Balance   string           `json:"balance"`
+	Init      []SegmentCommand `json:"init"`
+	Trig      []SegmentCommand `json:"trig"`
+	DockerIds []string         `json:"docker_ids"`
+	Triggered bool             `json:"triggered"`
+}
+
+// Stats are the connection and traffic counters of a segment or of one of
+// its tails. BytesIn flows from clients to tails and BytesOut back.
+type Stats struct {
+	Accepted    uint64        `json:"accepted"`
+	Active      int64         `json:"active"`
+	Failed      uint64        `json:"failed"`
+	BytesIn     uint64        `json:"bytes_in"`
+	BytesOut    uint64        `json:"bytes_out"`
+	Dials       uint64        `json:"dials"`
+	DialTime    time.Duration `json:"dial_time"`
+	MaxDialTime time.Duration `json:"max_dial_time"`
+}
+
+// SegmentStats are the counters of a segment. Tails are in the same order
+// as in SegmentInfo. TriggerTime is the total time spent running trigger
+// commands and TriggerErrors is the number of times they failed.
+type SegmentStats struct {
+	Id string `json:"id"`
+	Stats
+	Triggers      uint64        `json:"triggers"`
+	TriggerTime   time.Duration `json:"trigger_time"`
+	TriggerErrors uint64        `json:"trigger_errors"`
+	Tails         []Stats       `json:"tails"`
 }
 
 func (s *SegmentCommand) AddInit(c *SegmentCommand) {
@@ -65,26 +252,49 @@ type Client struct {
 	RpcClient *rpc.Client
 }
 
+// NewClient connects to wormholed at host. Unix sockets are authorized by
+// the server using peer credentials so tls is only used for tcp.
 func NewClient(host string, config *tls.Config) (*Client, error) {
 	proto, address := utils.ParseAddr(host)
-	conn, err := tls.Dial(proto, address, config)
+	var conn net.Conn
+	var err error
+	if proto == "unix" {
+		conn, err = net.Dial(proto, address)
+	} else {
+		conn, err = tls.Dial(proto, address, config)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &Client{rpc.NewClient(conn)}, nil
 }
 
+// NewClientTimeout connects like NewClient for a short exchange. Connecting
+// and every call on the client must finish within timeout.
+func NewClientTimeout(host string, config *tls.Config, timeout time.Duration) (*Client, error) {
+	proto, address := utils.ParseAddr(host)
+	conn, err := net.DialTimeout(proto, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proto != "unix" {
+		conn = tls.Client(conn, config)
+	}
+	return &Client{rpc.NewClient(conn)}, nil
+}
+
 func (c *Client) Close() error {
 	return c.RpcClient.Close()
 }
 
 type EchoArgs struct {
-	Value []byte
-	Host  string
+	Value []byte `json:"value"`
+	Host  string `json:"host,omitempty"`
 }
 
 type EchoReply struct {
-	Value []byte
+	Value []byte `json:"value"`
 }
 
 func (c *Client) Echo(value []byte, host string) ([]byte, error) {
@@ -94,19 +304,22 @@ func (c *Client) Echo(value []byte, host string) ([]byte, error) {
 	return reply.Value, err
 }
 
+// CreateTunnelArgs creates a tunnel to Host with Driver, which defaults to
+// the -driver of wormholed. Udp only applies to xfrm tunnels.
 type CreateTunnelArgs struct {
-	Host string
-	Udp  bool
+	Host   string `json:"host"`
+	Udp    bool   `json:"udp,omitempty"`
+	Driver string `json:"driver,omitempty"`
 }
 
 type CreateTunnelReply struct {
-	Src net.IP
-	Dst net.IP
+	Src net.IP `json:"src"`
+	Dst net.IP `json:"dst"`
 }
 
-func (c *Client) CreateTunnel(host string, udp bool) (net.IP, net.IP, error) {
+func (c *Client) CreateTunnel(host string, udp bool, driver string) (net.IP, net.IP, error) {
 	reply := CreateTunnelReply{}
-	args := CreateTunnelArgs{host, udp}
+	args := CreateTunnelArgs{host, udp, driver}
 	err := c.RpcClient.Call("Api.CreateTunnel", args, &reply)
 	return reply.Src, reply.Dst, err
 }
@@ -125,14 +338,49 @@ func (c *Client) DeleteTunnel(host string) error {
 	return err
 }
 
+// Tunnel statuses. Tunnels are unknown until they have been checked.
+const (
+	TunnelUnknown = "unknown"
+	TunnelUp      = "up"
+	TunnelDown    = "down"
+)
+
+// TunnelInfo describes the tunnel to the peer with external ip Host.
+// Discovered tunnels were found in the kernel when wormholed started. The
+// keys are empty unless they were requested. Status changed at StatusTime
+// and Rebuilds counts the times the tunnel was rebuilt after going down.
+type TunnelInfo struct {
+	Host string `json:"host"`
+	Tunnel
+	Discovered bool      `json:"discovered"`
+	Status     string    `json:"status"`
+	StatusTime time.Time `json:"status_time"`
+	Rebuilds   int       `json:"rebuilds"`
+}
+
+type ListTunnelsArgs struct {
+	Keys bool `json:"keys,omitempty"`
+}
+
+type ListTunnelsReply struct {
+	Tunnels []TunnelInfo `json:"tunnels"`
+}
+
+func (c *Client) ListTunnels(keys bool) ([]TunnelInfo, error) {
+	reply := ListTunnelsReply{}
+	args := ListTunnelsArgs{keys}
+	err := c.RpcClient.Call("Api.ListTunnels", args, &reply)
+	return reply.Tunnels, err
+}
+
 type CreateSegmentArgs struct {
-	Id   string
-	Init []SegmentCommand
-	Trig []SegmentCommand
+	Id   string           `json:"id"`
+	Init []SegmentCommand `json:"init"`
+	Trig []SegmentCommand `json:"trig"`
 }
 
 type CreateSegmentReply struct {
-	Url string
+	Url string `json:"url"`
 }
 
 func (c *Client) CreateSegment(id string, init []SegmentCommand, trig []SegmentCommand) (string, error) {
@@ -142,26 +390,81 @@ func (c *Client) CreateSegment(id string, init []SegmentCommand, trig []SegmentC
 	return reply.Url, err
 }
 
+// DeleteSegmentArgs drain the segment for up to Drain before deleting it.
+// Connections still open after Drain are closed if Force is set, otherwise
+// the delete fails and the segment keeps draining.
 type DeleteSegmentArgs struct {
-	Id string
+	Id    string
+	Drain time.Duration
+	Force bool
 }
 
 type DeleteSegmentReply struct {
 }
 
-func (c *Client) DeleteSegment(id string) error {
+func (c *Client) DeleteSegment(id string, drain time.Duration, force bool) error {
 	reply := DeleteSegmentReply{}
-	args := DeleteSegmentArgs{id}
+	args := DeleteSegmentArgs{id, drain, force}
 	err := c.RpcClient.Call("Api.DeleteSegment", args, &reply)
 	return err
 }
 
+type ListSegmentsArgs struct {
+}
+
+type ListSegmentsReply struct {
+	Segments []SegmentInfo
+}
+
+func (c *Client) ListSegments() ([]SegmentInfo, error) {
+	reply := ListSegmentsReply{}
+	args := ListSegmentsArgs{}
+	err := c.RpcClient.Call("Api.ListSegments", args, &reply)
+	return reply.Segments, err
+}
+
+type GetSegmentArgs struct {
+	Id string
+}
+
+type GetSegmentReply struct {
+	Segment SegmentInfo
+}
+
+func (c *Client) GetSegment(id string) (*SegmentInfo, error) {
+	reply := GetSegmentReply{}
+	args := GetSegmentArgs{id}
+	err := c.RpcClient.Call("Api.GetSegment", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Segment, nil
+}
+
+type GetSegmentStatsArgs struct {
+	Id string
+}
+
+type GetSegmentStatsReply struct {
+	Stats SegmentStats
+}
+
+func (c *Client) GetSegmentStats(id string) (*SegmentStats, error) {
+	reply := GetSegmentStatsReply{}
+	args := GetSegmentStatsArgs{id}
+	err := c.RpcClient.Call("Api.GetSegmentStats", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Stats, nil
+}
+
 type GetSrcIPArgs struct {
 	Dst net.IP
 }
 
 type GetSrcIPReply struct {
-	Src net.IP
+	Src net.IP `json:"src"`
 }
 
 func (c *Client) GetSrcIP(dst net.IP) (net.IP, error) {
@@ -171,9 +474,13 @@ func (c *Client) GetSrcIP(dst net.IP) (net.IP, error) {
 	return reply.Src, err
 }
 
+// BuildTunnelArgs asks the remote end to build tunnel. If the cipher of
+// tunnel is empty the remote end chooses the strongest one in Ciphers
+// that it supports.
 type BuildTunnelArgs struct {
-	Dst    net.IP
-	Tunnel *Tunnel
+	Dst     net.IP
+	Tunnel  *Tunnel
+	Ciphers []string
 }
 
 type BuildTunnelReply struct {
@@ -181,13 +488,30 @@ type BuildTunnelReply struct {
 	Tunnel *Tunnel
 }
 
-func (c *Client) BuildTunnel(dst net.IP, tunnel *Tunnel) (net.IP, *Tunnel, error) {
+func (c *Client) BuildTunnel(dst net.IP, tunnel *Tunnel, ciphers []string) (net.IP, *Tunnel, error) {
 	reply := BuildTunnelReply{}
-	args := BuildTunnelArgs{dst, tunnel}
+	args := BuildTunnelArgs{dst, tunnel, ciphers}
 	err := c.RpcClient.Call("Api.BuildTunnel", args, &reply)
 	return reply.Src, reply.Tunnel, err
 }
 
+// RekeyTunnelArgs asks the remote end of the tunnel to Dst to install
+// states with the spi and keys of Tunnel alongside its current ones.
+type RekeyTunnelArgs struct {
+	Dst    net.IP
+	Tunnel *Tunnel
+}
+
+// RekeyTunnel has no reply value
+type RekeyTunnelReply struct {
+}
+
+func (c *Client) RekeyTunnel(dst net.IP, tunnel *Tunnel) error {
+	reply := RekeyTunnelReply{}
+	args := RekeyTunnelArgs{dst, tunnel}
+	return c.RpcClient.Call("Api.RekeyTunnel", args, &reply)
+}
+
 type DestroyTunnelArgs struct {
 	Dst net.IP
 }
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSegmentCommandJson(t *testing.T) {
+	c := SegmentCommand{Type: REMOTE, Arg: "tcp://foo:9999"}
+	c.AddTrig(&SegmentCommand{Type: DOCKER_RUN, Tail: true, Arg: "mysql"})
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"remote","arg":"tcp://foo:9999","child_trig":[{"type":"docker-run","tail":true,"arg":"mysql"}]}`
+	if string(b) != expected {
+		t.Fatalf("Unexpected json: %s", b)
+	}
+	out := SegmentCommand{}
+	err = json.Unmarshal(b, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Type != REMOTE || len(out.ChildTrig) != 1 || out.ChildTrig[0].Type != DOCKER_RUN || !out.ChildTrig[0].Tail {
+		t.Fatalf("Command did not survive round trip: %v", out)
+	}
+}
+
+func TestSegmentCommandJsonUnknown(t *testing.T) {
+	out := SegmentCommand{}
+	err := json.Unmarshal([]byte(`{"type":"bogus"}`), &out)
+	if err == nil {
+		t.Fatal("No error for unknown command type")
+	}
+}
+
+func TestNewClientTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the listener never answers
+	c, err := NewClientTimeout("tcp://"+l.Addr().String(), nil, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	_, err = c.Echo([]byte{1}, "")
+	if err == nil {
+		t.Fatalf("Expected echo to time out")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Echo took %v", time.Since(start))
+	}
+}
@@ -168,6 +168,10 @@ func (c *Context) Logf(format string, arg ...interface{}) {
 
 func (c *Context) start(name string, arg ...string) {
 	s := Server{}
+	if name == SERVER {
+		// servers share a host so they must not share a state file
+		arg = append([]string{"-S", ""}, arg...)
+	}
 	s.Cmd = exec.Command(name, arg...)
 	s.CommandLine = strings.Join(append([]string{name}, arg...), " ")
 
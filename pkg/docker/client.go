@@ -0,0 +1,402 @@
+// Package docker is a minimal client for the docker engine api.
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Error is returned when the engine responds with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("docker: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound returns true if err is a not found error from the engine.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Client talks to the docker engine api over http.
+type Client struct {
+	client *http.Client
+	base   string
+}
+
+// NewClient returns a client for host. Host may be unix://path,
+// tcp://host:port or an http:// url.
+func NewClient(host string) (*Client, error) {
+	parts := strings.SplitN(host, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid docker host: %s", host)
+	}
+	switch parts[0] {
+	case "unix":
+		path := parts[1]
+		transport := &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		}
+		return &Client{&http.Client{Transport: transport}, "http://docker"}, nil
+	case "tcp":
+		return &Client{&http.Client{}, "http://" + parts[1]}, nil
+	case "http", "https":
+		return &Client{&http.Client{}, host}, nil
+	}
+	return nil, fmt.Errorf("Invalid docker host protocol: %s", host)
+}
+
+func (c *Client) do(method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := c.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return readError(res)
+	}
+	if out == nil {
+		// drain the body so the connection can be reused
+		_, err = io.Copy(ioutil.Discard, res.Body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// stream performs a request and returns the response body for the caller
+// to read and close.
+func (c *Client) stream(method string, path string, query url.Values) (io.ReadCloser, error) {
+	u := c.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+	return res.Body, nil
+}
+
+func readError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(res.Body)
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(b, &msg) != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(b))
+	}
+	return &Error{res.StatusCode, msg.Message}
+}
+
+type portBinding struct {
+	HostIp   string `json:",omitempty"`
+	HostPort string `json:",omitempty"`
+}
+
+type hostConfig struct {
+	Binds           []string                 `json:",omitempty"`
+	VolumesFrom     []string                 `json:",omitempty"`
+	PortBindings    map[string][]portBinding `json:",omitempty"`
+	PublishAllPorts bool                     `json:",omitempty"`
+	NetworkMode     string                   `json:",omitempty"`
+	Links           []string                 `json:",omitempty"`
+	Dns             []string                 `json:",omitempty"`
+	ExtraHosts      []string                 `json:",omitempty"`
+	Privileged      bool                     `json:",omitempty"`
+	CapAdd          []string                 `json:",omitempty"`
+	CapDrop         []string                 `json:",omitempty"`
+	AutoRemove      bool                     `json:",omitempty"`
+	RestartPolicy   *RestartPolicy           `json:",omitempty"`
+	Memory          int64                    `json:",omitempty"`
+	IpcMode         string                   `json:",omitempty"`
+	PidMode         string                   `json:",omitempty"`
+}
+
+type createConfig struct {
+	Image        string
+	Cmd          []string            `json:",omitempty"`
+	Entrypoint   []string            `json:",omitempty"`
+	Env          []string            `json:",omitempty"`
+	Labels       map[string]string   `json:",omitempty"`
+	WorkingDir   string              `json:",omitempty"`
+	User         string              `json:",omitempty"`
+	Hostname     string              `json:",omitempty"`
+	ExposedPorts map[string]struct{} `json:",omitempty"`
+	Tty          bool                `json:",omitempty"`
+	OpenStdin    bool                `json:",omitempty"`
+	HostConfig   hostConfig
+}
+
+// newCreateConfig returns the body of a create request for opts.
+func newCreateConfig(opts *RunOptions) *createConfig {
+	config := &createConfig{
+		Image:      opts.Image,
+		Cmd:        opts.Cmd,
+		Entrypoint: opts.Entrypoint,
+		Env:        opts.Env,
+		Labels:     opts.Labels,
+		WorkingDir: opts.WorkingDir,
+		User:       opts.User,
+		Hostname:   opts.Hostname,
+		Tty:        opts.Tty,
+		OpenStdin:  opts.OpenStdin,
+		HostConfig: hostConfig{
+			Binds:           opts.Volumes,
+			VolumesFrom:     opts.VolumesFrom,
+			PublishAllPorts: opts.PublishAll,
+			NetworkMode:     opts.Network,
+			Links:           opts.Links,
+			Dns:             opts.Dns,
+			ExtraHosts:      opts.ExtraHosts,
+			Privileged:      opts.Privileged,
+			CapAdd:          opts.CapAdd,
+			CapDrop:         opts.CapDrop,
+			AutoRemove:      opts.AutoRemove,
+			Memory:          opts.Memory,
+			IpcMode:         opts.IpcMode,
+			PidMode:         opts.PidMode,
+		},
+	}
+	if opts.RestartPolicy.Name != "" {
+		policy := opts.RestartPolicy
+		config.HostConfig.RestartPolicy = &policy
+	}
+	if len(opts.Ports) != 0 {
+		config.ExposedPorts = make(map[string]struct{})
+		config.HostConfig.PortBindings = make(map[string][]portBinding)
+		for _, p := range opts.Ports {
+			config.ExposedPorts[p.ContainerPort] = struct{}{}
+			binding := portBinding{HostIp: p.HostIP, HostPort: p.HostPort}
+			config.HostConfig.PortBindings[p.ContainerPort] = append(config.HostConfig.PortBindings[p.ContainerPort], binding)
+		}
+	}
+	return config
+}
+
+// Create creates a container from opts and returns its id. The image is
+// pulled if it is not present.
+func (c *Client) Create(opts *RunOptions) (string, error) {
+	config := newCreateConfig(opts)
+	query := url.Values{}
+	if opts.Name != "" {
+		query.Set("name", opts.Name)
+	}
+	created := struct {
+		Id string
+	}{}
+	err := c.do("POST", "/containers/create", query, config, &created)
+	if IsNotFound(err) {
+		err = c.Pull(opts.Image)
+		if err != nil {
+			return "", err
+		}
+		err = c.do("POST", "/containers/create", query, config, &created)
+	}
+	if err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+// Pull pulls image from the registry. The engine reports progress as a
+// stream of json messages and failures after the pull started as a message
+// with an error.
+func (c *Client) Pull(image string) error {
+	query := url.Values{}
+	query.Set("fromImage", image)
+	if !strings.Contains(image, "@") {
+		i := strings.LastIndex(image, ":")
+		if i == -1 || strings.Contains(image[i:], "/") {
+			query.Set("tag", "latest")
+		}
+	}
+	body, err := c.stream("POST", "/images/create", query)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		err = decoder.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("Failed to pull %s: %s", image, msg.Error)
+		}
+	}
+}
+
+// Start starts the container id.
+func (c *Client) Start(id string) error {
+	return c.do("POST", "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// Run creates and starts a container like docker run -d.
+func (c *Client) Run(opts *RunOptions) (string, error) {
+	id, err := c.Create(opts)
+	if err != nil {
+		return "", err
+	}
+	err = c.Start(id)
+	if err != nil {
+		c.Remove(id, true)
+		return "", err
+	}
+	return id, nil
+}
+
+// Stop stops the container id waiting up to timeout before killing it.
+func (c *Client) Stop(id string, timeout time.Duration) error {
+	query := url.Values{}
+	query.Set("t", fmt.Sprintf("%d", int(timeout.Seconds())))
+	return c.do("POST", "/containers/"+id+"/stop", query, nil, nil)
+}
+
+// Remove removes the container id. If force is set a running container
+// is killed first.
+func (c *Client) Remove(id string, force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+	return c.do("DELETE", "/containers/"+id, query, nil, nil)
+}
+
+type Health struct {
+	Status string
+}
+
+type State struct {
+	Running bool
+	Pid     int
+	Health  *Health
+}
+
+type Container struct {
+	Id    string
+	Name  string
+	State State
+}
+
+// Inspect returns the state of the container id.
+func (c *Client) Inspect(id string) (*Container, error) {
+	container := &Container{}
+	err := c.do("GET", "/containers/"+id+"/json", nil, nil, container)
+	if err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// Logs returns the combined stdout and stderr of the container id. If
+// follow is set the stream stays open until the container exits or the
+// reader is closed.
+func (c *Client) Logs(id string, follow bool) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	if follow {
+		query.Set("follow", "1")
+	}
+	body, err := c.stream("GET", "/containers/"+id+"/logs", query)
+	if err != nil {
+		return nil, err
+	}
+	return &logReader{body: body}, nil
+}
+
+// logReader removes the multiplexing headers from a log stream. Containers
+// with a tty have no headers so data is passed through unchanged.
+type logReader struct {
+	body      io.ReadCloser
+	r         io.Reader
+	remaining int
+	raw       bool
+}
+
+func (l *logReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		header := make([]byte, 8)
+		n, err := io.ReadFull(l.body, header)
+		l.r = l.body
+		if err != nil || header[0] > 2 || header[1] != 0 || header[2] != 0 || header[3] != 0 {
+			// not multiplexed so return what was read as data
+			l.raw = true
+			l.r = io.MultiReader(bytes.NewReader(header[:n]), l.body)
+		} else {
+			l.remaining = int(binary.BigEndian.Uint32(header[4:]))
+		}
+	}
+	if l.raw {
+		return l.r.Read(p)
+	}
+	for l.remaining == 0 {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(l.r, header)
+		if err != nil {
+			return 0, err
+		}
+		l.remaining = int(binary.BigEndian.Uint32(header[4:]))
+	}
+	if len(p) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= n
+	return n, err
+}
+
+func (l *logReader) Close() error {
+	return l.body.Close()
+}
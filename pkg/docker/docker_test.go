@@ -0,0 +1,191 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	args, err := SplitArgs(`-e FOO="a b" -e 'BAR=c d' img sh -c echo\ hi`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-e", "FOO=a b", "-e", "BAR=c d", "img", "sh", "-c", "echo hi"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Unexpected split: %q", args)
+	}
+	_, err = SplitArgs(`img "unterminated`)
+	if err == nil {
+		t.Fatal("No error for unterminated quote")
+	}
+}
+
+func TestParseRun(t *testing.T) {
+	opts, err := ParseRun(`-d --name=db -e "PASS=x y" -l app=wp -v /data:/var/lib/mysql wormhole/mysql mysqld --skip-grant-tables`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Image != "wormhole/mysql" || opts.Name != "db" {
+		t.Fatalf("Unexpected options: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.Env, []string{"PASS=x y"}) || opts.Labels["app"] != "wp" {
+		t.Fatalf("Unexpected env or labels: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.Volumes, []string{"/data:/var/lib/mysql"}) {
+		t.Fatalf("Unexpected volumes: %+v", opts.Volumes)
+	}
+	if !reflect.DeepEqual(opts.Cmd, []string{"mysqld", "--skip-grant-tables"}) {
+		t.Fatalf("Unexpected cmd: %q", opts.Cmd)
+	}
+}
+
+func TestParseRunFlags(t *testing.T) {
+	opts, err := ParseRun(`-dit --rm --privileged=true -p 8080:80 -p 127.0.0.1::53/udp --net host --restart on-failure:3 -m 512m --cap-add NET_ADMIN img`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.Tty || !opts.OpenStdin || !opts.AutoRemove || !opts.Privileged || opts.Network != "host" {
+		t.Fatalf("Unexpected flags: %+v", opts)
+	}
+	expected := []PortBinding{{"", "8080", "80/tcp"}, {"127.0.0.1", "", "53/udp"}}
+	if !reflect.DeepEqual(opts.Ports, expected) {
+		t.Fatalf("Unexpected ports: %+v", opts.Ports)
+	}
+	if opts.RestartPolicy != (RestartPolicy{"on-failure", 3}) || opts.Memory != 512<<20 {
+		t.Fatalf("Unexpected restart policy or memory: %+v", opts)
+	}
+	config := newCreateConfig(opts)
+	if _, ok := config.ExposedPorts["80/tcp"]; !ok || config.HostConfig.PortBindings["53/udp"][0].HostIp != "127.0.0.1" {
+		t.Fatalf("Unexpected port config: %+v", config)
+	}
+	if !reflect.DeepEqual(config.HostConfig.CapAdd, []string{"NET_ADMIN"}) || config.HostConfig.RestartPolicy.MaximumRetryCount != 3 {
+		t.Fatalf("Unexpected host config: %+v", config.HostConfig)
+	}
+}
+
+func TestParseRunErrors(t *testing.T) {
+	for _, s := range []string{"", "-e FOO=bar", "--bogus img", "-p 8000-8010:80 img", "--restart sometimes img", "img 'oops"} {
+		_, err := ParseRun(s)
+		if err == nil {
+			t.Fatalf("No error for %q", s)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	pulled := false
+	started := false
+	var config createConfig
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/containers/create":
+			if !pulled {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"message": "No such image: foo:latest"}`))
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&config)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id": "abc"}`))
+		case r.Method == "POST" && r.URL.Path == "/images/create":
+			if r.URL.Query().Get("fromImage") != "foo" || r.URL.Query().Get("tag") != "latest" {
+				t.Errorf("Unexpected pull query: %v", r.URL.RawQuery)
+			}
+			pulled = true
+		case r.Method == "POST" && r.URL.Path == "/containers/abc/start":
+			started = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.Run(&RunOptions{Image: "foo", Env: []string{"A=b c"}, Volumes: []string{"/a:/b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "abc" || !pulled || !started {
+		t.Fatalf("Run did not pull, create and start: %v %v %v", id, pulled, started)
+	}
+	if config.Image != "foo" || config.Env[0] != "A=b c" || config.HostConfig.Binds[0] != "/a:/b" {
+		t.Fatalf("Unexpected create config: %+v", config)
+	}
+}
+
+func TestPullError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "Pulling from library/foo"}` + "\n"))
+		w.Write([]byte(`{"errorDetail": {"message": "unauthorized"}, "error": "unauthorized"}` + "\n"))
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Pull("foo")
+	if err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Fatalf("Expected pull error from the stream: %v", err)
+	}
+}
+
+func TestError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "No such container: abc"}`))
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Remove("abc", true)
+	if !IsNotFound(err) {
+		t.Fatalf("Expected not found error: %v", err)
+	}
+	if err.(*Error).Message != "No such container: abc" {
+		t.Fatalf("Unexpected error message: %v", err)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/abc/logs" || r.URL.Query().Get("follow") != "1" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		w.Write([]byte{1, 0, 0, 0, 0, 0, 0, 6})
+		w.Write([]byte("hello "))
+		w.Write([]byte{2, 0, 0, 0, 0, 0, 0, 6})
+		w.Write([]byte("world\n"))
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := c.Logs("abc", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+	b, err := ioutil.ReadAll(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world\n" {
+		t.Fatalf("Unexpected logs: %q", b)
+	}
+}
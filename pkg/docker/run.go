@@ -0,0 +1,383 @@
+package docker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RunOptions are the supported options for running a container.
+type RunOptions struct {
+	Image         string
+	Name          string
+	Cmd           []string
+	Entrypoint    []string
+	Env           []string
+	Labels        map[string]string
+	Volumes       []string
+	VolumesFrom   []string
+	WorkingDir    string
+	User          string
+	Hostname      string
+	Ports         []PortBinding
+	PublishAll    bool
+	Network       string
+	Links         []string
+	Dns           []string
+	ExtraHosts    []string
+	Privileged    bool
+	CapAdd        []string
+	CapDrop       []string
+	AutoRemove    bool
+	Tty           bool
+	OpenStdin     bool
+	RestartPolicy RestartPolicy
+	Memory        int64
+	IpcMode       string
+	PidMode       string
+}
+
+// PortBinding publishes ContainerPort, which includes the protocol like
+// 80/tcp, on HostIP and HostPort. An empty HostPort picks a free port.
+type PortBinding struct {
+	HostIP        string
+	HostPort      string
+	ContainerPort string
+}
+
+type RestartPolicy struct {
+	Name              string
+	MaximumRetryCount int
+}
+
+// SplitArgs splits s into words like a posix shell. Single quotes, double
+// quotes and backslash escapes are supported.
+func SplitArgs(s string) ([]string, error) {
+	args := make([]string, 0)
+	var cur []rune
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur = append(cur, r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur = append(cur, r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' {
+				escaped = true
+			} else {
+				cur = append(cur, r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, string(cur))
+				cur = cur[:0]
+				inWord = false
+			}
+		default:
+			cur = append(cur, r)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("Trailing backslash in: %s", s)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote in: %s", s)
+	}
+	if inWord {
+		args = append(args, string(cur))
+	}
+	return args, nil
+}
+
+// boolFlags are the docker run flags that do not take a value.
+var boolFlags = map[string]string{
+	"-d":            "detach",
+	"--detach":      "detach",
+	"-i":            "interactive",
+	"--interactive": "interactive",
+	"-t":            "tty",
+	"--tty":         "tty",
+	"-P":            "publish-all",
+	"--publish-all": "publish-all",
+	"--privileged":  "privileged",
+	"--rm":          "rm",
+}
+
+// valueFlags are the docker run flags that take a value.
+var valueFlags = map[string]string{
+	"-e":             "env",
+	"--env":          "env",
+	"-l":             "label",
+	"--label":        "label",
+	"-v":             "volume",
+	"--volume":       "volume",
+	"--volumes-from": "volumes-from",
+	"--name":         "name",
+	"-w":             "workdir",
+	"--workdir":      "workdir",
+	"-u":             "user",
+	"--user":         "user",
+	"-h":             "hostname",
+	"--hostname":     "hostname",
+	"--entrypoint":   "entrypoint",
+	"-p":             "publish",
+	"--publish":      "publish",
+	"--net":          "network",
+	"--network":      "network",
+	"--link":         "link",
+	"--dns":          "dns",
+	"--add-host":     "add-host",
+	"--cap-add":      "cap-add",
+	"--cap-drop":     "cap-drop",
+	"--restart":      "restart",
+	"-m":             "memory",
+	"--memory":       "memory",
+	"--ipc":          "ipc",
+	"--pid":          "pid",
+}
+
+// ParseRun parses arguments in the form of docker run into RunOptions.
+// Everything after the image is the command. Flags that are not in
+// boolFlags or valueFlags are rejected.
+func ParseRun(s string) (*RunOptions, error) {
+	args, err := SplitArgs(s)
+	if err != nil {
+		return nil, err
+	}
+	opts := &RunOptions{}
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		if !strings.HasPrefix(arg, "-") {
+			opts.Image = arg
+			opts.Cmd = args
+			return opts, nil
+		}
+		name, value := arg, ""
+		hasValue := false
+		if i := strings.Index(arg, "="); i != -1 && strings.HasPrefix(arg, "--") {
+			name, value = arg[:i], arg[i+1:]
+			hasValue = true
+		}
+		if flag, ok := boolFlags[name]; ok {
+			on := true
+			if hasValue {
+				on, err = strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value for docker-run option: %s", arg)
+				}
+			}
+			opts.setBool(flag, on)
+			continue
+		}
+		if combined, ok := shortBools(name); ok {
+			for _, flag := range combined {
+				opts.setBool(flag, true)
+			}
+			continue
+		}
+		flag, ok := valueFlags[name]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported docker-run option: %s", arg)
+		}
+		if !hasValue {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("Missing value for docker-run option: %s", arg)
+			}
+			value, args = args[0], args[1:]
+		}
+		err = opts.setValue(flag, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Image is required for docker-run")
+}
+
+// shortBools splits combined short flags like -it into their names.
+func shortBools(arg string) ([]string, bool) {
+	if len(arg) < 3 || arg[1] == '-' {
+		return nil, false
+	}
+	flags := make([]string, 0, len(arg)-1)
+	for _, c := range arg[1:] {
+		flag, ok := boolFlags["-"+string(c)]
+		if !ok {
+			return nil, false
+		}
+		flags = append(flags, flag)
+	}
+	return flags, true
+}
+
+func (opts *RunOptions) setBool(flag string, on bool) {
+	switch flag {
+	case "interactive":
+		opts.OpenStdin = on
+	case "tty":
+		opts.Tty = on
+	case "publish-all":
+		opts.PublishAll = on
+	case "privileged":
+		opts.Privileged = on
+	case "rm":
+		opts.AutoRemove = on
+	}
+}
+
+func (opts *RunOptions) setValue(flag string, value string) error {
+	switch flag {
+	case "env":
+		opts.Env = append(opts.Env, value)
+	case "label":
+		if opts.Labels == nil {
+			opts.Labels = make(map[string]string)
+		}
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) == 2 {
+			opts.Labels[parts[0]] = parts[1]
+		} else {
+			opts.Labels[parts[0]] = ""
+		}
+	case "volume":
+		opts.Volumes = append(opts.Volumes, value)
+	case "volumes-from":
+		opts.VolumesFrom = append(opts.VolumesFrom, value)
+	case "name":
+		opts.Name = value
+	case "workdir":
+		opts.WorkingDir = value
+	case "user":
+		opts.User = value
+	case "hostname":
+		opts.Hostname = value
+	case "entrypoint":
+		opts.Entrypoint = []string{value}
+	case "publish":
+		port, err := parsePort(value)
+		if err != nil {
+			return err
+		}
+		opts.Ports = append(opts.Ports, port)
+	case "network":
+		opts.Network = value
+	case "link":
+		opts.Links = append(opts.Links, value)
+	case "dns":
+		opts.Dns = append(opts.Dns, value)
+	case "add-host":
+		opts.ExtraHosts = append(opts.ExtraHosts, value)
+	case "cap-add":
+		opts.CapAdd = append(opts.CapAdd, value)
+	case "cap-drop":
+		opts.CapDrop = append(opts.CapDrop, value)
+	case "restart":
+		policy, err := parseRestart(value)
+		if err != nil {
+			return err
+		}
+		opts.RestartPolicy = policy
+	case "memory":
+		memory, err := parseBytes(value)
+		if err != nil {
+			return err
+		}
+		opts.Memory = memory
+	case "ipc":
+		opts.IpcMode = value
+	case "pid":
+		opts.PidMode = value
+	}
+	return nil
+}
+
+// parsePort parses [[IP:]HOSTPORT:]PORT[/PROTO]. Port ranges are not
+// supported.
+func parsePort(value string) (PortBinding, error) {
+	spec, proto := value, "tcp"
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		spec, proto = spec[:i], spec[i+1:]
+	}
+	binding := PortBinding{}
+	i := strings.LastIndex(spec, ":")
+	port := spec[i+1:]
+	if i != -1 {
+		rest := spec[:i]
+		if j := strings.LastIndex(rest, ":"); j != -1 {
+			binding.HostIP = strings.Trim(rest[:j], "[]")
+			rest = rest[j+1:]
+		}
+		binding.HostPort = rest
+	}
+	if !validPort(port) || (binding.HostPort != "" && !validPort(binding.HostPort)) {
+		return PortBinding{}, fmt.Errorf("Invalid port for docker-run option -p: %s", value)
+	}
+	binding.ContainerPort = port + "/" + proto
+	return binding, nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// parseRestart parses a restart policy like on-failure:5.
+func parseRestart(value string) (RestartPolicy, error) {
+	parts := strings.SplitN(value, ":", 2)
+	policy := RestartPolicy{Name: parts[0]}
+	switch policy.Name {
+	case "no", "always", "unless-stopped":
+		if len(parts) == 1 {
+			return policy, nil
+		}
+	case "on-failure":
+		if len(parts) == 1 {
+			return policy, nil
+		}
+		retries, err := strconv.Atoi(parts[1])
+		if err == nil && retries >= 0 {
+			policy.MaximumRetryCount = retries
+			return policy, nil
+		}
+	}
+	return RestartPolicy{}, fmt.Errorf("Invalid restart policy for docker-run: %s", value)
+}
+
+// parseBytes parses a size with an optional b, k, m or g suffix.
+func parseBytes(value string) (int64, error) {
+	number, unit := value, int64(1)
+	if len(value) > 0 {
+		switch strings.ToLower(value[len(value)-1:]) {
+		case "b":
+			number = value[:len(value)-1]
+		case "k":
+			number, unit = value[:len(value)-1], 1<<10
+		case "m":
+			number, unit = value[:len(value)-1], 1<<20
+		case "g":
+			number, unit = value[:len(value)-1], 1<<30
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid size for docker-run: %s", value)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,352 @@
+// Package ipam allocates pairs of overlay ips for tunnels. Each pair is an
+// aligned /31 (or /127) from a cidr. The pairs that hold the first and last
+// addresses of the cidr are never used.
+//
+// A peer starts its search at a pair derived from its name, so it gets the
+// same pair every time unless that pair is taken. Allocations can be
+// persisted to a file and operators can pin a pair for a peer.
+package ipam
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/wormhole/pkg/netaddr"
+)
+
+// Pair is two adjacent overlay ips. First is the lower one.
+type Pair struct {
+	First  net.IP `json:"first"`
+	Second net.IP `json:"second"`
+}
+
+// NewPair returns the pair of a and b in order.
+func NewPair(a net.IP, b net.IP) Pair {
+	if ipInt(b).Cmp(ipInt(a)) < 0 {
+		a, b = b, a
+	}
+	return Pair{First: a, Second: b}
+}
+
+func (p Pair) Equal(o Pair) bool {
+	return p.First.Equal(o.First) && p.Second.Equal(o.Second)
+}
+
+func (p Pair) String() string {
+	return fmt.Sprintf("%s-%s", p.First, p.Second)
+}
+
+// InUseError is returned when an ip of a pair belongs to another peer.
+type InUseError struct {
+	IP net.IP
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("IP %s is in use", e.IP)
+}
+
+// IsInUse returns true if err is an InUseError. Errors that crossed an rpc
+// only keep their message, so that is checked as well.
+func IsInUse(err error) bool {
+	if _, ok := err.(*InUseError); ok {
+		return true
+	}
+	return err != nil && strings.HasPrefix(err.Error(), "IP ") && strings.HasSuffix(err.Error(), " is in use")
+}
+
+// ExhaustedError is returned when every pair of the cidr is in use.
+// Used pairs may be fewer than Pairs when the peer rejected the rest.
+type ExhaustedError struct {
+	Cidr  *net.IPNet
+	Used  int
+	Pairs *big.Int
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("No free ip pairs in %s: %d of %s are in use", e.Cidr, e.Used, e.Pairs)
+}
+
+// Allocator hands out pairs to peers. It is safe for concurrent use.
+type Allocator struct {
+	mu     sync.Mutex
+	cidr   *net.IPNet
+	pairs  *big.Int
+	path   string
+	used   map[string]string
+	owners map[string]Pair
+	pins   map[string]Pair
+}
+
+type savedAllocations struct {
+	Allocations map[string]Pair `json:"allocations"`
+}
+
+// New returns an allocator for cidr. If path is not empty allocations are
+// loaded from and saved to it. Saved allocations that no longer fit the
+// cidr are dropped.
+func New(cidr *net.IPNet, path string) (*Allocator, error) {
+	ones, bits := cidr.Mask.Size()
+	if bits-ones < 3 {
+		return nil, fmt.Errorf("Cidr %s is too small for tunnel ip pairs", cidr)
+	}
+	pairs := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones-1))
+	a := &Allocator{
+		cidr:   &net.IPNet{IP: cidr.IP.Mask(cidr.Mask), Mask: cidr.Mask},
+		pairs:  pairs.Sub(pairs, big.NewInt(2)),
+		used:   make(map[string]string),
+		owners: make(map[string]Pair),
+		pins:   make(map[string]Pair),
+	}
+	if path == "" {
+		return a, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		a.path = path
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := savedAllocations{}
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	for owner, pair := range saved.Allocations {
+		if a.cidr.Contains(pair.First) && a.cidr.Contains(pair.Second) && a.free(owner, pair) == nil {
+			a.take(owner, pair)
+		}
+	}
+	a.path = path
+	return a, nil
+}
+
+// Pin reserves the pair starting at first for owner. Allocate always
+// returns it for owner and Reserve only accepts it.
+func (a *Allocator) Pin(owner string, first net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pair := Pair{First: first, Second: netaddr.IPAdd(first, 1)}
+	if !a.usable(pair) {
+		return fmt.Errorf("Pinned pair %s is not usable in %s", pair, a.cidr)
+	}
+	for other, pin := range a.pins {
+		if other != owner && overlaps(pin, pair) {
+			return fmt.Errorf("Pinned pair %s for %s overlaps the pair of %s", pair, owner, other)
+		}
+	}
+	a.pins[owner] = pair
+	return nil
+}
+
+// Allocate returns the pair of owner, allocating one if needed. Pairs in
+// skip are not returned, which lets the caller move on from a pair that
+// the peer already uses.
+func (a *Allocator) Allocate(owner string, skip ...Pair) (Pair, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pin, ok := a.pins[owner]; ok {
+		if contains(skip, pin) {
+			return Pair{}, fmt.Errorf("Pinned pair %s for %s is in use on the peer", pin, owner)
+		}
+		err := a.free(owner, pin)
+		if err != nil {
+			return Pair{}, err
+		}
+		a.take(owner, pin)
+		return pin, nil
+	}
+	if pair, ok := a.owners[owner]; ok && !contains(skip, pair) {
+		return pair, nil
+	}
+	a.release(owner)
+
+	// every used ip blocks at most one candidate and every skipped or
+	// pinned pair at most two
+	limit := big.NewInt(int64(len(a.used) + 2*len(skip) + 2*len(a.pins) + 1))
+	if limit.Cmp(a.pairs) > 0 {
+		limit = a.pairs
+	}
+	start := a.start(owner)
+	index := new(big.Int)
+	for i := big.NewInt(0); i.Cmp(limit) < 0; i.Add(i, big.NewInt(1)) {
+		index.Add(start, i)
+		index.Mod(index, a.pairs)
+		pair := a.pair(index)
+		if contains(skip, pair) || a.pinned(owner, pair) || a.free(owner, pair) != nil {
+			continue
+		}
+		a.take(owner, pair)
+		return pair, nil
+	}
+	return Pair{}, &ExhaustedError{Cidr: a.cidr, Used: len(a.owners), Pairs: new(big.Int).Set(a.pairs)}
+}
+
+// Reserve records that owner uses the ips first and second, which were
+// allocated by the peer or found in the kernel. They replace any pair
+// owner had.
+func (a *Allocator) Reserve(owner string, first net.IP, second net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pair := NewPair(first, second)
+	if pin, ok := a.pins[owner]; ok && !pin.Equal(pair) {
+		return fmt.Errorf("Overlay ips for %s are pinned to %s", owner, pin)
+	}
+	if a.pinned(owner, pair) {
+		return &InUseError{pair.First}
+	}
+	err := a.free(owner, pair)
+	if err != nil {
+		return err
+	}
+	a.take(owner, pair)
+	return nil
+}
+
+// Release frees the pair of owner.
+func (a *Allocator) Release(owner string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release(owner)
+}
+
+// Get returns the pair of owner.
+func (a *Allocator) Get(owner string) (Pair, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pair, ok := a.owners[owner]
+	return pair, ok
+}
+
+// Used returns the number of ips in use.
+func (a *Allocator) Used() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.used)
+}
+
+// start returns the index where the search for owner begins.
+func (a *Allocator) start(owner string) *big.Int {
+	sum := sha256.Sum256([]byte(owner))
+	start := new(big.Int).SetBytes(sum[:])
+	return start.Mod(start, a.pairs)
+}
+
+// pair returns the pair with index, skipping the pair with the first
+// address of the cidr.
+func (a *Allocator) pair(index *big.Int) Pair {
+	offset := new(big.Int).Add(index, big.NewInt(1))
+	first := netaddr.IPAddBig(a.cidr.IP, offset.Lsh(offset, 1))
+	return Pair{First: first, Second: netaddr.IPAdd(first, 1)}
+}
+
+// usable returns true if pair is in the cidr and holds neither its first
+// nor its last address.
+func (a *Allocator) usable(pair Pair) bool {
+	if !a.cidr.Contains(pair.First) || !a.cidr.Contains(pair.Second) {
+		return false
+	}
+	// the cidr holds pairs+2 pairs
+	size := new(big.Int).Lsh(new(big.Int).Add(a.pairs, big.NewInt(2)), 1)
+	last := netaddr.IPAddBig(a.cidr.IP, size.Sub(size, big.NewInt(1)))
+	return !pair.First.Equal(a.cidr.IP) && !pair.Second.Equal(last)
+}
+
+// pinned returns true if pair overlaps a pair pinned for another owner.
+func (a *Allocator) pinned(owner string, pair Pair) bool {
+	for other, pin := range a.pins {
+		if other != owner && overlaps(pin, pair) {
+			return true
+		}
+	}
+	return false
+}
+
+// free returns an InUseError if an ip of pair belongs to another owner.
+func (a *Allocator) free(owner string, pair Pair) error {
+	for _, ip := range []net.IP{pair.First, pair.Second} {
+		if other, ok := a.used[ip.String()]; ok && other != owner {
+			return &InUseError{ip}
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) take(owner string, pair Pair) {
+	if old, ok := a.owners[owner]; ok && old.Equal(pair) {
+		return
+	}
+	a.release(owner)
+	a.owners[owner] = pair
+	a.used[pair.First.String()] = owner
+	a.used[pair.Second.String()] = owner
+	a.save()
+}
+
+func (a *Allocator) release(owner string) {
+	pair, ok := a.owners[owner]
+	if !ok {
+		return
+	}
+	delete(a.owners, owner)
+	delete(a.used, pair.First.String())
+	delete(a.used, pair.Second.String())
+	a.save()
+}
+
+func (a *Allocator) save() {
+	if a.path == "" {
+		return
+	}
+	err := writeAllocations(a.path, a.owners)
+	if err != nil {
+		glog.Errorf("Failed to write ip allocations to %s: %v", a.path, err)
+	}
+}
+
+// writeAllocations atomically replaces the allocations file at path.
+func writeAllocations(path string, owners map[string]Pair) error {
+	b, err := json.MarshalIndent(savedAllocations{owners}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func ipInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func overlaps(a Pair, b Pair) bool {
+	return a.First.Equal(b.First) || a.First.Equal(b.Second) || a.Second.Equal(b.First) || a.Second.Equal(b.Second)
+}
+
+func contains(pairs []Pair, pair Pair) bool {
+	for _, p := range pairs {
+		if overlaps(p, pair) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package ipam
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newAllocator(t *testing.T, cidr string, path string) *Allocator {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(ipnet, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAllocate(t *testing.T) {
+	for _, cidr := range []string{"100.65.0.0/14", "100.65.0.0/29", "fd00:1::/64", "fd00::/48", "fd00::/16"} {
+		a := newAllocator(t, cidr, "")
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		pair, err := a.Allocate("10.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ipnet.Contains(pair.First) || !ipnet.Contains(pair.Second) || pair.First.Equal(ipnet.IP) {
+			t.Fatalf("Pair %s is not usable in %s", pair, cidr)
+		}
+		if (pair.First.To4() == nil) != (ipnet.IP.To4() == nil) {
+			t.Fatalf("Pair %s has the wrong family for %s", pair, cidr)
+		}
+		if ipInt(pair.First).Bit(0) != 0 || ipInt(pair.Second).Bit(0) != 1 {
+			t.Fatalf("Pair %s is not an aligned /31", pair)
+		}
+		again, err := a.Allocate("10.0.0.2")
+		if err != nil || !again.Equal(pair) {
+			t.Fatalf("Owner got a different pair: %s %s %v", pair, again, err)
+		}
+		other := newAllocator(t, cidr, "")
+		same, err := other.Allocate("10.0.0.2")
+		if err != nil || !same.Equal(pair) {
+			t.Fatalf("Allocation is not deterministic: %s %s %v", pair, same, err)
+		}
+		if a.Used() != 2 {
+			t.Fatalf("Expected 2 used ips: %d", a.Used())
+		}
+	}
+	_, ipnet, _ := net.ParseCIDR("100.65.0.0/30")
+	_, err := New(ipnet, "")
+	if err == nil {
+		t.Fatalf("Expected error for a /30")
+	}
+}
+
+func TestAllocateSkip(t *testing.T) {
+	a := newAllocator(t, "100.65.0.0/24", "")
+	pair, err := a.Allocate("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := a.Allocate("10.0.0.2", pair)
+	if err != nil || next.Equal(pair) {
+		t.Fatalf("Skipped pair was returned: %s %v", next, err)
+	}
+	if a.Used() != 2 {
+		t.Fatalf("Skipped pair was not released: %d", a.Used())
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	a := newAllocator(t, "100.65.0.0/29", "")
+	for _, owner := range []string{"10.0.0.2", "10.0.0.3"} {
+		pair, err := a.Allocate(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pair.First.Equal(net.ParseIP("100.65.0.0")) || pair.Second.Equal(net.ParseIP("100.65.0.7")) {
+			t.Fatalf("Pair %s holds the first or last address", pair)
+		}
+	}
+	_, err := a.Allocate("10.0.0.4")
+	if _, ok := err.(*ExhaustedError); !ok {
+		t.Fatalf("Expected exhaustion: %v", err)
+	}
+	a.Release("10.0.0.2")
+	_, err = a.Allocate("10.0.0.4")
+	if err != nil {
+		t.Fatalf("Released pair was not reused: %v", err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	a := newAllocator(t, "100.65.0.0/24", "")
+	err := a.Reserve("10.0.0.2", net.ParseIP("100.65.0.6"), net.ParseIP("100.65.0.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, ok := a.Get("10.0.0.2")
+	if !ok || !pair.First.Equal(net.ParseIP("100.65.0.5")) {
+		t.Fatalf("Unexpected reservation: %s", pair)
+	}
+	err = a.Reserve("10.0.0.3", net.ParseIP("100.65.0.6"), net.ParseIP("100.65.0.7"))
+	if !IsInUse(err) {
+		t.Fatalf("Expected ip in use: %v", err)
+	}
+	if !IsInUse(errors.New(err.Error())) || IsInUse(errors.New("Cipher foo is not supported")) {
+		t.Fatalf("In use errors are not recognized by message")
+	}
+	err = a.Reserve("10.0.0.2", net.ParseIP("100.65.0.8"), net.ParseIP("100.65.0.9"))
+	if err != nil || a.Used() != 2 {
+		t.Fatalf("Reservation was not replaced: %v %d", err, a.Used())
+	}
+}
+
+func TestPin(t *testing.T) {
+	a := newAllocator(t, "100.65.0.0/24", "")
+	err := a.Pin("10.0.0.2", net.ParseIP("100.65.0.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Pin("10.0.0.3", net.ParseIP("100.65.0.9"))
+	if err == nil {
+		t.Fatalf("Expected error for overlapping pins")
+	}
+	err = a.Pin("10.0.0.3", net.ParseIP("100.65.0.0"))
+	if err == nil {
+		t.Fatalf("Expected error for a pin on the first address")
+	}
+	pair, err := a.Allocate("10.0.0.2")
+	if err != nil || !pair.First.Equal(net.ParseIP("100.65.0.8")) {
+		t.Fatalf("Pinned pair was not allocated: %s %v", pair, err)
+	}
+	_, err = a.Allocate("10.0.0.2", pair)
+	if err == nil {
+		t.Fatalf("Expected error when the pinned pair is in use on the peer")
+	}
+	err = a.Reserve("10.0.0.2", net.ParseIP("100.65.0.10"), net.ParseIP("100.65.0.11"))
+	if err == nil {
+		t.Fatalf("Expected error for a pair other than the pin")
+	}
+	err = a.Reserve("10.0.0.3", net.ParseIP("100.65.0.8"), net.ParseIP("100.65.0.9"))
+	if !IsInUse(err) {
+		t.Fatalf("Expected pinned pair to be in use: %v", err)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "ipam.json")
+
+	a := newAllocator(t, "100.65.0.0/24", path)
+	pair, err := a.Allocate("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Reserve("10.0.0.3", net.ParseIP("100.65.0.1"), net.ParseIP("100.65.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Release("10.0.0.3")
+
+	loaded := newAllocator(t, "100.65.0.0/24", path)
+	saved, ok := loaded.Get("10.0.0.2")
+	if !ok || !saved.Equal(pair) || loaded.Used() != 2 {
+		t.Fatalf("Allocation was not persisted: %s %d", saved, loaded.Used())
+	}
+	// allocations outside a new cidr are dropped
+	moved := newAllocator(t, "100.66.0.0/24", path)
+	if moved.Used() != 0 {
+		t.Fatalf("Allocation outside the cidr was loaded")
+	}
+}
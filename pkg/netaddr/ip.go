@@ -2,6 +2,7 @@ package netaddr
 
 import (
 	"math"
+	"math/big"
 	"net"
 )
 
@@ -54,20 +55,35 @@ func IPAdd(ip net.IP, offset uint64) net.IP {
 	}
 	a := ipToU64(ip[:net.IPv6len/2])
 	b := ipToU64(ip[net.IPv6len/2:])
-	o := uint64(offset)
-	if math.MaxUint64-b < o {
+	if math.MaxUint64-b < offset {
 		a++
 	}
-	b += o
-	if offset < 0 {
-		a += math.MaxUint64
-	}
+	b += offset
 	ip = make(net.IP, net.IPv6len)
 	u64ToIP(ip[:net.IPv6len/2], a)
 	u64ToIP(ip[net.IPv6len/2:], b)
 	return ip
 }
 
+// IPAddBig adds offset to ip. It is needed for offsets within ipv6
+// prefixes that are shorter than /64. The result wraps around like IPAdd.
+func IPAddBig(ip net.IP, offset *big.Int) net.IP {
+	size := net.IPv6len
+	if IsIPv4(ip) {
+		size = net.IPv4len
+	}
+	a := new(big.Int).SetBytes(ip[len(ip)-size:])
+	a.Add(a, offset)
+	a.Mod(a, new(big.Int).Lsh(big.NewInt(1), uint(size*8)))
+	b := a.Bytes()
+	result := make(net.IP, size)
+	copy(result[size-len(b):], b)
+	if size == net.IPv4len {
+		return result.To16()
+	}
+	return result
+}
+
 // IPMod calculates ip % d
 func IPMod(ip net.IP, d uint64) uint64 {
 	if IsIPv4(ip) {
@@ -0,0 +1,64 @@
+package netaddr
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+func TestIPAdd(t *testing.T) {
+	for _, c := range []struct {
+		ip       string
+		offset   uint64
+		expected string
+	}{
+		{"10.0.0.1", 1, "10.0.0.2"},
+		{"10.0.0.255", 1, "10.0.1.0"},
+		{"255.255.255.255", 1, "0.0.0.0"},
+		{"2001:db8::1", 1, "2001:db8::2"},
+		{"2001:db8::ffff:ffff:ffff:ffff", 1, "2001:db8:0:1::"},
+		{"2001:db8::", 1<<63 + 5, "2001:db8::8000:0:0:5"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", 1, "::"},
+	} {
+		actual := IPAdd(net.ParseIP(c.ip), c.offset)
+		if !actual.Equal(net.ParseIP(c.expected)) {
+			t.Fatalf("IPAdd(%s, %d) = %s (Expected: %s)", c.ip, c.offset, actual, c.expected)
+		}
+	}
+}
+
+func TestIPAddBig(t *testing.T) {
+	// offsets beyond 64 bits are needed within a /48
+	offset := new(big.Int).Lsh(big.NewInt(1), 79)
+	offset.Add(offset, big.NewInt(3))
+	actual := IPAddBig(net.ParseIP("2001:db8:1::"), offset)
+	if !actual.Equal(net.ParseIP("2001:db8:1:8000::3")) {
+		t.Fatalf("Unexpected ip: %s", actual)
+	}
+	actual = IPAddBig(net.ParseIP("10.0.0.255"), big.NewInt(2))
+	if !actual.Equal(net.ParseIP("10.0.1.1")) || !IsIPv4(actual) {
+		t.Fatalf("Unexpected ip: %s", actual)
+	}
+	actual = IPAddBig(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), big.NewInt(2))
+	if !actual.Equal(net.ParseIP("::1")) {
+		t.Fatalf("Unexpected ip: %s", actual)
+	}
+}
+
+func TestIsIPv4(t *testing.T) {
+	if !IsIPv4(net.ParseIP("10.0.0.1")) || !IsIPv4(net.ParseIP("10.0.0.1").To4()) {
+		t.Fatalf("Expected ipv4")
+	}
+	if IsIPv4(net.ParseIP("2001:db8::1")) || IsIPv4(net.ParseIP("::1")) {
+		t.Fatalf("Expected ipv6")
+	}
+}
+
+func TestIPMod(t *testing.T) {
+	if IPMod(net.ParseIP("10.0.0.7"), 4) != 3 {
+		t.Fatalf("Unexpected ipv4 mod")
+	}
+	if IPMod(net.ParseIP("2001:db8::7"), 4) != 3 {
+		t.Fatalf("Unexpected ipv6 mod")
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"time"
+)
+
+type affinityState struct {
+	endpoint string
+	lastUsed time.Time
+}
+
+// affinityPolicy remembers the endpoint each client ip was sent to so the
+// client keeps using it until it has been idle for ttl. Expired clients
+// are swept at most once per ttl.
+type affinityPolicy struct {
+	ttl     time.Duration
+	clients map[string]*affinityState
+	swept   time.Time
+}
+
+func newAffinityPolicy(ttl time.Duration) *affinityPolicy {
+	return &affinityPolicy{ttl: ttl, clients: make(map[string]*affinityState), swept: time.Now()}
+}
+
+// lookup returns the endpoint for ip if it has not expired.
+func (a *affinityPolicy) lookup(ip string) (string, bool) {
+	state, exists := a.clients[ip]
+	if !exists {
+		return "", false
+	}
+	if time.Since(state.lastUsed) > a.ttl {
+		delete(a.clients, ip)
+		return "", false
+	}
+	state.lastUsed = time.Now()
+	return state.endpoint, true
+}
+
+func (a *affinityPolicy) record(ip string, endpoint string) {
+	if time.Since(a.swept) > a.ttl {
+		a.retain(func(string) bool { return true })
+	}
+	a.clients[ip] = &affinityState{endpoint: endpoint, lastUsed: time.Now()}
+}
+
+// retain forgets clients of endpoints that keep returns false for and
+// clients that have expired.
+func (a *affinityPolicy) retain(keep func(endpoint string) bool) {
+	for ip, state := range a.clients {
+		if !keep(state.endpoint) || time.Since(state.lastUsed) > a.ttl {
+			delete(a.clients, ip)
+		}
+	}
+	a.swept = time.Now()
+}
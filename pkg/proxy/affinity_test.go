@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAffinitySweepsExpired(t *testing.T) {
+	a := newAffinityPolicy(10 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		a.record(fmt.Sprintf("10.0.0.%d", i), "endpoint")
+	}
+	time.Sleep(20 * time.Millisecond)
+	a.record("10.0.1.1", "endpoint")
+	if len(a.clients) != 1 {
+		t.Fatalf("Expired clients not removed: %d left", len(a.clients))
+	}
+	if _, ok := a.lookup("10.0.1.1"); !ok {
+		t.Fatal("Recorded client not found")
+	}
+}
@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+// Endpoint is a backend that a Balancer can choose.
+type Endpoint struct {
+	Ns      netns.NsHandle
+	Address string
+	Weight  int
+}
+
+func (e *Endpoint) equal(ns netns.NsHandle, address string) bool {
+	return e.Address == address && e.Ns.Equal(ns)
+}
+
+// key identifies the endpoint independent of the handle used for its
+// namespace.
+func (e *Endpoint) key() string {
+	if !e.Ns.IsOpen() {
+		return e.Address
+	}
+	return e.Ns.UniqueId() + e.Address
+}
+
+// Strategy chooses the index of the endpoint for the next connection from
+// srcAddr. active holds the number of open connections to each endpoint.
+// Strategies are only called with at least one endpoint and with the
+// Balancer locked.
+type Strategy interface {
+	Next(endpoints []Endpoint, active []int, srcAddr net.Addr) int
+}
+
+// Strategies lists the names accepted by NewStrategy.
+var Strategies = []string{"round-robin", "least-conn", "random-two", "weighted", "consistent-hash"}
+
+// NewStrategy returns the strategy called name.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "round-robin":
+		return &roundRobin{}, nil
+	case "least-conn":
+		return &leastConn{}, nil
+	case "random-two":
+		return &randomTwo{}, nil
+	case "weighted":
+		return &weighted{}, nil
+	case "consistent-hash":
+		return &consistentHash{}, nil
+	}
+	return nil, fmt.Errorf("Unknown balance strategy %s", name)
+}
+
+type roundRobin struct {
+	next int
+}
+
+func (r *roundRobin) Next(endpoints []Endpoint, active []int, srcAddr net.Addr) int {
+	i := r.next % len(endpoints)
+	r.next = i + 1
+	return i
+}
+
+// leastConn picks the endpoint with the fewest open connections. Ties are
+// broken round robin so idle endpoints share the load.
+type leastConn struct {
+	rr roundRobin
+}
+
+func (l *leastConn) Next(endpoints []Endpoint, active []int, srcAddr net.Addr) int {
+	start := l.rr.Next(endpoints, active, srcAddr)
+	best := start
+	for j := 1; j < len(endpoints); j++ {
+		i := (start + j) % len(endpoints)
+		if active[i] < active[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// randomTwo picks two endpoints at random and uses the one with fewer open
+// connections.
+type randomTwo struct{}
+
+func (randomTwo) Next(endpoints []Endpoint, active []int, srcAddr net.Addr) int {
+	if len(endpoints) == 1 {
+		return 0
+	}
+	a := rand.Intn(len(endpoints))
+	b := rand.Intn(len(endpoints) - 1)
+	if b >= a {
+		b++
+	}
+	if active[b] < active[a] {
+		return b
+	}
+	return a
+}
+
+// weighted is a smooth weighted round robin. Endpoints without a weight
+// count as weight 1.
+type weighted struct {
+	current []int
+}
+
+func (w *weighted) Next(endpoints []Endpoint, active []int, srcAddr net.Addr) int {
+	if len(w.current) != len(endpoints) {
+		w.current = make([]int, len(endpoints))
+	}
+	total := 0
+	best := 0
+	for i := range endpoints {
+		weight := endpoints[i].Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		w.current[i] += weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= total
+	return best
+}
+
+// consistentHash sends each client ip to the same endpoint using a maglev
+// table, so most clients keep their endpoint when endpoints change.
+type consistentHash struct {
+	keys  []string
+	table []int
+}
+
+func (c *consistentHash) Next(endpoints []Endpoint, active []int, srcAddr net.Addr) int {
+	keys := make([]string, len(endpoints))
+	for i := range endpoints {
+		keys[i] = endpoints[i].key()
+	}
+	if !reflect.DeepEqual(keys, c.keys) {
+		c.keys = keys
+		c.table = maglevTable(keys, maglevTableSize)
+	}
+	return maglevLookup(c.table, clientIP(srcAddr))
+}
+
+// Balancer is a LoadBalancer that distributes the connections of a single
+// service between endpoints using a Strategy.
+type Balancer struct {
+	mu        sync.Mutex
+	strategy  Strategy
+	endpoints []Endpoint
+	active    []int
+	affinity  *affinityPolicy
+	health    *HealthMonitor
+	outliers  *outlierDetector
+}
+
+// NewBalancer returns a Balancer without endpoints that uses strategy.
+// Endpoints are ejected for 30 seconds after 3 dials in a row fail.
+func NewBalancer(strategy Strategy) *Balancer {
+	return &Balancer{
+		strategy: strategy,
+		outliers: newOutlierDetector(outlierFailures, outlierCooldown),
+	}
+}
+
+// SetStrategy replaces the strategy of b.
+func (b *Balancer) SetStrategy(strategy Strategy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.strategy = strategy
+}
+
+// SetAffinity makes b send each client ip to the same endpoint until the
+// client has not connected for ttl. A ttl of 0 disables affinity.
+func (b *Balancer) SetAffinity(ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.affinity = nil
+	if ttl > 0 {
+		b.affinity = newAffinityPolicy(ttl)
+	}
+}
+
+// SetHealthCheck starts probing the endpoints of b with check. Unhealthy
+// endpoints are not chosen. A nil check stops probing.
+func (b *Balancer) SetHealthCheck(check *HealthCheck) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.health != nil {
+		b.health.Stop()
+		b.health = nil
+	}
+	if check != nil {
+		b.health = NewHealthMonitor(check)
+		b.health.SetEndpoints(b.endpoints)
+	}
+}
+
+// SetOutlierDetection makes b eject endpoints for cooldown after failures
+// dials in a row fail. A failures of 0 disables ejection.
+func (b *Balancer) SetOutlierDetection(failures int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outliers = nil
+	if failures > 0 {
+		b.outliers = newOutlierDetector(failures, cooldown)
+	}
+}
+
+// Health returns the health of endpoint and whether it is checked.
+func (b *Balancer) Health(endpoint Endpoint) (EndpointHealth, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.health == nil {
+		return EndpointHealth{}, false
+	}
+	return b.health.Health(endpoint)
+}
+
+// Stop stops health checking.
+func (b *Balancer) Stop() {
+	b.SetHealthCheck(nil)
+}
+
+// SetEndpoints replaces the endpoints of b. Connection counts are kept for
+// endpoints that are still present.
+func (b *Balancer) SetEndpoints(endpoints []Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	active := make([]int, len(endpoints))
+	for i := range endpoints {
+		for j := range b.endpoints {
+			if b.endpoints[j].equal(endpoints[i].Ns, endpoints[i].Address) {
+				active[i] = b.active[j]
+				break
+			}
+		}
+	}
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+	b.active = active
+	if b.affinity != nil {
+		b.affinity.retain(func(key string) bool { return b.find(key) >= 0 })
+	}
+	if b.health != nil {
+		b.health.SetEndpoints(endpoints)
+	}
+	if b.outliers != nil {
+		b.outliers.retain(func(key string) bool { return b.find(key) >= 0 })
+	}
+}
+
+// available returns the indexes of the endpoints that are healthy and not
+// in tried. Ejected endpoints are left out unless all of them are ejected.
+func (b *Balancer) available(tried []Endpoint) []int {
+	indexes := make([]int, 0, len(b.endpoints))
+	for i := range b.endpoints {
+		e := &b.endpoints[i]
+		if wasTried(tried, e.Ns, e.Address) {
+			continue
+		}
+		if b.health == nil || b.health.Healthy(*e) {
+			indexes = append(indexes, i)
+		}
+	}
+	if b.outliers == nil {
+		return indexes
+	}
+	kept := make([]int, 0, len(indexes))
+	for _, i := range indexes {
+		if !b.outliers.ejected(b.endpoints[i].key()) {
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) == 0 {
+		return indexes
+	}
+	return kept
+}
+
+func containsIndex(indexes []int, i int) bool {
+	for _, j := range indexes {
+		if i == j {
+			return true
+		}
+	}
+	return false
+}
+
+// choose asks the strategy to choose between the endpoints in indexes.
+func (b *Balancer) choose(indexes []int, srcAddr net.Addr) int {
+	if len(indexes) == len(b.endpoints) {
+		return b.strategy.Next(b.endpoints, b.active, srcAddr)
+	}
+	endpoints := make([]Endpoint, len(indexes))
+	active := make([]int, len(indexes))
+	for j, i := range indexes {
+		endpoints[j] = b.endpoints[i]
+		active[j] = b.active[i]
+	}
+	return indexes[b.strategy.Next(endpoints, active, srcAddr)]
+}
+
+// find returns the index of the endpoint with key or -1.
+func (b *Balancer) find(key string) int {
+	for i := range b.endpoints {
+		if b.endpoints[i].key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// NextEndpoint is an implementation of the LoadBalancer interface.
+func (b *Balancer) NextEndpoint(service string, srcAddr net.Addr) (netns.NsHandle, string, error) {
+	return b.NextEndpointExcluding(service, srcAddr, nil)
+}
+
+// NextEndpointExcluding is an implementation of the Failover interface.
+func (b *Balancer) NextEndpointExcluding(service string, srcAddr net.Addr, tried []Endpoint) (netns.NsHandle, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.endpoints) == 0 {
+		return netns.None(), "", ErrMissingEndpoints
+	}
+	indexes := b.available(tried)
+	if len(indexes) == 0 {
+		return netns.None(), "", ErrNoHealthyEndpoints
+	}
+	ip := ""
+	if b.affinity != nil {
+		ip = clientIP(srcAddr)
+	}
+	i := -1
+	if ip != "" {
+		if key, ok := b.affinity.lookup(ip); ok {
+			i = b.find(key)
+		}
+		if i >= 0 && !containsIndex(indexes, i) {
+			i = -1
+		}
+	}
+	if i < 0 {
+		i = b.choose(indexes, srcAddr)
+		if ip != "" {
+			b.affinity.record(ip, b.endpoints[i].key())
+		}
+	}
+	b.active[i]++
+	return b.endpoints[i].Ns, b.endpoints[i].Address, nil
+}
+
+// DialResult is an implementation of the DialTracker interface.
+func (b *Balancer) DialResult(service string, ns netns.NsHandle, endpoint string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.outliers == nil {
+		return
+	}
+	for i := range b.endpoints {
+		if b.endpoints[i].equal(ns, endpoint) {
+			b.outliers.record(b.endpoints[i].key(), err)
+			return
+		}
+	}
+}
+
+// ConnectionClosed is an implementation of the ConnectionTracker interface.
+func (b *Balancer) ConnectionClosed(service string, ns netns.NsHandle, endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.endpoints {
+		if b.endpoints[i].equal(ns, endpoint) && b.active[i] > 0 {
+			b.active[i]--
+			return
+		}
+	}
+}
+
+// Active returns the number of open connections to each endpoint.
+func (b *Balancer) Active() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int(nil), b.active...)
+}
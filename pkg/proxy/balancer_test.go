@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+func testEndpoints(weights ...int) []Endpoint {
+	endpoints := make([]Endpoint, 0)
+	for i, w := range weights {
+		endpoints = append(endpoints, Endpoint{Ns: netns.None(), Address: string('a' + rune(i)), Weight: w})
+	}
+	return endpoints
+}
+
+func counts(t *testing.T, b *Balancer, n int, release bool) map[string]int {
+	result := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ns, endpoint, err := b.NextEndpoint("segment", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[endpoint]++
+		if release {
+			b.ConnectionClosed("segment", ns, endpoint)
+		}
+	}
+	return result
+}
+
+func TestBalancerNoEndpoints(t *testing.T) {
+	strategy, _ := NewStrategy("round-robin")
+	b := NewBalancer(strategy)
+	_, _, err := b.NextEndpoint("segment", nil)
+	if err != ErrMissingEndpoints {
+		t.Fatalf("Expected missing endpoints, got %v", err)
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	strategy, _ := NewStrategy("round-robin")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(0, 0, 0))
+	c := counts(t, b, 9, true)
+	if c["a"] != 3 || c["b"] != 3 || c["c"] != 3 {
+		t.Fatalf("Uneven round robin: %v", c)
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	strategy, _ := NewStrategy("least-conn")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(0, 0))
+	ns, endpoint, _ := b.NextEndpoint("segment", nil)
+	// the busy endpoint is skipped until its connection closes
+	c := counts(t, b, 4, true)
+	if c[endpoint] != 0 {
+		t.Fatalf("Busy endpoint %s chosen: %v", endpoint, c)
+	}
+	b.ConnectionClosed("segment", ns, endpoint)
+	c = counts(t, b, 4, true)
+	if c[endpoint] != 2 {
+		t.Fatalf("Released endpoint %s not shared: %v", endpoint, c)
+	}
+}
+
+func TestBalancerRandomTwo(t *testing.T) {
+	strategy, _ := NewStrategy("random-two")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(0, 0))
+	// with two endpoints both are compared so connections alternate
+	c := counts(t, b, 10, false)
+	if c["a"] != 5 || c["b"] != 5 {
+		t.Fatalf("Uneven random two: %v", c)
+	}
+	if active := b.Active(); active[0] != 5 || active[1] != 5 {
+		t.Fatalf("Unexpected active connections: %v", active)
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	strategy, _ := NewStrategy("weighted")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(3, 1, 0))
+	c := counts(t, b, 10, true)
+	if c["a"] != 6 || c["b"] != 2 || c["c"] != 2 {
+		t.Fatalf("Connections not weighted: %v", c)
+	}
+}
+
+func TestBalancerSetEndpointsKeepsActive(t *testing.T) {
+	strategy, _ := NewStrategy("round-robin")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(0, 0))
+	counts(t, b, 2, false)
+	b.SetEndpoints(testEndpoints(0, 0, 0)[1:])
+	if active := b.Active(); len(active) != 2 || active[0] != 1 || active[1] != 0 {
+		t.Fatalf("Unexpected active connections: %v", active)
+	}
+}
+
+func TestNewStrategyUnknown(t *testing.T) {
+	_, err := NewStrategy("bogus")
+	if err == nil {
+		t.Fatal("No error for unknown strategy")
+	}
+}
+
+func TestBalancerAffinity(t *testing.T) {
+	strategy, _ := NewStrategy("round-robin")
+	b := NewBalancer(strategy)
+	b.SetAffinity(time.Minute)
+	b.SetEndpoints(testEndpoints(0, 0))
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	_, first, _ := b.NextEndpoint("segment", src)
+	for i := 0; i < 3; i++ {
+		_, endpoint, _ := b.NextEndpoint("segment", src)
+		if endpoint != first {
+			t.Fatalf("Client moved from %s to %s", first, endpoint)
+		}
+	}
+	// the client moves once its endpoint is removed
+	b.SetEndpoints([]Endpoint{{Ns: netns.None(), Address: "c"}})
+	_, endpoint, _ := b.NextEndpoint("segment", src)
+	if endpoint != "c" {
+		t.Fatalf("Client not moved to remaining endpoint: %s", endpoint)
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	strategy, _ := NewStrategy("consistent-hash")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(0, 0, 0))
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	_, first, _ := b.NextEndpoint("segment", src)
+	src.Port = 2
+	_, endpoint, _ := b.NextEndpoint("segment", src)
+	if endpoint != first {
+		t.Fatalf("Same client ip mapped to %s and %s", first, endpoint)
+	}
+}
+
+func TestBalancerSkipsUnhealthy(t *testing.T) {
+	strategy, _ := NewStrategy("round-robin")
+	b := NewBalancer(strategy)
+	defer b.Stop()
+	b.SetHealthCheck(&HealthCheck{Type: "tcp", Interval: time.Hour})
+	endpoints := testEndpoints(0, 0)
+	b.SetEndpoints(endpoints)
+	for i := 0; i < healthFall; i++ {
+		b.health.record(endpoints[0], ErrMissingEndpoints)
+	}
+	c := counts(t, b, 4, true)
+	if c["a"] != 0 || c["b"] != 4 {
+		t.Fatalf("Unhealthy endpoint chosen: %v", c)
+	}
+	for i := 0; i < healthFall; i++ {
+		b.health.record(endpoints[1], ErrMissingEndpoints)
+	}
+	_, _, err := b.NextEndpoint("segment", nil)
+	if err != ErrNoHealthyEndpoints {
+		t.Fatalf("Expected no healthy endpoints, got %v", err)
+	}
+}
+
+func TestBalancerExcluding(t *testing.T) {
+	strategy, _ := NewStrategy("consistent-hash")
+	b := NewBalancer(strategy)
+	b.SetEndpoints(testEndpoints(0, 0))
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	ns, first, _ := b.NextEndpoint("segment", src)
+	tried := []Endpoint{{Ns: ns, Address: first}}
+	_, second, err := b.NextEndpointExcluding("segment", src, tried)
+	if err != nil || second == first {
+		t.Fatalf("Tried endpoint %s returned again: %s %v", first, second, err)
+	}
+	tried = append(tried, Endpoint{Ns: ns, Address: second})
+	_, _, err = b.NextEndpointExcluding("segment", src, tried)
+	if err == nil {
+		t.Fatal("Endpoint returned after all were tried")
+	}
+}
+
+func TestBalancerOutlierEjection(t *testing.T) {
+	strategy, _ := NewStrategy("round-robin")
+	b := NewBalancer(strategy)
+	b.SetOutlierDetection(2, time.Minute)
+	endpoints := testEndpoints(0, 0)
+	b.SetEndpoints(endpoints)
+	b.DialResult("segment", endpoints[0].Ns, "a", ErrMissingEndpoints)
+	b.DialResult("segment", endpoints[0].Ns, "a", nil)
+	b.DialResult("segment", endpoints[0].Ns, "a", ErrMissingEndpoints)
+	if c := counts(t, b, 4, true); c["a"] != 2 {
+		t.Fatalf("Endpoint ejected after a success: %v", c)
+	}
+	b.DialResult("segment", endpoints[0].Ns, "a", ErrMissingEndpoints)
+	if c := counts(t, b, 4, true); c["a"] != 0 {
+		t.Fatalf("Ejected endpoint chosen: %v", c)
+	}
+	// ejecting every endpoint would leave nothing to connect to
+	b.DialResult("segment", endpoints[1].Ns, "b", ErrMissingEndpoints)
+	b.DialResult("segment", endpoints[1].Ns, "b", ErrMissingEndpoints)
+	if c := counts(t, b, 4, true); c["a"] != 2 || c["b"] != 2 {
+		t.Fatalf("All endpoints ejected: %v", c)
+	}
+}
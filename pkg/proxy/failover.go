@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netns"
+)
+
+// RetryPolicy controls how many endpoints are dialed for a connection
+// before it is given up.
+type RetryPolicy struct {
+	// Attempts is the number of endpoints to try.
+	Attempts int
+	// Timeout is how long each endpoint is redialed before moving on.
+	Timeout time.Duration
+}
+
+// DefaultRetryPolicy is used by new Proxiers.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Timeout: endpointDialTimeout}
+
+// Default passive outlier detection for Balancers.
+const (
+	outlierFailures = 3
+	outlierCooldown = 30 * time.Second
+)
+
+type outlierState struct {
+	failures     int
+	ejectedUntil time.Time
+}
+
+// outlierDetector ejects endpoints after failures dials in a row have
+// failed. Ejected endpoints return after cooldown.
+type outlierDetector struct {
+	failures  int
+	cooldown  time.Duration
+	endpoints map[string]*outlierState
+}
+
+func newOutlierDetector(failures int, cooldown time.Duration) *outlierDetector {
+	return &outlierDetector{
+		failures:  failures,
+		cooldown:  cooldown,
+		endpoints: make(map[string]*outlierState),
+	}
+}
+
+func (o *outlierDetector) record(key string, err error) {
+	if err == nil {
+		delete(o.endpoints, key)
+		return
+	}
+	state, exists := o.endpoints[key]
+	if !exists {
+		state = &outlierState{}
+		o.endpoints[key] = state
+	}
+	state.failures++
+	if state.failures >= o.failures {
+		glog.Warningf("Ejecting endpoint %s for %v after %d failures", key, o.cooldown, state.failures)
+		state.failures = 0
+		state.ejectedUntil = time.Now().Add(o.cooldown)
+	}
+}
+
+func (o *outlierDetector) ejected(key string) bool {
+	state, exists := o.endpoints[key]
+	return exists && time.Now().Before(state.ejectedUntil)
+}
+
+// retain forgets endpoints for which keep returns false.
+func (o *outlierDetector) retain(keep func(key string) bool) {
+	for key := range o.endpoints {
+		if !keep(key) {
+			delete(o.endpoints, key)
+		}
+	}
+}
+
+// SetRetryPolicy replaces the retry policy of proxier.
+func (proxier *Proxier) SetRetryPolicy(policy RetryPolicy) {
+	proxier.mu.Lock()
+	defer proxier.mu.Unlock()
+	proxier.retry = policy
+}
+
+func (proxier *Proxier) retryPolicy() RetryPolicy {
+	proxier.mu.Lock()
+	defer proxier.mu.Unlock()
+	return proxier.retry
+}
+
+func wasTried(tried []Endpoint, ns netns.NsHandle, endpoint string) bool {
+	for i := range tried {
+		if tried[i].equal(ns, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextEndpoint asks the load balancer for an endpoint that is not in tried
+// if it supports it.
+func (proxier *Proxier) nextEndpoint(service string, srcAddr net.Addr, tried []Endpoint) (netns.NsHandle, string, error) {
+	if failover, ok := proxier.loadBalancer.(Failover); ok && len(tried) != 0 {
+		return failover.NextEndpointExcluding(service, srcAddr, tried)
+	}
+	return proxier.loadBalancer.NextEndpoint(service, srcAddr)
+}
+
+// dialResult tells the load balancer whether a dial to endpoint succeeded
+// if it is interested.
+func (proxier *Proxier) dialResult(service string, ns netns.NsHandle, endpoint string, err error) {
+	if tracker, ok := proxier.loadBalancer.(DialTracker); ok {
+		tracker.DialResult(service, ns, endpoint, err)
+	}
+}
+
+// dialEndpoint dials endpoints for the service of info until one answers
+// or the retry policy is exhausted. The endpoint that answered is returned
+// along with the connection.
+func (proxier *Proxier) dialEndpoint(info *serviceInfo, network string, srcAddr net.Addr) (netns.NsHandle, string, net.Conn, error) {
+	service := info.name
+	policy := proxier.retryPolicy()
+	tried := make([]Endpoint, 0, policy.Attempts)
+	var lastErr error
+	for attempt := 0; attempt < policy.Attempts; attempt++ {
+		ns, endpoint, err := proxier.nextEndpoint(service, srcAddr, tried)
+		if err != nil {
+			if lastErr != nil {
+				// every endpoint has been tried
+				break
+			}
+			glog.Errorf("Couldn't find an endpoint for %s %v", service, err)
+			info.stats.failed()
+			return ns, endpoint, nil, err
+		}
+		if wasTried(tried, ns, endpoint) {
+			proxier.connectionClosed(service, ns, endpoint)
+			continue
+		}
+		glog.Infof("Mapped service %s to endpoint %s", service, endpoint)
+		if ns.IsOpen() {
+			glog.Infof("Using namespace %v for endpoint %s", ns, endpoint)
+		}
+		var conn net.Conn
+		start := time.Now()
+		n, address := endpointNetwork(network, endpoint)
+		if network == "udp" && n != "udp" {
+			err = fmt.Errorf("Cannot proxy udp to %s", endpoint)
+		} else {
+			conn, err = retryDial(ns, n, address, policy.Timeout)
+		}
+		proxier.dialResult(service, ns, endpoint, err)
+		stats := info.endpointStats(Endpoint{Ns: ns, Address: endpoint})
+		if err == nil {
+			d := time.Since(start)
+			info.stats.dialed(d)
+			stats.dialed(d)
+			stats.opened()
+			return ns, endpoint, conn, nil
+		}
+		stats.failed()
+		glog.Errorf("Dial to %s failed: %v", endpoint, err)
+		proxier.connectionClosed(service, ns, endpoint)
+		tried = append(tried, Endpoint{Ns: ns, Address: endpoint})
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("No endpoint could be dialed for %s", service)
+	}
+	info.stats.failed()
+	return netns.None(), "", nil, lastErr
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Size of the buffers used for connections that cannot be spliced.
+const copyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// forward copies from src to dst until src is exhausted. Tcp and unix
+// stream sockets are spliced in the kernel. Anything else is copied
+// through a pooled buffer. If count is not nil it is passed the number of
+// bytes written after each write.
+func forward(dst, src net.Conn, count func(int64)) (int64, error) {
+	n, handled, err := splice(dst, src, count)
+	if handled {
+		return n, err
+	}
+	if count != nil {
+		return copyBuffered(&countingWriter{dst, count}, src)
+	}
+	return copyBuffered(dst, src)
+}
+
+type countingWriter struct {
+	io.Writer
+	count func(int64)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.count(int64(n))
+	return n, err
+}
+
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// connPair returns both ends of a connection on network.
+func connPair(t testing.TB, network, address string) (net.Conn, net.Conn) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial(network, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	return client, server
+}
+
+// testForward sends data into one connection, forwards it to another and
+// checks that it arrives intact.
+func testForward(t *testing.T, in, out [2]net.Conn, copy func(dst, src net.Conn) (int64, error)) {
+	data := make([]byte, 1<<20+17)
+	rand.Read(data)
+	go func() {
+		in[0].Write(data)
+		in[0].Close()
+	}()
+	result := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(out[1])
+		result <- b
+	}()
+	n, err := copy(out[0], in[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	out[0].Close()
+	if n != int64(len(data)) {
+		t.Fatalf("Forwarded %d of %d bytes", n, len(data))
+	}
+	if !bytes.Equal(<-result, data) {
+		t.Fatal("Forwarded data does not match")
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	a, b := connPair(t, "tcp", "127.0.0.1:0")
+	c, d := connPair(t, "tcp", "127.0.0.1:0")
+	testForward(t, [2]net.Conn{a, b}, [2]net.Conn{c, d}, spliceCopy)
+}
+
+func TestForwardUnixToTCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := connPair(t, "unix", filepath.Join(dir, "forward.sock"))
+	c, d := connPair(t, "tcp", "127.0.0.1:0")
+	testForward(t, [2]net.Conn{a, b}, [2]net.Conn{c, d}, spliceCopy)
+}
+
+func TestForwardFallback(t *testing.T) {
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	if _, ok := streamRawConn(b); ok {
+		t.Fatal("Pipe treated as a stream socket")
+	}
+	testForward(t, [2]net.Conn{a, b}, [2]net.Conn{c, d}, spliceCopy)
+}
+
+// userCopy hides the fast paths of the connections so every byte goes
+// through a user space buffer.
+func userCopy(dst, src net.Conn) (int64, error) {
+	return copyBuffered(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+}
+
+func spliceCopy(dst, src net.Conn) (int64, error) {
+	return forward(dst, src, nil)
+}
+
+func ioCopy(dst, src net.Conn) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+// benchmarkThroughput forwards b.N chunks of size bytes between two tcp
+// connections.
+func benchmarkThroughput(b *testing.B, size int, copy func(dst, src net.Conn) (int64, error)) {
+	in, inPeer := connPair(b, "tcp", "127.0.0.1:0")
+	out, outPeer := connPair(b, "tcp", "127.0.0.1:0")
+	defer out.Close()
+	defer outPeer.Close()
+	go func() {
+		copy(out, inPeer)
+		out.(*net.TCPConn).CloseWrite()
+		inPeer.Close()
+	}()
+	chunk := make([]byte, size)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, outPeer)
+		close(done)
+	}()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		in.Write(chunk)
+	}
+	in.Close()
+	<-done
+}
+
+// benchmarkLatency measures round trips of a small message through a
+// proxied connection to an echo server.
+func benchmarkLatency(b *testing.B, copy func(dst, src net.Conn) (int64, error)) {
+	client, proxyIn := connPair(b, "tcp", "127.0.0.1:0")
+	proxyOut, echo := connPair(b, "tcp", "127.0.0.1:0")
+	defer client.Close()
+	go func() {
+		io.Copy(echo, echo)
+		echo.Close()
+	}()
+	go func() {
+		copy(proxyOut, proxyIn)
+		proxyOut.Close()
+	}()
+	go func() {
+		copy(proxyIn, proxyOut)
+		proxyIn.Close()
+	}()
+	msg := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.Write(msg)
+		if _, err := io.ReadFull(client, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkThroughputSplice(b *testing.B) { benchmarkThroughput(b, 64*1024, spliceCopy) }
+func BenchmarkThroughputIOCopy(b *testing.B) { benchmarkThroughput(b, 64*1024, ioCopy) }
+func BenchmarkThroughputBuffer(b *testing.B) { benchmarkThroughput(b, 64*1024, userCopy) }
+func BenchmarkLatencySplice(b *testing.B)    { benchmarkLatency(b, spliceCopy) }
+func BenchmarkLatencyIOCopy(b *testing.B)    { benchmarkLatency(b, ioCopy) }
+func BenchmarkLatencyBuffer(b *testing.B)    { benchmarkLatency(b, userCopy) }
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Consecutive probe results needed to change the health of an endpoint.
+const (
+	healthFall = 3
+	healthRise = 2
+)
+
+// HealthCheck describes how endpoints are probed. Type is tcp, http or
+// exec. Http checks GET Path and expect a 2xx or 3xx status. Exec checks
+// run Command inside the namespace of the endpoint with the address of the
+// endpoint in $WORMHOLE_ENDPOINT and expect it to exit successfully.
+type HealthCheck struct {
+	Type     string
+	Path     string
+	Command  []string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// ParseHealthCheck parses INTERVAL CHECK where CHECK is one of tcp,
+// http:PATH or exec:COMMAND.
+func ParseHealthCheck(spec string) (*HealthCheck, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), " ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Health check requires an interval and a check: %s", spec)
+	}
+	interval, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Health check interval must be positive: %s", parts[0])
+	}
+	h := &HealthCheck{Interval: interval, Timeout: interval}
+	check := strings.TrimSpace(parts[1])
+	switch {
+	case check == "tcp":
+		h.Type = "tcp"
+	case strings.HasPrefix(check, "http:"):
+		h.Type = "http"
+		h.Path = strings.TrimPrefix(check, "http:")
+		if !strings.HasPrefix(h.Path, "/") {
+			return nil, fmt.Errorf("Health check path must be absolute: %s", h.Path)
+		}
+	case strings.HasPrefix(check, "exec:"):
+		h.Type = "exec"
+		h.Command = strings.Fields(strings.TrimPrefix(check, "exec:"))
+		if len(h.Command) == 0 {
+			return nil, fmt.Errorf("Health check command is empty")
+		}
+	default:
+		return nil, fmt.Errorf("Health check %s not recognized", check)
+	}
+	return h, nil
+}
+
+// Probe checks endpoint once from inside its namespace.
+func (h *HealthCheck) Probe(endpoint Endpoint) error {
+	network, address := endpointNetwork("tcp", endpoint.Address)
+	switch h.Type {
+	case "tcp":
+		conn, err := DialInNs(endpoint.Ns, network, address, h.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		host := address
+		if network == "unix" {
+			host = "localhost"
+		}
+		c := &http.Client{
+			Timeout: h.Timeout,
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return DialInNs(endpoint.Ns, network, address, h.Timeout)
+				},
+			},
+		}
+		res, err := c.Get("http://" + host + h.Path)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return fmt.Errorf("Health check returned %s", res.Status)
+		}
+		return nil
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+		defer cancel()
+		// the child inherits the namespace of the locked thread
+		return RunInNs(endpoint.Ns, func() error {
+			cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+			cmd.Env = append(os.Environ(), "WORMHOLE_ENDPOINT="+address)
+			return cmd.Run()
+		})
+	}
+	return fmt.Errorf("Health check %s not recognized", h.Type)
+}
+
+type healthState struct {
+	endpoint  Endpoint
+	healthy   bool
+	successes int
+	failures  int
+	lastError error
+}
+
+// EndpointHealth is the health of one endpoint.
+type EndpointHealth struct {
+	Address   string
+	Healthy   bool
+	LastError string
+}
+
+// HealthMonitor periodically probes a set of endpoints with a HealthCheck.
+// Endpoints start healthy and become unhealthy after healthFall failed
+// probes in a row.
+type HealthMonitor struct {
+	check  *HealthCheck
+	mu     sync.Mutex
+	states map[string]*healthState
+	stop   chan struct{}
+}
+
+// NewHealthMonitor starts monitoring with check. Stop must be called to
+// release it.
+func NewHealthMonitor(check *HealthCheck) *HealthMonitor {
+	m := &HealthMonitor{
+		check:  check,
+		states: make(map[string]*healthState),
+		stop:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// SetEndpoints replaces the monitored endpoints. Endpoints that were
+// already monitored keep their health.
+func (m *HealthMonitor) SetEndpoints(endpoints []Endpoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make(map[string]*healthState)
+	for _, e := range endpoints {
+		state, exists := m.states[e.key()]
+		if !exists {
+			state = &healthState{healthy: true}
+		}
+		state.endpoint = e
+		states[e.key()] = state
+	}
+	m.states = states
+}
+
+// Healthy returns false if endpoint is monitored and unhealthy.
+func (m *HealthMonitor) Healthy(endpoint Endpoint) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, exists := m.states[endpoint.key()]
+	return !exists || state.healthy
+}
+
+// Health returns the health of endpoint and whether it is monitored.
+func (m *HealthMonitor) Health(endpoint Endpoint) (EndpointHealth, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, exists := m.states[endpoint.key()]
+	if !exists {
+		return EndpointHealth{}, false
+	}
+	health := EndpointHealth{Address: endpoint.Address, Healthy: state.healthy}
+	if state.lastError != nil {
+		health.LastError = state.lastError.Error()
+	}
+	return health, true
+}
+
+// Stop stops probing.
+func (m *HealthMonitor) Stop() {
+	close(m.stop)
+}
+
+func (m *HealthMonitor) run() {
+	ticker := time.NewTicker(m.check.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.probeAll()
+		}
+	}
+}
+
+func (m *HealthMonitor) probeAll() {
+	m.mu.Lock()
+	endpoints := make([]Endpoint, 0, len(m.states))
+	for _, state := range m.states {
+		endpoints = append(endpoints, state.endpoint)
+	}
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, e := range endpoints {
+		wg.Add(1)
+		go func(e Endpoint) {
+			defer wg.Done()
+			m.record(e, m.check.Probe(e))
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (m *HealthMonitor) record(e Endpoint, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, exists := m.states[e.key()]
+	if !exists {
+		// removed while probing
+		return
+	}
+	state.lastError = err
+	if err != nil {
+		state.successes = 0
+		state.failures++
+		if state.healthy && state.failures >= healthFall {
+			glog.Warningf("Endpoint %s is unhealthy: %v", e.Address, err)
+			state.healthy = false
+		}
+		return
+	}
+	state.failures = 0
+	state.successes++
+	if !state.healthy && state.successes >= healthRise {
+		glog.Infof("Endpoint %s is healthy", e.Address)
+		state.healthy = true
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	h, err := ParseHealthCheck("5s http:/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != "http" || h.Path != "/status" || h.Interval != 5*time.Second {
+		t.Fatalf("Unexpected health check: %+v", h)
+	}
+	h, err = ParseHealthCheck("1m exec:mysqladmin ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != "exec" || len(h.Command) != 2 || h.Command[1] != "ping" {
+		t.Fatalf("Unexpected health check: %+v", h)
+	}
+	for _, spec := range []string{"tcp", "5s", "0s tcp", "5s udp", "5s http:status", "5s exec:"} {
+		if _, err := ParseHealthCheck(spec); err == nil {
+			t.Fatalf("Invalid health check %q accepted", spec)
+		}
+	}
+}
+
+func TestHealthCheckProbe(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	endpoint := Endpoint{Ns: netns.None(), Address: s.Listener.Addr().String()}
+	checks := map[string]bool{"tcp": true, "http:/ok": true, "http:/missing": false}
+	for check, healthy := range checks {
+		h, err := ParseHealthCheck("1s " + check)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.Probe(endpoint)
+		if (err == nil) != healthy {
+			t.Fatalf("Check %s returned %v", check, err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := Endpoint{Ns: netns.None(), Address: l.Addr().String()}
+	l.Close()
+	h, _ := ParseHealthCheck("1s tcp")
+	if h.Probe(closed) == nil {
+		t.Fatal("Probe of a closed port succeeded")
+	}
+}
+
+func TestHealthMonitorThresholds(t *testing.T) {
+	m := NewHealthMonitor(&HealthCheck{Type: "tcp", Interval: time.Hour})
+	defer m.Stop()
+	e := testEndpoints(0)[0]
+	m.SetEndpoints([]Endpoint{e})
+	failed := errors.New("failed")
+	for i := 0; i < healthFall; i++ {
+		if !m.Healthy(e) {
+			t.Fatalf("Unhealthy after %d failures", i)
+		}
+		m.record(e, failed)
+	}
+	health, _ := m.Health(e)
+	if health.Healthy || health.LastError != "failed" {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+	for i := 0; i < healthRise; i++ {
+		if m.Healthy(e) {
+			t.Fatalf("Healthy after %d successes", i)
+		}
+		m.record(e, nil)
+	}
+	if !m.Healthy(e) {
+		t.Fatal("Endpoint did not recover")
+	}
+}
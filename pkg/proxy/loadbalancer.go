@@ -27,3 +27,22 @@ type LoadBalancer interface {
 	// service and source address.
 	NextEndpoint(service string, srcAddr net.Addr) (netns.NsHandle, string, error)
 }
+
+// ConnectionTracker is implemented by LoadBalancers that need to know when
+// a connection to an endpoint returned by NextEndpoint has closed.
+type ConnectionTracker interface {
+	ConnectionClosed(service string, ns netns.NsHandle, endpoint string)
+}
+
+// Failover is implemented by LoadBalancers that can choose another
+// endpoint when dialing the previous choices failed.
+type Failover interface {
+	// NextEndpointExcluding is NextEndpoint without the endpoints in tried.
+	NextEndpointExcluding(service string, srcAddr net.Addr, tried []Endpoint) (netns.NsHandle, string, error)
+}
+
+// DialTracker is implemented by LoadBalancers that need to know whether
+// dialing an endpoint returned by NextEndpoint succeeded.
+type DialTracker interface {
+	DialResult(service string, ns netns.NsHandle, endpoint string, err error)
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netns"
+)
+
+// Size of maglev lookup tables. It must be prime and should be much larger
+// than the number of endpoints.
+const maglevTableSize = 65537
+
+func hashString(s string, seed byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{seed})
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// maglevTable builds a maglev lookup table for names. Each entry is the
+// index of a name. Adding or removing a name only moves the entries of
+// about 1/len(names) of the keys.
+func maglevTable(names []string, size int) []int {
+	table := make([]int, size)
+	if len(names) == 0 {
+		return table
+	}
+	offsets := make([]uint64, len(names))
+	skips := make([]uint64, len(names))
+	for i, name := range names {
+		offsets[i] = hashString(name, 0) % uint64(size)
+		skips[i] = hashString(name, 1)%uint64(size-1) + 1
+	}
+	for i := range table {
+		table[i] = -1
+	}
+	next := make([]uint64, len(names))
+	filled := 0
+	for {
+		for i := range names {
+			c := (offsets[i] + next[i]*skips[i]) % uint64(size)
+			for table[c] >= 0 {
+				next[i]++
+				c = (offsets[i] + next[i]*skips[i]) % uint64(size)
+			}
+			table[c] = i
+			next[i]++
+			filled++
+			if filled == size {
+				return table
+			}
+		}
+	}
+}
+
+// maglevLookup returns the index of the name that key maps to in table.
+func maglevLookup(table []int, key string) int {
+	return table[hashString(key, 2)%uint64(len(table))]
+}
+
+// clientIP returns the ip address of srcAddr or an empty string if it does
+// not have one.
+func clientIP(srcAddr net.Addr) string {
+	switch addr := srcAddr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(srcAddr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// LoadBalancerHash is a consistent hashing load balancer. Connections
+// from the same client ip are sent to the same endpoint and most clients
+// keep their endpoint when endpoints are added or removed.
+type LoadBalancerHash struct {
+	lock         sync.RWMutex
+	endpointsMap map[string][]string
+	tables       map[string][]int
+}
+
+// NewLoadBalancerHash returns a new LoadBalancerHash.
+func NewLoadBalancerHash() *LoadBalancerHash {
+	return &LoadBalancerHash{
+		endpointsMap: make(map[string][]string),
+		tables:       make(map[string][]int),
+	}
+}
+
+// NextEndpoint returns a service endpoint.
+// The service endpoint is chosen by hashing the ip of srcAddr.
+func (lb *LoadBalancerHash) NextEndpoint(service string, srcAddr net.Addr) (netns.NsHandle, string, error) {
+	ns := netns.None()
+	lb.lock.RLock()
+	defer lb.lock.RUnlock()
+	endpoints, exists := lb.endpointsMap[service]
+	if !exists {
+		return ns, "", ErrMissingServiceEntry
+	}
+	if len(endpoints) == 0 {
+		return ns, "", ErrMissingEndpoints
+	}
+	return ns, endpoints[maglevLookup(lb.tables[service], clientIP(srcAddr))], nil
+}
+
+// OnUpdate manages the registered service endpoints.
+// Registered endpoints are updated if found in the update set or
+// unregistered if missing from the update set.
+func (lb *LoadBalancerHash) OnUpdate(endpoints []api.Endpoints) {
+	registeredEndpoints := make(map[string]bool)
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	// Update endpoints for services.
+	for _, endpoint := range endpoints {
+		existingEndpoints, exists := lb.endpointsMap[endpoint.ID]
+		validEndpoints := filterValidEndpoints(endpoint.Endpoints)
+		if !exists || !reflect.DeepEqual(existingEndpoints, validEndpoints) {
+			glog.Infof("LoadBalancerHash: Setting endpoints for %s to %+v", endpoint.ID, endpoint.Endpoints)
+			lb.endpointsMap[endpoint.ID] = validEndpoints
+			lb.tables[endpoint.ID] = maglevTable(validEndpoints, maglevTableSize)
+		}
+		registeredEndpoints[endpoint.ID] = true
+	}
+	// Remove endpoints missing from the update.
+	for k, v := range lb.endpointsMap {
+		if _, exists := registeredEndpoints[k]; !exists {
+			glog.Infof("LoadBalancerHash: Removing endpoints for %s -> %+v", k, v)
+			delete(lb.endpointsMap, k)
+			delete(lb.tables, k)
+		}
+	}
+}
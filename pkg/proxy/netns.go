@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+// RunInNs calls f with the calling thread in network namespace ns. The
+// namespace is only changed on a dedicated locked thread so it never leaks
+// into other goroutines. If the original namespace cannot be restored the
+// thread is left locked so the runtime discards it when the goroutine exits.
+// If ns is not open, f is called directly.
+func RunInNs(ns netns.NsHandle, f func() error) error {
+	if !ns.IsOpen() {
+		return f()
+	}
+	c := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origns, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			c <- err
+			return
+		}
+		defer origns.Close()
+		err = netns.Set(ns)
+		if err != nil {
+			c <- err
+			return
+		}
+		c <- f()
+		if netns.Set(origns) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return <-c
+}
+
+// DialInNs dials address from inside ns.
+func DialInNs(ns netns.NsHandle, network, address string, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	err := RunInNs(ns, func() error {
+		var err error
+		conn, err = net.DialTimeout(network, address, timeout)
+		return err
+	})
+	return conn, err
+}
+
+// ListenInNs announces on address inside ns. Sockets keep the namespace
+// they were created in, so the listener accepts connections from ns.
+func ListenInNs(ns netns.NsHandle, network, address string) (net.Listener, error) {
+	var l net.Listener
+	err := RunInNs(ns, func() error {
+		var err error
+		l, err = net.Listen(network, address)
+		return err
+	})
+	return l, err
+}
+
+// ListenPacketInNs is the packet oriented version of ListenInNs.
+func ListenPacketInNs(ns netns.NsHandle, network, address string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	err := RunInNs(ns, func() error {
+		var err error
+		conn, err = net.ListenPacket(network, address)
+		return err
+	})
+	return conn, err
+}
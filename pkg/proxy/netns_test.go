@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+func TestDialInNsRestoresNs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origns, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origns.Close()
+	newns, err := netns.New()
+	if err != nil {
+		t.Skipf("Unable to create namespace: %v", err)
+	}
+	defer newns.Close()
+	err = netns.Set(origns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a listener in the new namespace is only reachable from inside it
+	l, err := ListenInNs(newns, "tcp", "127.0.0.1:0")
+	if err != nil {
+		// loopback is down in a fresh namespace
+		t.Skipf("Unable to listen in namespace: %v", err)
+	}
+	defer l.Close()
+	_, err = DialInNs(netns.None(), "tcp", l.Addr().String(), time.Second)
+	if err == nil {
+		t.Fatal("Dial from the original namespace reached the new namespace")
+	}
+
+	cur, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	if !cur.Equal(origns) {
+		t.Fatal("Namespace leaked into the calling thread")
+	}
+}
+
+func TestRunInNsNone(t *testing.T) {
+	called := false
+	err := RunInNs(netns.None(), func() error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Fatalf("Function not called directly: %v", err)
+	}
+}
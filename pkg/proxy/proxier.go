@@ -18,9 +18,8 @@ package proxy
 
 import (
 	"fmt"
-	"io"
 	"net"
-	"runtime"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,13 +32,19 @@ import (
 )
 
 type serviceInfo struct {
-	name     string
-	port     int
-	protocol string
-	socket   proxySocket
-	timeout  time.Duration
-	mu       sync.Mutex // protects active
-	active   bool
+	name        string
+	port        int
+	protocol    string
+	socket      proxySocket
+	timeout     time.Duration
+	mu          sync.Mutex // protects active, draining, connections, conns, idleSince and endpoints
+	active      bool
+	draining    bool
+	connections int
+	conns       map[net.Conn]bool
+	idleSince   time.Time
+	stats       statsRecorder
+	endpoints   map[string]*endpointRecorder
 }
 
 func (si *serviceInfo) isActive() bool {
@@ -56,6 +61,61 @@ func (si *serviceInfo) setActive(val bool) bool {
 	return tmp
 }
 
+// connOpened records a new tcp connection or udp client session.
+func (si *serviceInfo) connOpened() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.connections++
+}
+
+// connClosed records the end of a tcp connection or udp client session.
+func (si *serviceInfo) connClosed() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.connections--
+	if si.connections == 0 {
+		si.idleSince = time.Now()
+	}
+}
+
+// track records conn as open so it can be closed when the service is
+// forcibly drained.
+func (si *serviceInfo) track(conn net.Conn) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.conns == nil {
+		si.conns = make(map[net.Conn]bool)
+	}
+	si.conns[conn] = true
+}
+
+func (si *serviceInfo) untrack(conn net.Conn) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	delete(si.conns, conn)
+}
+
+func (si *serviceInfo) isDraining() bool {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return si.draining
+}
+
+func (si *serviceInfo) openConnections() int {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return si.connections
+}
+
+// closeConns closes every tracked connection.
+func (si *serviceInfo) closeConns() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	for conn := range si.conns {
+		conn.Close()
+	}
+}
+
 // How long we wait for a connection to a backend.
 const endpointDialTimeout = 5 * time.Second
 
@@ -73,17 +133,20 @@ type proxySocket interface {
 	ProxyLoop(service string, proxier *Proxier)
 }
 
-// tcpProxySocket implements proxySocket.  Close() is implemented by net.Listener.  When Close() is called,
-// no new connections are allowed but existing connections are left untouched.
+// tcpProxySocket implements proxySocket for stream sockets (tcp and unix).  Close() is implemented by
+// net.Listener.  When Close() is called, no new connections are allowed but existing connections are left
+// untouched.
 type tcpProxySocket struct {
 	net.Listener
 }
 
-func retryDial(network, address string, timeout time.Duration) (net.Conn, error) {
+// retryDial dials address from inside ns until it succeeds or timeout
+// expires.
+func retryDial(ns netns.NsHandle, network, address string, timeout time.Duration) (net.Conn, error) {
 	endTime := time.Now().Add(timeout)
 	for {
 		remaining := endTime.Sub(time.Now())
-		outConn, err := net.DialTimeout(network, address, remaining)
+		outConn, err := DialInNs(ns, network, address, remaining)
 		if err != nil {
 			if endTime.After(time.Now()) {
 				glog.Infof("Dial retrying on error for %s: %v", remaining, err)
@@ -115,49 +178,60 @@ func (tcp *tcpProxySocket) ProxyLoop(service string, proxier *Proxier) {
 			continue
 		}
 		glog.Infof("Accepted TCP connection from %v to %v", inConn.RemoteAddr(), inConn.LocalAddr())
-		ns, endpoint, err := proxier.loadBalancer.NextEndpoint(service, inConn.RemoteAddr())
-		if err != nil {
-			glog.Errorf("Couldn't find an endpoint for %s %v", service, err)
-			inConn.Close()
-			continue
-		}
-		glog.Infof("Mapped service %s to endpoint %s", service, endpoint)
-		// TODO: This could spin up a new goroutine to make the outbound connection,
-		// and keep accepting inbound traffic.
-		if ns.IsOpen() {
-			glog.Infof("Using namespace %v for endpoint %s", ns, endpoint)
-			runtime.LockOSThread()
-			defer runtime.UnlockOSThread()
-			origns, err := netns.Get()
-			if err != nil {
-				glog.Errorf("Failed to get original ns: %v", err)
-				continue
-			}
-			err = netns.Set(ns)
-			if err != nil {
-				glog.Errorf("Failed to set ns: %v", err)
-				continue
-			}
-			defer netns.Set(origns)
-		}
-		outConn, err := retryDial("tcp", endpoint, endpointDialTimeout)
-		if err != nil {
-			// TODO: Try another endpoint?
-			glog.Errorf("Dial failed: %v", err)
-			inConn.Close()
-			continue
-		}
-		// Spin up an async copy loop.
-		proxyTCP(inConn.(*net.TCPConn), outConn.(*net.TCPConn))
+		info.connOpened()
+		info.stats.accepted()
+		info.track(inConn)
+		// Finding an endpoint may trigger the backend, so dial in a
+		// goroutine and keep accepting inbound traffic.
+		go func() {
+			defer util.HandleCrash()
+			tcp.dialBackend(service, proxier, info, inConn)
+		}()
 	}
 }
 
-// proxyTCP proxies data bi-directionally between in and out.
-func proxyTCP(in, out *net.TCPConn) {
-	glog.Infof("Creating proxy between %v <-> %v <-> %v <-> %v",
+// dialBackend connects inConn to the next endpoint for service.
+func (tcp *tcpProxySocket) dialBackend(service string, proxier *Proxier, info *serviceInfo, inConn net.Conn) {
+	ns, endpoint, outConn, err := proxier.dialEndpoint(info, "tcp", inConn.RemoteAddr())
+	if err != nil {
+		inConn.Close()
+		info.untrack(inConn)
+		info.connClosed()
+		return
+	}
+	info.track(outConn)
+	estats := info.endpointStats(Endpoint{Ns: ns, Address: endpoint})
+	// Spin up an async copy loop.
+	proxyTCP(inConn, outConn, connStats{&info.stats, &estats.statsRecorder}, func() {
+		estats.closed()
+		info.untrack(inConn)
+		info.untrack(outConn)
+		info.connClosed()
+		proxier.connectionClosed(service, ns, endpoint)
+	})
+}
+
+// proxyTCP proxies data bi-directionally between in and out. done is
+// called once both directions have finished and the connections are closed.
+func proxyTCP(in, out net.Conn, stats connStats, done func()) {
+	glog.V(1).Infof("Creating proxy between %v <-> %v <-> %v <-> %v",
 		in.RemoteAddr(), in.LocalAddr(), out.LocalAddr(), out.RemoteAddr())
-	go copyBytes(in, out)
-	go copyBytes(out, in)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyBytes(in, out, stats.addOut)
+	}()
+	go func() {
+		defer wg.Done()
+		copyBytes(out, in, stats.addIn)
+	}()
+	go func() {
+		wg.Wait()
+		in.Close()
+		out.Close()
+		done()
+	}()
 }
 
 // udpProxySocket implements proxySocket.  Close() is implemented by net.UDPConn.  When Close() is called,
@@ -171,14 +245,18 @@ func (udp *udpProxySocket) Addr() net.Addr {
 	return udp.LocalAddr()
 }
 
+// How many packets are queued for a UDP client while its backend is dialed.
+const maxPendingPackets = 64
+
 // Holds all the known UDP clients that have not timed out.
 type clientCache struct {
 	mu      sync.Mutex
 	clients map[string]net.Conn // addr string -> connection
+	pending map[string][][]byte // addr string -> packets queued while dialing
 }
 
 func newClientCache() *clientCache {
-	return &clientCache{clients: map[string]net.Conn{}}
+	return &clientCache{clients: map[string]net.Conn{}, pending: map[string][][]byte{}}
 }
 
 func (udp *udpProxySocket) ProxyLoop(service string, proxier *Proxier) {
@@ -208,8 +286,9 @@ func (udp *udpProxySocket) ProxyLoop(service string, proxier *Proxier) {
 			break
 		}
 		// If this is a client we know already, reuse the connection and goroutine.
-		svrConn, err := udp.getBackendConn(activeClients, cliAddr, proxier, service, info.timeout)
-		if err != nil {
+		svrConn := udp.getBackendConn(activeClients, cliAddr, proxier, info, buffer[0:n])
+		if svrConn == nil {
+			// the packet was queued until the backend is dialed
 			continue
 		}
 		// TODO: It would be nice to let the goroutine handle this write, but we don't
@@ -230,40 +309,76 @@ func (udp *udpProxySocket) ProxyLoop(service string, proxier *Proxier) {
 	}
 }
 
-func (udp *udpProxySocket) getBackendConn(activeClients *clientCache, cliAddr net.Addr, proxier *Proxier, service string, timeout time.Duration) (net.Conn, error) {
+// getBackendConn returns the connection for cliAddr. If there is none yet,
+// packet is queued and nil is returned while the backend is dialed in a
+// goroutine.
+func (udp *udpProxySocket) getBackendConn(activeClients *clientCache, cliAddr net.Addr, proxier *Proxier, info *serviceInfo, packet []byte) net.Conn {
 	activeClients.mu.Lock()
 	defer activeClients.mu.Unlock()
 
-	svrConn, found := activeClients.clients[cliAddr.String()]
-	if !found {
-		// TODO: This could spin up a new goroutine to make the outbound connection,
-		// and keep accepting inbound traffic.
+	key := cliAddr.String()
+	svrConn, found := activeClients.clients[key]
+	if found {
+		return svrConn
+	}
+	queued, dialing := activeClients.pending[key]
+	if !dialing && info.isDraining() {
+		// new clients are dropped while the service drains
+		return nil
+	}
+	if len(queued) < maxPendingPackets {
+		activeClients.pending[key] = append(queued, append([]byte(nil), packet...))
+	}
+	if !dialing {
 		glog.Infof("New UDP connection from %s", cliAddr)
-		ns, endpoint, err := proxier.loadBalancer.NextEndpoint(service, cliAddr)
-		if err != nil {
-			glog.Errorf("Couldn't find an endpoint for %s %v", service, err)
-			return nil, err
-		}
-		glog.Infof("Mapped service %s to endpoint %s", service, endpoint)
-		if ns.IsOpen() {
-			glog.Infof("Using namespace %v for endpoint %s", ns, endpoint)
-			runtime.LockOSThread()
-			netns.Set(ns)
-			defer runtime.UnlockOSThread()
-		}
-		svrConn, err = retryDial("udp", endpoint, endpointDialTimeout)
-		if err != nil {
-			// TODO: Try another endpoint?
-			glog.Errorf("Dial failed: %v", err)
-			return nil, err
-		}
-		activeClients.clients[cliAddr.String()] = svrConn
-		go func(cliAddr net.Addr, svrConn net.Conn, activeClients *clientCache, timeout time.Duration) {
+		// the session counts as open while the backend is dialed so that
+		// drains and idle checks wait for it
+		info.connOpened()
+		info.stats.accepted()
+		go func() {
 			defer util.HandleCrash()
-			udp.proxyClient(cliAddr, svrConn, activeClients, timeout)
-		}(cliAddr, svrConn, activeClients, timeout)
+			udp.dialBackend(activeClients, cliAddr, proxier, info)
+		}()
+	}
+	return nil
+}
+
+// dialBackend connects cliAddr to the next endpoint for the service and
+// flushes the packets that were queued while dialing.
+func (udp *udpProxySocket) dialBackend(activeClients *clientCache, cliAddr net.Addr, proxier *Proxier, info *serviceInfo) {
+	service := info.name
+	key := cliAddr.String()
+	ns, endpoint, conn, err := proxier.dialEndpoint(info, "udp", cliAddr)
+
+	activeClients.mu.Lock()
+	defer activeClients.mu.Unlock()
+	queued := activeClients.pending[key]
+	delete(activeClients.pending, key)
+	if err != nil {
+		info.connClosed()
+		return
+	}
+	estats := info.endpointStats(Endpoint{Ns: ns, Address: endpoint})
+	svrConn := &countingConn{conn, connStats{&info.stats, &estats.statsRecorder}}
+	// Writing the queue before publishing the connection keeps packets in
+	// order with the ones written by the proxy loop.
+	for _, packet := range queued {
+		_, err = svrConn.Write(packet)
+		if err != nil && !logTimeout(err) {
+			glog.Errorf("Write failed: %v", err)
+		}
 	}
-	return svrConn, nil
+	svrConn.SetDeadline(time.Now().Add(info.timeout))
+	activeClients.clients[key] = svrConn
+	info.track(svrConn)
+	go func(cliAddr net.Addr, svrConn net.Conn, activeClients *clientCache, timeout time.Duration) {
+		defer util.HandleCrash()
+		defer proxier.connectionClosed(service, ns, endpoint)
+		defer info.connClosed()
+		defer estats.closed()
+		defer info.untrack(svrConn)
+		udp.proxyClient(cliAddr, svrConn, activeClients, timeout)
+	}(cliAddr, svrConn, activeClients, info.timeout)
 }
 
 // This function is expected to be called as a goroutine.
@@ -306,11 +421,11 @@ func logTimeout(err error) bool {
 	return false
 }
 
-func newProxySocket(protocol string, host string, port int) (proxySocket, error) {
+func newProxySocket(ns netns.NsHandle, protocol string, host string, port int) (proxySocket, error) {
 	endTime := time.Now().Add(listenTimeout)
 	for {
 		remaining := endTime.Sub(time.Now())
-		sock, err := innerProxySocket(protocol, host, port)
+		sock, err := innerProxySocket(ns, protocol, host, port)
 		if err != nil {
 			// TODO(vish): don't retry if the socket is in use
 			if endTime.After(time.Now()) {
@@ -326,24 +441,30 @@ func newProxySocket(protocol string, host string, port int) (proxySocket, error)
 
 }
 
-func innerProxySocket(protocol string, host string, port int) (proxySocket, error) {
+func innerProxySocket(ns netns.NsHandle, protocol string, host string, port int) (proxySocket, error) {
 	switch strings.ToUpper(protocol) {
 	case "TCP":
-		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		listener, err := ListenInNs(ns, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 		if err != nil {
 			return nil, err
 		}
 		return &tcpProxySocket{listener}, nil
 	case "UDP":
-		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		conn, err := ListenPacketInNs(ns, "udp", net.JoinHostPort(host, strconv.Itoa(port)))
 		if err != nil {
 			return nil, err
 		}
-		conn, err := net.ListenUDP("udp", addr)
+		return &udpProxySocket{conn.(*net.UDPConn)}, nil
+	case "UNIX":
+		if fi, err := os.Lstat(host); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			// remove stale socket from a previous run
+			os.Remove(host)
+		}
+		listener, err := ListenInNs(ns, "unix", host)
 		if err != nil {
 			return nil, err
 		}
-		return &udpProxySocket{conn}, nil
+		return &tcpProxySocket{listener}, nil
 	}
 	return nil, fmt.Errorf("Unknown protocol %q", protocol)
 }
@@ -352,8 +473,9 @@ func innerProxySocket(protocol string, host string, port int) (proxySocket, erro
 // and services that provide the actual implementations.
 type Proxier struct {
 	loadBalancer LoadBalancer
-	mu           sync.Mutex // protects serviceMap
+	mu           sync.Mutex // protects serviceMap and retry
 	serviceMap   map[string]*serviceInfo
+	retry        RetryPolicy
 	address      string
 	// NOTE(vish): this ns probably should be part of the Service struct
 	ns netns.NsHandle
@@ -370,20 +492,63 @@ func NewProxier(loadBalancer LoadBalancer, address string) *Proxier {
 	return &Proxier{
 		loadBalancer: loadBalancer,
 		serviceMap:   make(map[string]*serviceInfo),
+		retry:        DefaultRetryPolicy,
 		address:      address,
 		// NOTE(vish): this ns probably should be part of the Service struct
 		ns: netns.None(),
 	}
 }
 
-func copyBytes(in, out *net.TCPConn) {
-	glog.Infof("Copying from %v <-> %v <-> %v <-> %v",
+// halfCloser is implemented by *net.TCPConn and *net.UnixConn.
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// copyBytes copies from out to in and passes the number of bytes copied
+// to count as it goes.
+func copyBytes(in, out net.Conn, count func(int64)) {
+	glog.V(2).Infof("Copying from %v <-> %v <-> %v <-> %v",
 		in.RemoteAddr(), in.LocalAddr(), out.LocalAddr(), out.RemoteAddr())
-	if _, err := io.Copy(in, out); err != nil {
+	if _, err := forward(in, out, count); err != nil {
 		glog.Errorf("I/O error: %v", err)
 	}
-	in.CloseRead()
-	out.CloseWrite()
+	if c, ok := in.(halfCloser); ok {
+		c.CloseRead()
+	}
+	if c, ok := out.(halfCloser); ok {
+		c.CloseWrite()
+	}
+}
+
+// endpointNetwork splits an endpoint into a network and an address.
+// Endpoints use the network of the service unless they are prefixed with
+// unix://.
+func endpointNetwork(network, endpoint string) (string, string) {
+	if strings.HasPrefix(endpoint, "unix://") {
+		return "unix", strings.TrimPrefix(endpoint, "unix://")
+	}
+	return network, endpoint
+}
+
+// connectionClosed tells the load balancer that a connection to endpoint
+// has closed if it is interested.
+func (proxier *Proxier) connectionClosed(service string, ns netns.NsHandle, endpoint string) {
+	if tracker, ok := proxier.loadBalancer.(ConnectionTracker); ok {
+		tracker.ConnectionClosed(service, ns, endpoint)
+	}
+}
+
+// Activity returns the number of open connections for the named service
+// and, if there are none, the time the service became idle.
+func (proxier *Proxier) Activity(service string) (int, time.Time, error) {
+	info, found := proxier.getServiceInfo(service)
+	if !found {
+		return 0, time.Time{}, fmt.Errorf("unknown service: %s", service)
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.connections, info.idleSince, nil
 }
 
 // StopProxy stops the proxy for the named service.
@@ -396,6 +561,45 @@ func (proxier *Proxier) StopProxy(service string) error {
 	return proxier.stopProxyInternal(info)
 }
 
+// How often DrainProxy checks for open connections.
+const drainInterval = 100 * time.Millisecond
+
+// DrainProxy stops the proxy for the named service after waiting up to
+// timeout for open connections to finish. New tcp connections are refused
+// immediately. Udp clients that already have a session keep it while new
+// ones are dropped. If force is set, connections still open after timeout
+// are closed. DrainProxy returns the number of connections that were still
+// open at the timeout.
+func (proxier *Proxier) DrainProxy(service string, timeout time.Duration, force bool) (int, error) {
+	info, found := proxier.getServiceInfo(service)
+	if !found {
+		return 0, fmt.Errorf("unknown service: %s", service)
+	}
+	info.mu.Lock()
+	info.draining = true
+	info.mu.Unlock()
+	// udp sessions reply through the listening socket so it stays open
+	if _, ok := info.socket.(*udpProxySocket); !ok {
+		if err := proxier.stopProxyInternal(info); err != nil {
+			return 0, err
+		}
+	}
+	glog.Infof("Draining service %s for up to %v", service, timeout)
+	endTime := time.Now().Add(timeout)
+	open := info.openConnections()
+	for open != 0 && time.Now().Before(endTime) {
+		time.Sleep(drainInterval)
+		open = info.openConnections()
+	}
+	if open != 0 {
+		glog.Warningf("Service %s still has %d open connections after %v", service, open, timeout)
+		if force {
+			info.closeConns()
+		}
+	}
+	return open, proxier.stopProxyInternal(info)
+}
+
 func (proxier *Proxier) stopProxyInternal(info *serviceInfo) error {
 	if !info.setActive(false) {
 		return nil
@@ -427,7 +631,7 @@ var unusedPortLock sync.Mutex
 func (proxier *Proxier) addServiceOnUnusedPort(service, protocol string, timeout time.Duration) (string, error) {
 	unusedPortLock.Lock()
 	defer unusedPortLock.Unlock()
-	sock, err := newProxySocket(protocol, proxier.address, 0)
+	sock, err := newProxySocket(proxier.ns, protocol, proxier.address, 0)
 	if err != nil {
 		return "", err
 	}
@@ -440,11 +644,12 @@ func (proxier *Proxier) addServiceOnUnusedPort(service, protocol string, timeout
 		return "", err
 	}
 	proxier.setServiceInfo(service, &serviceInfo{
-		port:     portNum,
-		protocol: protocol,
-		active:   true,
-		socket:   sock,
-		timeout:  timeout,
+		port:      portNum,
+		protocol:  protocol,
+		active:    true,
+		socket:    sock,
+		timeout:   timeout,
+		idleSince: time.Now(),
 	})
 	proxier.startAccepting(service, sock)
 	return port, nil
@@ -465,36 +670,30 @@ func (proxier *Proxier) AddService(service, protocol string, port int) (int, err
 	glog.Infof("Adding proxy %s on %s:%d", service, proxier.address, port)
 	if proxier.ns.IsOpen() {
 		glog.Infof("Using namespace %v for proxy %s", proxier.ns, service)
-		runtime.LockOSThread()
-		defer runtime.UnlockOSThread()
-		origns, err := netns.Get()
+	}
+	sock, err := newProxySocket(proxier.ns, protocol, proxier.address, port)
+	if err != nil {
+		return 0, err
+	}
+	portNum := 0
+	// unix sockets have no port
+	if sock.Addr().Network() != "unix" {
+		_, portStr, err := net.SplitHostPort(sock.Addr().String())
 		if err != nil {
 			return 0, err
 		}
-		err = netns.Set(proxier.ns)
+		portNum, err = strconv.Atoi(portStr)
 		if err != nil {
 			return 0, err
 		}
-		defer netns.Set(origns)
-	}
-	sock, err := newProxySocket(protocol, proxier.address, port)
-	if err != nil {
-		return 0, err
-	}
-	_, portStr, err := net.SplitHostPort(sock.Addr().String())
-	if err != nil {
-		return 0, err
-	}
-	portNum, err := strconv.Atoi(portStr)
-	if err != nil {
-		return 0, err
 	}
 	proxier.setServiceInfo(service, &serviceInfo{
-		port:     portNum,
-		protocol: protocol,
-		active:   true,
-		socket:   sock,
-		timeout:  udpIdleTimeout,
+		port:      portNum,
+		protocol:  protocol,
+		active:    true,
+		socket:    sock,
+		timeout:   udpIdleTimeout,
+		idleSince: time.Now(),
 	})
 	proxier.startAccepting(service, sock)
 	return portNum, err
@@ -520,17 +719,18 @@ func (proxier *Proxier) OnUpdate(services []api.Service) {
 			}
 		}
 		glog.Infof("Adding a new service %s on %s port %d", service.ID, service.Protocol, service.Port)
-		sock, err := newProxySocket(service.Protocol, proxier.address, service.Port)
+		sock, err := newProxySocket(proxier.ns, service.Protocol, proxier.address, service.Port)
 		if err != nil {
 			glog.Errorf("Failed to get a socket for %s: %+v", service.ID, err)
 			continue
 		}
 		proxier.setServiceInfo(service.ID, &serviceInfo{
-			port:     service.Port,
-			protocol: service.Protocol,
-			active:   true,
-			socket:   sock,
-			timeout:  udpIdleTimeout,
+			port:      service.Port,
+			protocol:  service.Protocol,
+			active:    true,
+			socket:    sock,
+			timeout:   udpIdleTimeout,
+			idleSince: time.Now(),
 		})
 		proxier.startAccepting(service.ID, sock)
 	}
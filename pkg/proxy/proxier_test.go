@@ -24,10 +24,12 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/vishvananda/netns"
 )
 
 func waitForClosedPortTCP(p *Proxier, proxyPort string) error {
@@ -436,3 +438,203 @@ func TestUDPProxyUpdatePort(t *testing.T) {
 }
 
 // TODO: Test UDP timeouts.
+
+func TestTCPProxyActivity(t *testing.T) {
+	lb := NewLoadBalancerRR()
+	lb.OnUpdate([]api.Endpoints{
+		{
+			JSONBase:  api.JSONBase{ID: "echo"},
+			Endpoints: []string{net.JoinHostPort("127.0.0.1", tcpServerPort)},
+		},
+	})
+
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	waitForActivity(t, p, 1)
+	conn.Close()
+	waitForActivity(t, p, 0)
+	p.StopProxy("echo")
+}
+
+func waitForActivity(t *testing.T, p *Proxier, expected int) {
+	for i := 0; i < 50; i++ {
+		active, _, err := p.Activity("echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d active connections", expected)
+}
+
+// slowLoadBalancer blocks the first call to NextEndpoint until release is
+// closed.
+type slowLoadBalancer struct {
+	endpoint string
+	mu       sync.Mutex
+	calls    int
+	release  chan struct{}
+}
+
+func (lb *slowLoadBalancer) NextEndpoint(service string, srcAddr net.Addr) (netns.NsHandle, string, error) {
+	lb.mu.Lock()
+	lb.calls++
+	first := lb.calls == 1
+	lb.mu.Unlock()
+	if first {
+		<-lb.release
+	}
+	return netns.None(), lb.endpoint, nil
+}
+
+func TestTCPProxySlowEndpoint(t *testing.T) {
+	lb := &slowLoadBalancer{
+		endpoint: net.JoinHostPort("127.0.0.1", tcpServerPort),
+		release:  make(chan struct{}),
+	}
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	slow, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer slow.Close()
+	// the blocked first connection must not hold up the second one
+	testEchoTCP(t, "127.0.0.1", proxyPort)
+	close(lb.release)
+	p.StopProxy("echo")
+}
+
+func TestUDPProxyActivityWhileDialing(t *testing.T) {
+	lb := &slowLoadBalancer{
+		endpoint: net.JoinHostPort("127.0.0.1", udpServerPort),
+		release:  make(chan struct{}),
+	}
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "UDP", time.Second)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("error sending to proxy: %v", err)
+	}
+	// the session is open while its first dial is blocked
+	waitForActivity(t, p, 1)
+	close(lb.release)
+	p.StopProxy("echo")
+}
+
+func TestTCPProxyFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	strategy, _ := NewStrategy("round-robin")
+	lb := NewBalancer(strategy)
+	lb.SetEndpoints([]Endpoint{
+		{Ns: netns.None(), Address: dead},
+		{Ns: netns.None(), Address: net.JoinHostPort("127.0.0.1", tcpServerPort)},
+	})
+	p := NewProxier(lb, "127.0.0.1")
+	p.SetRetryPolicy(RetryPolicy{Attempts: 2, Timeout: 100 * time.Millisecond})
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	// the first connection is mapped to the dead endpoint and fails over
+	testEchoTCP(t, "127.0.0.1", proxyPort)
+	testEchoTCP(t, "127.0.0.1", proxyPort)
+	p.StopProxy("echo")
+}
+
+func TestTCPProxyDrain(t *testing.T) {
+	lb := NewLoadBalancerRR()
+	lb.OnUpdate([]api.Endpoints{
+		{
+			JSONBase:  api.JSONBase{ID: "echo"},
+			Endpoints: []string{net.JoinHostPort("127.0.0.1", tcpServerPort)},
+		},
+	})
+
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	waitForActivity(t, p, 1)
+	go func() {
+		// the open connection finishes while the proxy drains
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+	open, err := p.DrainProxy("echo", 5*time.Second, false)
+	if err != nil || open != 0 {
+		t.Fatalf("Drain left %d connections open: %v", open, err)
+	}
+	if err := waitForClosedPortTCP(p, proxyPort); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestTCPProxyDrainForce(t *testing.T) {
+	lb := NewLoadBalancerRR()
+	lb.OnUpdate([]api.Endpoints{
+		{
+			JSONBase:  api.JSONBase{ID: "echo"},
+			Endpoints: []string{net.JoinHostPort("127.0.0.1", tcpServerPort)},
+		},
+	})
+
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	waitForActivity(t, p, 1)
+	open, err := p.DrainProxy("echo", 50*time.Millisecond, true)
+	if err != nil || open != 1 {
+		t.Fatalf("Expected 1 open connection at the timeout, got %d: %v", open, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [4]byte
+	if _, err := conn.Read(buf[0:]); err == nil {
+		t.Fatal("Connection still open after a forced drain")
+	}
+	waitForActivity(t, p, 0)
+}
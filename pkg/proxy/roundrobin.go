@@ -22,6 +22,7 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	"github.com/golang/glog"
@@ -31,6 +32,7 @@ import (
 var (
 	ErrMissingServiceEntry = errors.New("missing service entry")
 	ErrMissingEndpoints    = errors.New("missing endpoints")
+	ErrNoHealthyEndpoints  = errors.New("no healthy endpoints")
 )
 
 // LoadBalancerRR is a round-robin load balancer.
@@ -38,34 +40,87 @@ type LoadBalancerRR struct {
 	lock         sync.RWMutex
 	endpointsMap map[string][]string
 	rrIndex      map[string]int
+	affinityTTL  time.Duration
+	affinity     map[string]*affinityPolicy
+	healthCheck  *HealthCheck
+	health       map[string]*HealthMonitor
 }
 
 // NewLoadBalancerRR returns a new LoadBalancerRR.
 func NewLoadBalancerRR() *LoadBalancerRR {
+	return NewLoadBalancerRRWithAffinity(0)
+}
+
+// NewLoadBalancerRRWithAffinity returns a new LoadBalancerRR that sends
+// each client ip to the same endpoint until the client has not connected
+// for ttl. A ttl of 0 disables affinity.
+func NewLoadBalancerRRWithAffinity(ttl time.Duration) *LoadBalancerRR {
 	return &LoadBalancerRR{
 		endpointsMap: make(map[string][]string),
 		rrIndex:      make(map[string]int),
+		affinityTTL:  ttl,
+		affinity:     make(map[string]*affinityPolicy),
+		health:       make(map[string]*HealthMonitor),
 	}
 }
 
+// SetHealthCheck makes lb probe the endpoints of each service with check
+// and skip the ones that are unhealthy. It applies to endpoints set by
+// later calls to OnUpdate.
+func (lb *LoadBalancerRR) SetHealthCheck(check *HealthCheck) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	lb.healthCheck = check
+}
+
+// healthy returns false if endpoint of service is known to be unhealthy.
+func (lb *LoadBalancerRR) healthy(service string, endpoint string) bool {
+	monitor := lb.health[service]
+	return monitor == nil || monitor.Healthy(Endpoint{Ns: netns.None(), Address: endpoint})
+}
+
 // NextEndpoint returns a service endpoint.
-// The service endpoint is chosen using the round-robin algorithm.
+// The service endpoint is chosen using the round-robin algorithm unless
+// the client has affinity for an endpoint.
 func (lb *LoadBalancerRR) NextEndpoint(service string, srcAddr net.Addr) (netns.NsHandle, string, error) {
 	ns := netns.None()
-	lb.lock.RLock()
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
 	endpoints, exists := lb.endpointsMap[service]
-	index := lb.rrIndex[service]
-	lb.lock.RUnlock()
 	if !exists {
 		return ns, "", ErrMissingServiceEntry
 	}
 	if len(endpoints) == 0 {
 		return ns, "", ErrMissingEndpoints
 	}
-	endpoint := endpoints[index]
-	lb.lock.Lock()
-	lb.rrIndex[service] = (index + 1) % len(endpoints)
-	lb.lock.Unlock()
+	ip := ""
+	if lb.affinityTTL > 0 {
+		ip = clientIP(srcAddr)
+	}
+	affinity := lb.affinity[service]
+	if ip != "" {
+		if affinity == nil {
+			affinity = newAffinityPolicy(lb.affinityTTL)
+			lb.affinity[service] = affinity
+		}
+		if endpoint, ok := affinity.lookup(ip); ok && lb.healthy(service, endpoint) {
+			return ns, endpoint, nil
+		}
+	}
+	endpoint := ""
+	for i := 0; i < len(endpoints) && endpoint == ""; i++ {
+		index := lb.rrIndex[service]
+		lb.rrIndex[service] = (index + 1) % len(endpoints)
+		if lb.healthy(service, endpoints[index]) {
+			endpoint = endpoints[index]
+		}
+	}
+	if endpoint == "" {
+		return ns, "", ErrNoHealthyEndpoints
+	}
+	if ip != "" {
+		affinity.record(ip, endpoint)
+	}
 	return ns, endpoint, nil
 }
 
@@ -107,6 +162,11 @@ func (lb *LoadBalancerRR) OnUpdate(endpoints []api.Endpoints) {
 			lb.endpointsMap[endpoint.ID] = validEndpoints
 			// Reset the round-robin index.
 			lb.rrIndex[endpoint.ID] = 0
+			// Clients of removed endpoints lose their affinity.
+			if affinity := lb.affinity[endpoint.ID]; affinity != nil {
+				affinity.retain(func(e string) bool { return contains(validEndpoints, e) })
+			}
+			lb.updateHealth(endpoint.ID, validEndpoints)
 		}
 		registeredEndpoints[endpoint.ID] = true
 	}
@@ -115,6 +175,36 @@ func (lb *LoadBalancerRR) OnUpdate(endpoints []api.Endpoints) {
 		if _, exists := registeredEndpoints[k]; !exists {
 			glog.Infof("LoadBalancerRR: Removing endpoints for %s -> %+v", k, v)
 			delete(lb.endpointsMap, k)
+			delete(lb.affinity, k)
+			if monitor := lb.health[k]; monitor != nil {
+				monitor.Stop()
+				delete(lb.health, k)
+			}
+		}
+	}
+}
+
+func (lb *LoadBalancerRR) updateHealth(service string, endpoints []string) {
+	if lb.healthCheck == nil {
+		return
+	}
+	monitor := lb.health[service]
+	if monitor == nil {
+		monitor = NewHealthMonitor(lb.healthCheck)
+		lb.health[service] = monitor
+	}
+	monitored := make([]Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		monitored = append(monitored, Endpoint{Ns: netns.None(), Address: e})
+	}
+	monitor.SetEndpoints(monitored)
+}
+
+func contains(endpoints []string, endpoint string) bool {
+	for _, e := range endpoints {
+		if e == endpoint {
+			return true
 		}
 	}
+	return false
 }
@@ -17,7 +17,10 @@ limitations under the License.
 package proxy
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 )
@@ -192,3 +195,95 @@ func TestLoadBalanceWorksWithServiceRemoval(t *testing.T) {
 	expectEndpoint(t, loadBalancer, "bar", "endpoint:5")
 	expectEndpoint(t, loadBalancer, "bar", "endpoint:4")
 }
+
+func expectEndpointFrom(t *testing.T, loadBalancer LoadBalancer, service string, ip string, expected string) {
+	src := &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	_, endpoint, err := loadBalancer.NextEndpoint(service, src)
+	if err != nil {
+		t.Errorf("Didn't find a service for %s from %s, expected %s, failed with: %v", service, ip, expected, err)
+	}
+	if endpoint != expected {
+		t.Errorf("Didn't get expected endpoint for service %s from %s, expected %s, got: %s", service, ip, expected, endpoint)
+	}
+}
+
+func TestLoadBalanceWorksWithAffinity(t *testing.T) {
+	loadBalancer := NewLoadBalancerRRWithAffinity(time.Minute)
+	endpoints := make([]api.Endpoints, 1)
+	endpoints[0] = api.Endpoints{
+		JSONBase:  api.JSONBase{ID: "foo"},
+		Endpoints: []string{"endpoint:1", "endpoint:2", "endpoint:3"},
+	}
+	loadBalancer.OnUpdate(endpoints)
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.1", "endpoint:1")
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.2", "endpoint:2")
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.1", "endpoint:1")
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.2", "endpoint:2")
+	// Clients without an address are still balanced
+	expectEndpoint(t, loadBalancer, "foo", "endpoint:3")
+	// Removing an endpoint only moves its clients
+	endpoints[0] = api.Endpoints{JSONBase: api.JSONBase{ID: "foo"},
+		Endpoints: []string{"endpoint:2", "endpoint:3"},
+	}
+	loadBalancer.OnUpdate(endpoints)
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.2", "endpoint:2")
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.1", "endpoint:2")
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.1", "endpoint:2")
+}
+
+func TestLoadBalanceAffinityExpires(t *testing.T) {
+	loadBalancer := NewLoadBalancerRRWithAffinity(10 * time.Millisecond)
+	endpoints := make([]api.Endpoints, 1)
+	endpoints[0] = api.Endpoints{
+		JSONBase:  api.JSONBase{ID: "foo"},
+		Endpoints: []string{"endpoint:1", "endpoint:2"},
+	}
+	loadBalancer.OnUpdate(endpoints)
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.1", "endpoint:1")
+	time.Sleep(20 * time.Millisecond)
+	expectEndpointFrom(t, loadBalancer, "foo", "10.0.0.1", "endpoint:2")
+}
+
+func TestLoadBalanceHashKeepsClients(t *testing.T) {
+	loadBalancer := NewLoadBalancerHash()
+	_, endpoint, err := loadBalancer.NextEndpoint("foo", nil)
+	if err == nil || len(endpoint) != 0 {
+		t.Errorf("Didn't fail with non-existent service")
+	}
+	endpoints := make([]api.Endpoints, 1)
+	endpoints[0] = api.Endpoints{
+		JSONBase:  api.JSONBase{ID: "foo"},
+		Endpoints: []string{"endpoint:1", "endpoint:2", "endpoint:3", "endpoint:4"},
+	}
+	loadBalancer.OnUpdate(endpoints)
+	before := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/250, i%250)
+		_, endpoint, err := loadBalancer.NextEndpoint("foo", &net.TCPAddr{IP: net.ParseIP(ip)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[ip] = endpoint
+		used[endpoint] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("Clients not spread over endpoints: %v", used)
+	}
+	// Adding an endpoint only moves clients to the new endpoint
+	endpoints[0].Endpoints = append(endpoints[0].Endpoints, "endpoint:5")
+	loadBalancer.OnUpdate(endpoints)
+	moved := 0
+	for ip, old := range before {
+		_, endpoint, _ := loadBalancer.NextEndpoint("foo", &net.TCPAddr{IP: net.ParseIP(ip)})
+		if endpoint != old {
+			if endpoint != "endpoint:5" {
+				t.Errorf("Client %s moved from %s to %s", ip, old, endpoint)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 80 {
+		t.Errorf("Unexpected number of clients moved: %d", moved)
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"syscall"
+)
+
+// Flags for splice(2) that are missing from the syscall package.
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+)
+
+// Most bytes moved by one splice. This is the default capacity of a pipe.
+const maxSpliceSize = 64 * 1024
+
+// splice moves data from src to dst through a pipe without copying it
+// into user space. It returns false without moving anything if either
+// connection is not a tcp or unix stream socket. If count is not nil it is
+// passed the number of bytes moved to dst after each splice.
+func splice(dst, src net.Conn, count func(int64)) (int64, bool, error) {
+	srcRaw, ok := streamRawConn(src)
+	if !ok {
+		return 0, false, nil
+	}
+	dstRaw, ok := streamRawConn(dst)
+	if !ok {
+		return 0, false, nil
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	var written int64
+	for {
+		n, err := spliceIn(srcRaw, p[1])
+		if err != nil || n == 0 {
+			return written, true, err
+		}
+		m, err := spliceOut(dstRaw, p[0], n)
+		written += m
+		if count != nil {
+			count(m)
+		}
+		if err != nil {
+			return written, true, err
+		}
+	}
+}
+
+func streamRawConn(c net.Conn) (syscall.RawConn, bool) {
+	var raw syscall.RawConn
+	var err error
+	switch c := c.(type) {
+	case *net.TCPConn:
+		raw, err = c.SyscallConn()
+	case *net.UnixConn:
+		if c.LocalAddr().Network() != "unix" {
+			return nil, false
+		}
+		raw, err = c.SyscallConn()
+	default:
+		return nil, false
+	}
+	return raw, err == nil
+}
+
+// spliceIn waits for src to be readable and moves what it can into the
+// pipe. It returns 0 at EOF.
+func spliceIn(src syscall.RawConn, pipe int) (int64, error) {
+	var n int64
+	var serr error
+	err := src.Read(func(fd uintptr) bool {
+		for {
+			n, serr = syscall.Splice(int(fd), nil, pipe, nil, maxSpliceSize, spliceMove|spliceNonblock)
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, serr
+}
+
+// spliceOut moves n bytes from the pipe to dst, waiting for dst to be
+// writable as needed.
+func spliceOut(dst syscall.RawConn, pipe int, n int64) (int64, error) {
+	var written int64
+	var serr error
+	err := dst.Write(func(fd uintptr) bool {
+		for written < n {
+			m, err := syscall.Splice(pipe, nil, int(fd), nil, int(n-written), spliceMove|spliceNonblock)
+			switch {
+			case err == syscall.EINTR:
+				continue
+			case err == syscall.EAGAIN:
+				return false
+			case err != nil:
+				serr = err
+				return true
+			case m == 0:
+				serr = io.ErrShortWrite
+				return true
+			}
+			written += m
+		}
+		return true
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"net"
+)
+
+// splice is only implemented on linux.
+func splice(dst, src net.Conn, count func(int64)) (int64, bool, error) {
+	return 0, false, nil
+}
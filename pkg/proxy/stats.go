@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats counts the connections and traffic of a service or of one of its
+// endpoints. Udp client sessions count as connections.
+type Stats struct {
+	// Accepted is the number of connections from clients.
+	Accepted uint64
+	// Active is the number of connections that are open.
+	Active int64
+	// Failed is the number of connections that could not reach an
+	// endpoint. For endpoints it is the number of failed dials.
+	Failed uint64
+	// BytesIn is the number of bytes sent from clients to endpoints.
+	BytesIn uint64
+	// BytesOut is the number of bytes sent from endpoints to clients.
+	BytesOut uint64
+	// Dials is the number of successful dials to endpoints.
+	Dials uint64
+	// DialTime is the total time spent on successful dials.
+	DialTime time.Duration
+	// MaxDialTime is the longest successful dial.
+	MaxDialTime time.Duration
+}
+
+// EndpointStats are the Stats of one endpoint of a service.
+type EndpointStats struct {
+	Endpoint
+	Stats
+}
+
+type statsRecorder struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (r *statsRecorder) snapshot() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+func (r *statsRecorder) accepted() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Accepted++
+}
+
+func (r *statsRecorder) failed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Failed++
+}
+
+func (r *statsRecorder) dialed(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Dials++
+	r.stats.DialTime += d
+	if d > r.stats.MaxDialTime {
+		r.stats.MaxDialTime = d
+	}
+}
+
+func (r *statsRecorder) opened() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Active++
+}
+
+func (r *statsRecorder) closed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Active--
+}
+
+func (r *statsRecorder) addIn(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.BytesIn += uint64(n)
+}
+
+func (r *statsRecorder) addOut(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.BytesOut += uint64(n)
+}
+
+type endpointRecorder struct {
+	endpoint Endpoint
+	statsRecorder
+}
+
+// connStats are the recorders that the traffic of a connection to an
+// endpoint is added to.
+type connStats []*statsRecorder
+
+func (c connStats) addIn(n int64) {
+	for _, r := range c {
+		r.addIn(n)
+	}
+}
+
+func (c connStats) addOut(n int64) {
+	for _, r := range c {
+		r.addOut(n)
+	}
+}
+
+// countingConn counts the traffic of a udp session. Writes go to the
+// endpoint and reads come from it.
+type countingConn struct {
+	net.Conn
+	stats connStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.addOut(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.addIn(int64(n))
+	return n, err
+}
+
+// endpointStats returns the recorder for e, creating it if needed.
+func (si *serviceInfo) endpointStats(e Endpoint) *endpointRecorder {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.endpoints == nil {
+		si.endpoints = make(map[string]*endpointRecorder)
+	}
+	r, exists := si.endpoints[e.key()]
+	if !exists {
+		r = &endpointRecorder{endpoint: e}
+		si.endpoints[e.key()] = r
+	}
+	return r
+}
+
+// Stats returns the counters of the named service and of each endpoint it
+// has dialed.
+func (proxier *Proxier) Stats(service string) (Stats, []EndpointStats, error) {
+	info, found := proxier.getServiceInfo(service)
+	if !found {
+		return Stats{}, nil, fmt.Errorf("unknown service: %s", service)
+	}
+	stats := info.stats.snapshot()
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	stats.Active = int64(info.connections)
+	endpoints := make([]EndpointStats, 0, len(info.endpoints))
+	for _, r := range info.endpoints {
+		endpoints = append(endpoints, EndpointStats{r.endpoint, r.snapshot()})
+	}
+	sort.Sort(byAddress(endpoints))
+	return stats, endpoints, nil
+}
+
+type byAddress []EndpointStats
+
+func (a byAddress) Len() int           { return len(a) }
+func (a byAddress) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAddress) Less(i, j int) bool { return a[i].Address < a[j].Address }
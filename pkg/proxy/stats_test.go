@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/vishvananda/netns"
+)
+
+func TestTCPProxyStats(t *testing.T) {
+	lb := NewLoadBalancerRR()
+	lb.OnUpdate([]api.Endpoints{
+		{
+			JSONBase:  api.JSONBase{ID: "echo"},
+			Endpoints: []string{net.JoinHostPort("127.0.0.1", tcpServerPort)},
+		},
+	})
+
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	defer p.StopProxy("echo")
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	// http/1.0 closes the connection after the response
+	_, err = conn.Write([]byte("GET /aaaaa HTTP/1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForActivity(t, p, 0)
+
+	stats, endpoints, err := p.Stats("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Accepted != 1 || stats.Active != 0 || stats.Dials != 1 || stats.Failed != 0 {
+		t.Fatalf("Unexpected service stats: %+v", stats)
+	}
+	if stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Fatalf("Traffic not counted: %+v", stats)
+	}
+	if len(endpoints) != 1 || endpoints[0].BytesIn != stats.BytesIn || endpoints[0].Active != 0 {
+		t.Fatalf("Unexpected endpoint stats: %+v", endpoints)
+	}
+	if stats.DialTime <= 0 || stats.MaxDialTime > stats.DialTime {
+		t.Fatalf("Unexpected dial time: %+v", stats)
+	}
+}
+
+func TestUDPProxyStats(t *testing.T) {
+	lb := NewLoadBalancerRR()
+	lb.OnUpdate([]api.Endpoints{
+		{
+			JSONBase:  api.JSONBase{ID: "echo"},
+			Endpoints: []string{net.JoinHostPort("127.0.0.1", udpServerPort)},
+		},
+	})
+
+	p := NewProxier(lb, "127.0.0.1")
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "UDP", time.Second)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	defer p.StopProxy("echo")
+	testEchoUDP(t, "127.0.0.1", proxyPort)
+
+	stats, endpoints, err := p.Stats("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testEchoUDP sends and receives 6 bytes
+	if stats.Accepted != 1 || stats.BytesIn != 6 || stats.BytesOut != 6 {
+		t.Fatalf("Unexpected service stats: %+v", stats)
+	}
+	if len(endpoints) != 1 || endpoints[0].Active != 1 {
+		t.Fatalf("Unexpected endpoint stats: %+v", endpoints)
+	}
+}
+
+func TestProxyStatsFailed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	strategy, _ := NewStrategy("round-robin")
+	lb := NewBalancer(strategy)
+	lb.SetEndpoints([]Endpoint{{Ns: netns.None(), Address: dead}})
+	p := NewProxier(lb, "127.0.0.1")
+	p.SetRetryPolicy(RetryPolicy{Attempts: 1, Timeout: 10 * time.Millisecond})
+
+	proxyPort, err := p.addServiceOnUnusedPort("echo", "TCP", 0)
+	if err != nil {
+		t.Fatalf("error adding new service: %#v", err)
+	}
+	defer p.StopProxy("echo")
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", proxyPort))
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	waitForActivity(t, p, 1)
+	waitForActivity(t, p, 0)
+	stats, endpoints, err := p.Stats("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed != 1 || stats.Dials != 0 || len(endpoints) != 1 || endpoints[0].Failed != 1 {
+		t.Fatalf("Failure not counted: %+v %+v", stats, endpoints)
+	}
+}
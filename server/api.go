@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/rpc"
+	"sync"
 )
 
 type Api int
@@ -20,7 +21,7 @@ func (t *Api) Echo(args *client.EchoArgs, reply *client.EchoReply) (err error) {
 }
 
 func (t *Api) CreateTunnel(args *client.CreateTunnelArgs, reply *client.CreateTunnelReply) (err error) {
-	reply.Src, reply.Dst, err = createTunnel(args.Host, args.Udp)
+	reply.Src, reply.Dst, err = createTunnel(args.Host, args.Udp, args.Driver)
 	return err
 }
 
@@ -29,26 +30,60 @@ func (t *Api) DeleteTunnel(args *client.DeleteTunnelArgs, reply *client.DeleteTu
 	return err
 }
 
+func (t *Api) ListTunnels(args *client.ListTunnelsArgs, reply *client.ListTunnelsReply) (err error) {
+	reply.Tunnels = listTunnels(args.Keys)
+	return nil
+}
+
 func (t *Api) CreateSegment(args *client.CreateSegmentArgs, reply *client.CreateSegmentReply) (err error) {
 	reply.Url, err = createSegment(args.Id, args.Init, args.Trig)
 	return err
 }
 
 func (t *Api) DeleteSegment(args *client.DeleteSegmentArgs, reply *client.DeleteSegmentReply) (err error) {
-	err = deleteSegment(args.Id)
+	err = deleteSegment(args.Id, args.Drain, args.Force)
 	return err
 }
 
+func (t *Api) ListSegments(args *client.ListSegmentsArgs, reply *client.ListSegmentsReply) (err error) {
+	reply.Segments = listSegments()
+	return nil
+}
+
+func (t *Api) GetSegment(args *client.GetSegmentArgs, reply *client.GetSegmentReply) (err error) {
+	var info *client.SegmentInfo
+	info, err = getSegmentInfo(args.Id)
+	if err != nil {
+		return err
+	}
+	reply.Segment = *info
+	return nil
+}
+
+func (t *Api) GetSegmentStats(args *client.GetSegmentStatsArgs, reply *client.GetSegmentStatsReply) (err error) {
+	var stats *client.SegmentStats
+	stats, err = getSegmentStats(args.Id)
+	if err != nil {
+		return err
+	}
+	reply.Stats = *stats
+	return nil
+}
+
 func (t *Api) GetSrcIP(args *client.GetSrcIPArgs, reply *client.GetSrcIPReply) (err error) {
 	reply.Src, err = getSrcIP(args.Dst)
 	return err
 }
 
 func (t *Api) BuildTunnel(args *client.BuildTunnelArgs, reply *client.BuildTunnelReply) (err error) {
-	reply.Src, reply.Tunnel, err = buildTunnel(args.Dst, args.Tunnel)
+	reply.Src, reply.Tunnel, err = buildTunnel(args.Dst, args.Tunnel, args.Ciphers)
 	return err
 }
 
+func (t *Api) RekeyTunnel(args *client.RekeyTunnelArgs, reply *client.RekeyTunnelReply) (err error) {
+	return installRekey(args.Dst, args.Tunnel)
+}
+
 func (t *Api) DestroyTunnel(args *client.DestroyTunnelArgs, reply *client.DestroyTunnelReply) (err error) {
 	reply.Src, err = destroyTunnel(args.Dst)
 	return err
@@ -89,27 +124,51 @@ func handle(conn net.Conn) {
 	rpc.ServeCodec(srv)
 }
 
-var listener net.Listener
+// listen creates a listener for host. Unix sockets are authorized by peer
+// credentials instead of tls.
+func listen(host string) (net.Listener, error) {
+	proto, address := utils.ParseAddr(host)
+	if proto == "unix" {
+		return listenUnix(address, opts.group)
+	}
+	return tls.Listen(proto, address, opts.config)
+}
+
+var listenersMutex sync.Mutex
+var apiListeners []net.Listener
 
 func serveAPI() {
 	rpc.Register(new(Api))
-	proto, address := utils.ParseAddr(opts.hosts[0])
-	var err error
-	listener, err = tls.Listen(proto, address, opts.config)
-	if err != nil {
-		log.Fatalf("Listen: %v", err)
-	}
-	defer listener.Close()
-	for {
-		conn, err := listener.Accept()
+	var wg sync.WaitGroup
+	for _, host := range opts.hosts {
+		l, err := listen(host)
 		if err != nil {
-			log.Fatalf("Accept: %v", err)
-			return
+			log.Fatalf("Listen: %v", err)
 		}
-		go handle(conn)
+		listenersMutex.Lock()
+		apiListeners = append(apiListeners, l)
+		listenersMutex.Unlock()
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			defer l.Close()
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					log.Fatalf("Accept: %v", err)
+					return
+				}
+				go handle(conn)
+			}
+		}(l)
 	}
+	wg.Wait()
 }
 
 func shutdownAPI() {
-	listener.Close()
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	for _, l := range apiListeners {
+		l.Close()
+	}
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/wormhole/client"
+)
+
+const (
+	// aeadSaltLen is the length of the salt that follows the key of the
+	// aead ciphers
+	aeadSaltLen = 4
+	// aeadICVLen is the length in bits of the aead integrity check value
+	aeadICVLen = 128
+)
+
+// parseCiphers parses a comma separated list of ciphers.
+func parseCiphers(list string) ([]string, error) {
+	ciphers := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !supportsCipher(client.Ciphers, name) {
+			return nil, fmt.Errorf("Unknown cipher %s", name)
+		}
+		ciphers = append(ciphers, name)
+	}
+	return ciphers, nil
+}
+
+func supportsCipher(ciphers []string, cipher string) bool {
+	for _, c := range ciphers {
+		if c == cipher {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseCipher returns the first of local that is also in remote. Peers
+// that do not send their ciphers only support client.CipherAesCbc.
+func chooseCipher(local []string, remote []string) (string, error) {
+	if len(remote) == 0 {
+		remote = []string{client.CipherAesCbc}
+	}
+	for _, cipher := range local {
+		if supportsCipher(remote, cipher) {
+			return cipher, nil
+		}
+	}
+	return "", fmt.Errorf("No common cipher in %v", remote)
+}
+
+// isAead returns true if cipher is an aead cipher.
+func isAead(cipher string) bool {
+	return cipher == client.CipherAesGcm || cipher == client.CipherChaCha20Poly1305
+}
+
+// setCipher sets the cipher of tunnel and converts the keys it was created
+// with. Aead ciphers take their salt from the unused AuthKey.
+func setCipher(tunnel *client.Tunnel, cipher string) error {
+	tunnel.Cipher = cipher
+	if !isAead(cipher) {
+		return nil
+	}
+	if len(tunnel.AuthKey) < aeadSaltLen {
+		return fmt.Errorf("Tunnel key is too short for %s", cipher)
+	}
+	key := make([]byte, 0, len(tunnel.EncKey)+aeadSaltLen)
+	key = append(key, tunnel.EncKey...)
+	tunnel.EncKey = append(key, tunnel.AuthKey[:aeadSaltLen]...)
+	tunnel.AuthKey = nil
+	return nil
+}
+
+// setStateAlgos fills in the algorithms of state for cipher.
+func setStateAlgos(state *netlink.XfrmState, cipher string, authKey []byte, encKey []byte) {
+	if isAead(cipher) {
+		state.Aead = &netlink.XfrmStateAlgo{
+			Name:   cipher,
+			Key:    encKey,
+			ICVLen: aeadICVLen,
+		}
+		return
+	}
+	state.Auth = &netlink.XfrmStateAlgo{
+		Name: "hmac(sha256)",
+		Key:  authKey,
+	}
+	state.Crypt = &netlink.XfrmStateAlgo{
+		Name: "cbc(aes)",
+		Key:  encKey,
+	}
+}
+
+// stateCipher returns the cipher and keys of an existing state.
+func stateCipher(state *netlink.XfrmState) (string, []byte, []byte, error) {
+	if state.Aead != nil {
+		if !isAead(state.Aead.Name) {
+			return "", nil, nil, fmt.Errorf("Tunnel state uses unknown aead %s", state.Aead.Name)
+		}
+		return state.Aead.Name, nil, state.Aead.Key, nil
+	}
+	if state.Auth == nil {
+		return "", nil, nil, fmt.Errorf("Tunnel state has no associated authentication entry")
+	}
+	if state.Crypt == nil {
+		return "", nil, nil, fmt.Errorf("Tunnel state has no associated encryption entry")
+	}
+	return client.CipherAesCbc, state.Auth.Key, state.Crypt.Key, nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestChooseCipher(t *testing.T) {
+	cipher, err := chooseCipher(client.Ciphers, []string{client.CipherAesCbc, client.CipherChaCha20Poly1305})
+	if err != nil || cipher != client.CipherChaCha20Poly1305 {
+		t.Fatalf("Expected chacha20: %v %v", cipher, err)
+	}
+	cipher, err = chooseCipher(client.Ciphers, nil)
+	if err != nil || cipher != client.CipherAesCbc {
+		t.Fatalf("Expected cbc for peers without ciphers: %v %v", cipher, err)
+	}
+	_, err = chooseCipher([]string{client.CipherAesGcm}, []string{client.CipherAesCbc})
+	if err == nil {
+		t.Fatalf("Expected error without a common cipher")
+	}
+}
+
+func TestParseCiphers(t *testing.T) {
+	ciphers, err := parseCiphers(client.CipherAesCbc + ", " + client.CipherAesGcm)
+	if err != nil || len(ciphers) != 2 || ciphers[1] != client.CipherAesGcm {
+		t.Fatalf("Unexpected ciphers: %v %v", ciphers, err)
+	}
+	_, err = parseCiphers("cbc(des)")
+	if err == nil {
+		t.Fatalf("Expected error for unknown cipher")
+	}
+}
+
+func TestAeadStates(t *testing.T) {
+	tunnel := &client.Tunnel{Reqid: 7, AuthKey: bytes.Repeat([]byte{1}, 32), EncKey: bytes.Repeat([]byte{2}, 32)}
+	err := setCipher(tunnel, client.CipherAesGcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.AuthKey != nil || len(tunnel.EncKey) != 36 || tunnel.EncKey[35] != 1 {
+		t.Fatalf("Unexpected aead keys: %+v", tunnel)
+	}
+	states := getStates(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), tunnel)
+	for _, state := range states {
+		if state.Auth != nil || state.Crypt != nil || state.Aead == nil || state.Aead.ICVLen != aeadICVLen {
+			t.Fatalf("Unexpected aead state: %v", state)
+		}
+		cipher, authKey, encKey, err := stateCipher(&state)
+		if err != nil || cipher != client.CipherAesGcm || authKey != nil || !bytes.Equal(encKey, tunnel.EncKey) {
+			t.Fatalf("Aead state was not recognized: %v %v", cipher, err)
+		}
+	}
+
+	state := netlink.XfrmState{}
+	setStateAlgos(&state, "", []byte{1}, []byte{2})
+	cipher, _, _, err := stateCipher(&state)
+	if err != nil || cipher != client.CipherAesCbc || state.Crypt.Name != "cbc(aes)" {
+		t.Fatalf("Cbc state was not recognized: %v %v", cipher, err)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/wormhole/client"
+)
+
+// tunnelDriver programs one kind of tunnel. The tunnels passed to offer
+// and accept are in the view of the end that builds them remotely, so Src
+// is the overlay ip of the peer that called BuildTunnel.
+type tunnelDriver interface {
+	// offer fills in the keys of a new tunnel before it is sent to the
+	// peer. A private key is left in PrivateKey, which is never sent.
+	offer(tunnel *client.Tunnel) error
+	// accept completes a tunnel offered by a peer that supports ciphers.
+	accept(tunnel *client.Tunnel, ciphers []string) error
+	// build programs the local end of tunnel to the peer with external ip
+	// dst. It may be called again for a tunnel that is partially built.
+	build(dst net.IP, tunnel *client.Tunnel) error
+	// destroy removes what build programmed. Errors are only logged.
+	destroy(dst net.IP, tunnel *client.Tunnel)
+}
+
+var drivers = map[string]tunnelDriver{
+	client.DriverXfrm:      xfrmDriver{},
+	client.DriverWireguard: wireguardDriver{},
+}
+
+// getDriver returns the driver called name. An empty name is DriverXfrm.
+func getDriver(name string) (tunnelDriver, error) {
+	if name == "" {
+		name = client.DriverXfrm
+	}
+	driver, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tunnel driver %s", name)
+	}
+	return driver, nil
+}
+
+// xfrmDriver builds ipsec tunnels out of xfrm policies and states.
+type xfrmDriver struct{}
+
+func (xfrmDriver) offer(tunnel *client.Tunnel) error {
+	tunnel.AuthKey = randomKey()
+	tunnel.EncKey = randomKey()
+	return nil
+}
+
+func (xfrmDriver) accept(tunnel *client.Tunnel, ciphers []string) error {
+	if tunnel.Cipher != "" {
+		if !supportsCipher(opts.ciphers, tunnel.Cipher) {
+			return fmt.Errorf("Cipher %s is not supported", tunnel.Cipher)
+		}
+		return nil
+	}
+	cipher, err := chooseCipher(opts.ciphers, ciphers)
+	if err != nil {
+		glog.Errorf("Failed to choose cipher: %v", err)
+		return err
+	}
+	err = setCipher(tunnel, cipher)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Using %s for tunnel cipher", cipher)
+	return nil
+}
+
+func (xfrmDriver) build(dst net.IP, tunnel *client.Tunnel) error {
+	if tunnel.SrcPort != 0 && getListener(dst.String()) == 0 {
+		socket, err := createEncapListener(opts.src, tunnel.SrcPort)
+		if err != nil {
+			glog.Errorf("Failed to create udp listener: %v", err)
+			return err
+		}
+		setListener(dst.String(), socket)
+	}
+
+	src := opts.src
+
+	srcNet := netlink.NewIPNet(tunnel.Src)
+	dstNet := netlink.NewIPNet(tunnel.Dst)
+
+	// add IP address to loopback device
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		glog.Errorf("Failed to get loopback device: %v", err)
+		return err
+	}
+	err = netlink.AddrAdd(lo, &netlink.Addr{IPNet: srcNet})
+	if err != nil && err != syscall.EEXIST {
+		glog.Errorf("Failed to add %v to loopback: %v", tunnel.Src, err)
+		return err
+	}
+
+	index, err := getLinkIndex(src)
+	if err != nil {
+		glog.Errorf("Failed to get link for address: %v", err)
+		return err
+	}
+	// add source route to tunnel ips device
+	route := &netlink.Route{
+		Scope:     netlink.SCOPE_LINK,
+		Src:       tunnel.Src,
+		Dst:       dstNet,
+		LinkIndex: index,
+	}
+	err = netlink.RouteAdd(route)
+	if err != nil && err != syscall.EEXIST {
+		glog.Errorf("Failed to add route %v: %v", route, err)
+		return err
+	}
+
+	for _, policy := range getPolicies(tunnel.Reqid, src, dst, srcNet, dstNet) {
+		glog.Infof("building Policy: %v", policy)
+		// create xfrm policy rules
+		err = netlink.XfrmPolicyAdd(&policy)
+		if err != nil {
+			if err == syscall.EEXIST {
+				glog.Infof("Skipped adding policy %v because it already exists", policy)
+			} else {
+				glog.Errorf("Failed to add policy %v: %v", policy, err)
+				return err
+			}
+		}
+	}
+	for _, state := range getStates(src, dst, tunnel) {
+		glog.Infof("building State: %v", state)
+		// crate xfrm state rules
+		err = netlink.XfrmStateAdd(&state)
+		if err != nil {
+			if err == syscall.EEXIST {
+				glog.Infof("Skipped adding state %v because it already exists", state)
+			} else {
+				glog.Errorf("Failed to add state %v: %v", state, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (xfrmDriver) destroy(dst net.IP, tunnel *client.Tunnel) {
+	src := opts.src
+
+	srcNet := netlink.NewIPNet(tunnel.Src)
+	dstNet := netlink.NewIPNet(tunnel.Dst)
+
+	for _, state := range getStates(src, dst, tunnel) {
+		// crate xfrm state rules
+		err := netlink.XfrmStateDel(&state)
+		if err != nil {
+			glog.Errorf("Failed to delete state %v: %v", state, err)
+		}
+	}
+
+	for _, policy := range getPolicies(tunnel.Reqid, src, dst, srcNet, dstNet) {
+		// create xfrm policy rules
+		err := netlink.XfrmPolicyDel(&policy)
+		if err != nil {
+			glog.Errorf("Failed to delete policy %v: %v", policy, err)
+		}
+	}
+
+	index, err := getLinkIndex(src)
+	if err != nil {
+		glog.Errorf("Failed to get link for address: %v", err)
+	} else {
+
+		// del source route to tunnel ips device
+		route := &netlink.Route{
+			Scope:     netlink.SCOPE_LINK,
+			Src:       tunnel.Src,
+			Dst:       dstNet,
+			LinkIndex: index,
+		}
+		err = netlink.RouteDel(route)
+		if err != nil {
+			glog.Errorf("Failed to delete route %v: %v", route, err)
+		}
+	}
+
+	// del IP address to loopback device
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		glog.Errorf("Failed to get loopback device: %v", err)
+	} else {
+		err = netlink.AddrDel(lo, &netlink.Addr{IPNet: srcNet})
+		if err != nil {
+			glog.Errorf("Failed to delete %v from loopback: %v", tunnel.Src, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/utils"
+)
+
+// The http api exposes the same operations as Api using json bodies:
+//
+//   POST   /echo            EchoArgs -> EchoReply
+//   GET    /segments        -> []SegmentInfo
+//   POST   /segments        CreateSegmentArgs -> CreateSegmentReply
+//   GET    /segments/ID     -> SegmentInfo
+//   DELETE /segments/ID?drain=DURATION&force=true
+//   GET    /segments/ID/stats -> SegmentStats
+//   GET    /tunnels?keys=true -> []TunnelInfo
+//   POST   /tunnels         CreateTunnelArgs -> CreateTunnelReply
+//   DELETE /tunnels?host=HOST
+//   GET    /srcip?dst=IP    -> GetSrcIPReply
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		glog.Errorf("Failed to write http response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, httpError{err.Error()})
+}
+
+// Errors from the api and from peers only keep their message, so the
+// status for errors caused by the request is chosen by matching it.
+var errorStatuses = []struct {
+	text   string
+	status int
+}{
+	{"already exists", http.StatusConflict},
+	{"is in use", http.StatusConflict},
+	{"does not exist", http.StatusNotFound},
+	{"not found", http.StatusNotFound},
+	{"Failed to find", http.StatusNotFound},
+	{"not recognized", http.StatusBadRequest},
+	{"not supported", http.StatusBadRequest},
+	{"Unknown tunnel driver", http.StatusBadRequest},
+	{"is required", http.StatusBadRequest},
+	{"Cannot proxy", http.StatusBadRequest},
+}
+
+// errorStatus returns the http status for an error returned by the api.
+func errorStatus(err error) int {
+	for _, e := range errorStatuses {
+		if strings.Contains(err.Error(), e.text) {
+			return e.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+func writeReply(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJson(w, http.StatusOK, v)
+}
+
+func readArgs(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+func newHTTPHandler() http.Handler {
+	api := new(Api)
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		args := client.EchoArgs{}
+		if !readArgs(w, r, &args) {
+			return
+		}
+		reply := client.EchoReply{}
+		err := api.Echo(&args, &reply)
+		writeReply(w, &reply, err)
+	})
+
+	mux.HandleFunc("/segments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			reply := client.ListSegmentsReply{}
+			err := api.ListSegments(&client.ListSegmentsArgs{}, &reply)
+			writeReply(w, reply.Segments, err)
+		case "POST":
+			args := client.CreateSegmentArgs{}
+			if !readArgs(w, r, &args) {
+				return
+			}
+			if args.Id == "" {
+				args.Id = utils.Uuid()
+			}
+			reply := client.CreateSegmentReply{}
+			err := api.CreateSegment(&args, &reply)
+			writeReply(w, &reply, err)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	})
+
+	mux.HandleFunc("/segments/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/segments/")
+		if strings.HasSuffix(id, "/stats") {
+			if r.Method != "GET" {
+				methodNotAllowed(w, "GET")
+				return
+			}
+			reply := client.GetSegmentStatsReply{}
+			err := api.GetSegmentStats(&client.GetSegmentStatsArgs{Id: strings.TrimSuffix(id, "/stats")}, &reply)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			writeReply(w, &reply.Stats, nil)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			reply := client.GetSegmentReply{}
+			err := api.GetSegment(&client.GetSegmentArgs{Id: id}, &reply)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			writeReply(w, &reply.Segment, nil)
+		case "DELETE":
+			args := client.DeleteSegmentArgs{Id: id, Force: r.URL.Query().Get("force") == "true"}
+			if drain := r.URL.Query().Get("drain"); drain != "" {
+				var err error
+				args.Drain, err = time.ParseDuration(drain)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			err := api.DeleteSegment(&args, &client.DeleteSegmentReply{})
+			writeReply(w, nil, err)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	})
+
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			reply := client.ListTunnelsReply{}
+			args := client.ListTunnelsArgs{Keys: r.URL.Query().Get("keys") == "true"}
+			err := api.ListTunnels(&args, &reply)
+			writeReply(w, reply.Tunnels, err)
+		case "POST":
+			args := client.CreateTunnelArgs{}
+			if !readArgs(w, r, &args) {
+				return
+			}
+			if args.Host == "" {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("Host is required"))
+				return
+			}
+			var err error
+			args.Host, err = utils.ValidateAddr(args.Host)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			reply := client.CreateTunnelReply{}
+			err = api.CreateTunnel(&args, &reply)
+			writeReply(w, &reply, err)
+		case "DELETE":
+			host := r.URL.Query().Get("host")
+			if host == "" {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("Host is required"))
+				return
+			}
+			host, err := utils.ValidateAddr(host)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			err = api.DeleteTunnel(&client.DeleteTunnelArgs{Host: host}, &client.DeleteTunnelReply{})
+			writeReply(w, nil, err)
+		default:
+			methodNotAllowed(w, "GET, POST, DELETE")
+		}
+	})
+
+	mux.HandleFunc("/srcip", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		args := client.GetSrcIPArgs{}
+		if dst := r.URL.Query().Get("dst"); dst != "" {
+			args.Dst = net.ParseIP(dst)
+			if args.Dst == nil {
+				writeError(w, http.StatusBadRequest, &net.ParseError{Type: "IP address", Text: dst})
+				return
+			}
+		}
+		reply := client.GetSrcIPReply{}
+		err := api.GetSrcIP(&args, &reply)
+		writeReply(w, &reply, err)
+	})
+
+	return mux
+}
+
+var httpListener net.Listener
+
+func serveHTTP() {
+	var err error
+	httpListener, err = listen(opts.httpHost)
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+	glog.Infof("Serving http api on %s", opts.httpHost)
+	err = http.Serve(httpListener, newHTTPHandler())
+	if err != nil {
+		glog.Infof("Http api stopped: %v", err)
+	}
+}
+
+func shutdownHTTP() {
+	if httpListener != nil {
+		httpListener.Close()
+	}
+}
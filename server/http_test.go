@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestHTTPEcho(t *testing.T) {
+	ts := httptest.NewServer(newHTTPHandler())
+	defer ts.Close()
+	body, _ := json.Marshal(client.EchoArgs{Value: []byte("foo")})
+	res, err := http.Post(ts.URL+"/echo", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status: %v", res.Status)
+	}
+	reply := client.EchoReply{}
+	err = json.NewDecoder(res.Body).Decode(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Value) != "foo" {
+		t.Fatalf("Incorrect response from echo: %v", reply.Value)
+	}
+}
+
+func TestHTTPSegments(t *testing.T) {
+	initSegments()
+	seg := NewSegment()
+	seg.Id = "foo"
+	addSegment(seg.Id, seg)
+	defer removeSegment(seg.Id)
+
+	ts := httptest.NewServer(newHTTPHandler())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := []client.SegmentInfo{}
+	err = json.NewDecoder(res.Body).Decode(&infos)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Id != "foo" {
+		t.Fatalf("Unexpected segment list: %v", infos)
+	}
+
+	res, err = http.Get(ts.URL + "/segments/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected not found for missing segment: %v", res.Status)
+	}
+
+	body, _ := json.Marshal(client.CreateSegmentArgs{Id: "foo"})
+	res, err = http.Post(ts.URL+"/segments", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected conflict for existing segment: %v", res.Status)
+	}
+}
+
+func TestHTTPBadRequest(t *testing.T) {
+	ts := httptest.NewServer(newHTTPHandler())
+	defer ts.Close()
+	res, err := http.Post(ts.URL+"/segments", "application/json", bytes.NewReader([]byte("{")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for invalid json: %v", res.Status)
+	}
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/tunnels", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for missing host: %v", res.Status)
+	}
+}
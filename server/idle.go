@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netns"
+	"github.com/vishvananda/wormhole/client"
+)
+
+// How long stopped containers are given to exit before they are killed.
+const idleStopTimeout = 10 * time.Second
+
+// idlePolicy scales a triggered segment back down after it has had no
+// connections for timeout. Containers are stopped or removed depending on
+// remove.
+type idlePolicy struct {
+	timeout time.Duration
+	remove  bool
+}
+
+// parseIdle parses TIMEOUT ACTION where ACTION is stop or remove.
+func parseIdle(arg string) (*idlePolicy, error) {
+	parts := strings.Fields(arg)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Idle requires a timeout and an action: %s", arg)
+	}
+	timeout, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("Idle timeout must be positive: %s", parts[0])
+	}
+	p := &idlePolicy{timeout: timeout}
+	switch parts[1] {
+	case "stop":
+	case "remove":
+		p.remove = true
+	default:
+		return nil, fmt.Errorf("Idle action %s not recognized", parts[1])
+	}
+	return p, nil
+}
+
+func executeIdle(command *client.SegmentCommand, seg *Segment) error {
+	p, err := parseIdle(command.Arg)
+	if err != nil {
+		return err
+	}
+	seg.idle = p
+	return nil
+}
+
+// startIdleWatch starts watching for idleness if the segment has an idle
+// policy and is not already being watched.
+func (s *Segment) startIdleWatch() {
+	if s.idle == nil || s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	go s.watchIdle(s.done)
+}
+
+// watchIdle periodically checks if the segment has been idle long enough
+// to scale down. It exits when done is closed.
+func (s *Segment) watchIdle(done chan struct{}) {
+	interval := s.idle.timeout / 10
+	if interval < readyInterval {
+		interval = readyInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.checkIdle()
+		}
+	}
+}
+
+func (s *Segment) checkIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.Triggered || s.deleted || s.Proxy == nil {
+		return
+	}
+	active, idleSince, err := s.Proxy.Activity("segment")
+	if err != nil || active != 0 || time.Since(idleSince) < s.idle.timeout {
+		return
+	}
+	glog.Infof("Segment %s idle since %v, scaling down", s.Id, idleSince)
+	s.scaleDown()
+}
+
+// scaleDown releases everything created by the trigger commands and
+// re-arms them so the next connection triggers the segment again.
+// Containers and children created by the init commands are kept. It must
+// be called with s.mu held.
+func (s *Segment) scaleDown() {
+	if s.deleted {
+		return
+	}
+	trig := s.DockerIds[s.initDockers:]
+	for _, id := range trig {
+		var err error
+		if s.idle.remove {
+			err = dockerClient.Remove(id, true)
+		} else {
+			err = dockerClient.Stop(id, idleStopTimeout)
+		}
+		if err != nil {
+			glog.Errorf("Error scaling down docker container %s: %v", id, err)
+		}
+	}
+	if !s.idle.remove {
+		s.stopped = append(s.stopped, trig...)
+	}
+	s.DockerIds = s.DockerIds[:s.initDockers:s.initDockers]
+	for i := range s.Tails {
+		if !initChild(s.initTails, s.Tails[i].ChildId) {
+			s.Tails[i].cleanupChild()
+		}
+	}
+	for _, t := range s.Tails {
+		if t.Ns.IsOpen() && !initNs(s.initTails, t.Ns) {
+			t.Ns.Close()
+		}
+	}
+	s.Tails = append([]Tail(nil), s.initTails...)
+	s.balancer.SetEndpoints(nil)
+	s.Trig = copyCommands(s.trigTemplate)
+	s.Triggered = false
+	glog.Infof("Finished scaling down segment %s", s.Id)
+}
+
+// initChild returns true if id is the child of one of tails.
+func initChild(tails []Tail, id string) bool {
+	for _, t := range tails {
+		if t.ChildId != "" && t.ChildId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// initNs returns true if ns belongs to one of tails.
+func initNs(tails []Tail, ns netns.NsHandle) bool {
+	for _, t := range tails {
+		if t.Ns.Equal(ns) {
+			return true
+		}
+	}
+	return false
+}
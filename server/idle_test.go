@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/pkg/docker"
+)
+
+func TestParseIdle(t *testing.T) {
+	p, err := parseIdle("10m remove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.timeout != 10*time.Minute || !p.remove {
+		t.Fatalf("Unexpected idle policy: %+v", p)
+	}
+	for _, arg := range []string{"10m", "10m bogus", "bogus stop", "0s stop"} {
+		_, err := parseIdle(arg)
+		if err == nil {
+			t.Fatalf("No error for %q", arg)
+		}
+	}
+}
+
+func TestScaleDownRearms(t *testing.T) {
+	removed := make([]string, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		removed = append(removed, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	var err error
+	dockerClient, err = docker.NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg := NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1"})
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.IDLE, Arg: "1m remove"})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: ":2", Tail: true})
+	seg.trigTemplate = copyCommands(seg.Trig)
+	err = seg.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.initTails = append([]Tail(nil), seg.Tails...)
+	err = seg.Trigger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(seg.done)
+	seg.DockerIds = []string{"abc"}
+
+	seg.scaleDown()
+	if seg.Triggered || len(seg.Trig) != 1 || seg.Tails[0].Port != 0 {
+		t.Fatalf("Segment not re-armed: %v", seg.Info())
+	}
+	if len(removed) != 1 || removed[0] != "/containers/abc" || len(seg.DockerIds) != 0 {
+		t.Fatalf("Containers not removed: %v", removed)
+	}
+}
+
+func TestScaleDownStopRestarts(t *testing.T) {
+	requests := make([]string, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/containers/trig/json" {
+			fmt.Fprintf(w, `{"Id": "trig", "State": {"Running": true, "Pid": %d}}`, os.Getpid())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	var err error
+	dockerClient, err = docker.NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initSegments()
+	child := NewSegment()
+	child.Id = "initchild"
+	addSegment(child.Id, child)
+	defer removeSegment(child.Id)
+
+	seg := NewSegment()
+	seg.idle = &idlePolicy{timeout: time.Minute}
+	seg.tail(0).ChildId = "initchild"
+	seg.initTails = append([]Tail(nil), seg.Tails...)
+	seg.DockerIds = []string{"init"}
+	seg.initDockers = 1
+	seg.DockerIds = append(seg.DockerIds, "trig")
+	seg.Triggered = true
+
+	seg.scaleDown()
+	if len(requests) != 1 || requests[0] != "POST /containers/trig/stop" {
+		t.Fatalf("Only the trigger container should be stopped: %v", requests)
+	}
+	if getSegment("initchild") == nil || seg.Tails[0].ChildId != "initchild" {
+		t.Fatalf("Init child was deleted")
+	}
+	if len(seg.DockerIds) != 1 || len(seg.stopped) != 1 {
+		t.Fatalf("Unexpected containers: %v %v", seg.DockerIds, seg.stopped)
+	}
+
+	requests = requests[:0]
+	command := &client.SegmentCommand{Type: client.DOCKER_RUN, Arg: "img", Tail: true}
+	err = executeDockerRun(command, seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Tails[0].Ns.Close()
+	if len(requests) != 2 || requests[0] != "POST /containers/trig/start" {
+		t.Fatalf("Stopped container was not started again: %v", requests)
+	}
+	if len(seg.DockerIds) != 2 || seg.DockerIds[1] != "trig" || len(seg.stopped) != 0 {
+		t.Fatalf("Unexpected containers: %v %v", seg.DockerIds, seg.stopped)
+	}
+}
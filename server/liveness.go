@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/utils"
+)
+
+const (
+	// livenessTimeout bounds each echo through a tunnel
+	livenessTimeout = 5 * time.Second
+	// livenessFailures echoes in a row must fail to mark a tunnel down
+	livenessFailures = 3
+)
+
+// tunnelLiveness is the status of a tunnel as seen by monitorTunnels.
+type tunnelLiveness struct {
+	status   string
+	since    time.Time
+	failures int
+	rebuilds int
+}
+
+// probeTunnel and repairTunnel are variables so tests can replace them.
+var probeTunnel = echoTunnel
+var repairTunnel = rebuildTunnel
+
+// monitorTunnels echoes the peer of every tunnel over the overlay ips each
+// -tunnel-check and rebuilds the tunnels that are down.
+func monitorTunnels() {
+	for {
+		time.Sleep(opts.tunnelCheck)
+		checkTunnels()
+	}
+}
+
+func checkTunnels() {
+	tunnelsMutex.Lock()
+	dsts := make(map[string]net.IP, len(tunnels))
+	for key, tunnel := range tunnels {
+		dsts[key] = tunnel.Dst
+	}
+	tunnelsMutex.Unlock()
+
+	var wg sync.WaitGroup
+	var downMutex sync.Mutex
+	down := make([]string, 0)
+	for key, dst := range dsts {
+		wg.Add(1)
+		go func(key string, dst net.IP) {
+			defer wg.Done()
+			if !recordProbe(key, probeTunnel(dst)) {
+				downMutex.Lock()
+				down = append(down, key)
+				downMutex.Unlock()
+			}
+		}(key, dst)
+	}
+	wg.Wait()
+
+	for _, key := range down {
+		glog.Infof("Rebuilding tunnel to %s", key)
+		err := repairTunnel(key)
+		if err != nil {
+			glog.Errorf("Failed to rebuild tunnel to %s: %v", key, err)
+			continue
+		}
+		recordRebuild(key)
+		if dst := getTunnelDst(key); dst != nil {
+			recordProbe(key, probeTunnel(dst))
+		}
+	}
+}
+
+// echoTunnel sends an echo to the wormholed listening on the overlay ip dst
+// of the peer, which only reaches it through the tunnel.
+func echoTunnel(dst net.IP) error {
+	host, err := utils.ValidateAddr(dst.String())
+	if err != nil {
+		return err
+	}
+	c, err := client.NewClientTimeout(host, opts.config, livenessTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	value := randomKey()[:8]
+	result, err := c.Echo(value, "")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(value, result) {
+		return fmt.Errorf("Incorrect response from echo")
+	}
+	return nil
+}
+
+// recordProbe updates the status of the tunnel for key with the result of
+// an echo and returns false if the tunnel is down.
+func recordProbe(key string, err error) bool {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if tunnels[key] == nil {
+		return true
+	}
+	l := liveness[key]
+	if l == nil {
+		l = &tunnelLiveness{status: client.TunnelUnknown, since: time.Now()}
+		liveness[key] = l
+	}
+	if err == nil {
+		l.failures = 0
+		if l.status != client.TunnelUp {
+			glog.Infof("Tunnel to %s is up", key)
+			l.status = client.TunnelUp
+			l.since = time.Now()
+		}
+		return true
+	}
+	l.failures++
+	glog.Warningf("Echo through tunnel to %s failed (%d in a row): %v", key, l.failures, err)
+	if l.failures < livenessFailures {
+		return true
+	}
+	if l.status != client.TunnelDown {
+		glog.Warningf("Tunnel to %s is down", key)
+		l.status = client.TunnelDown
+		l.since = time.Now()
+	}
+	return false
+}
+
+func recordRebuild(key string) {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if l := liveness[key]; l != nil {
+		l.rebuilds++
+	}
+}
+
+// getLiveness returns the status of the tunnel for key. The caller must
+// hold tunnelsMutex.
+func getLiveness(key string) tunnelLiveness {
+	if l := liveness[key]; l != nil {
+		return *l
+	}
+	return tunnelLiveness{status: client.TunnelUnknown}
+}
+
+func getTunnelDst(key string) net.IP {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if tunnel := tunnels[key]; tunnel != nil {
+		return tunnel.Dst
+	}
+	return nil
+}
+
+// rebuildTunnel sends the tunnel for key to the peer again over the
+// underlay, which recreates it if the peer lost it, and rebuilds the local
+// end. The overlay ips are kept unless the peer has given them to another
+// tunnel.
+func rebuildTunnel(key string) error {
+	// a rebuild must not overlap a rekey of the same tunnel
+	rekeyMutex.Lock()
+	defer rekeyMutex.Unlock()
+	tunnel := getTunnel(key)
+	if tunnel == nil {
+		return fmt.Errorf("Failed to find tunnel to dst %s", key)
+	}
+	host, err := utils.ValidateAddr(key)
+	if err != nil {
+		return err
+	}
+	udp := tunnel.DriverName() == client.DriverXfrm && tunnel.SrcPort != 0
+	_, _, err = createTunnel(host, udp, tunnel.DriverName())
+	if err != nil {
+		return err
+	}
+	tunnel = getTunnel(key)
+	if tunnel == nil {
+		return fmt.Errorf("Tunnel to dst %s was removed", key)
+	}
+	driver, err := getDriver(tunnel.Driver)
+	if err != nil {
+		return err
+	}
+	return driver.build(net.ParseIP(key), tunnel)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestCheckTunnels(t *testing.T) {
+	tunnels = map[string]*client.Tunnel{
+		"10.0.0.2": {Reqid: 1, Src: net.ParseIP("100.65.0.1"), Dst: net.ParseIP("100.65.0.2")},
+	}
+	liveness = make(map[string]*tunnelLiveness)
+	up := false
+	repairs := 0
+	probeTunnel = func(dst net.IP) error {
+		if !dst.Equal(net.ParseIP("100.65.0.2")) {
+			t.Fatalf("Probed the wrong ip: %v", dst)
+		}
+		if up {
+			return nil
+		}
+		return fmt.Errorf("timeout")
+	}
+	repairTunnel = func(key string) error {
+		repairs++
+		up = true
+		return nil
+	}
+	defer func() {
+		tunnels = nil
+		liveness = nil
+		probeTunnel = echoTunnel
+		repairTunnel = rebuildTunnel
+	}()
+
+	for i := 1; i < livenessFailures; i++ {
+		checkTunnels()
+		if repairs != 0 || getLiveness("10.0.0.2").status != client.TunnelUnknown {
+			t.Fatalf("Tunnel was marked down after %d failures: %+v", i, getLiveness("10.0.0.2"))
+		}
+	}
+	checkTunnels()
+	l := getLiveness("10.0.0.2")
+	if repairs != 1 || l.status != client.TunnelUp || l.rebuilds != 1 || l.failures != 0 {
+		t.Fatalf("Tunnel was not rebuilt: %d %+v", repairs, l)
+	}
+
+	up = false
+	for i := 0; i < livenessFailures; i++ {
+		recordProbe("10.0.0.2", fmt.Errorf("timeout"))
+	}
+	infos := listTunnels(false)
+	if infos[0].Status != client.TunnelDown || infos[0].Rebuilds != 1 || infos[0].StatusTime.IsZero() {
+		t.Fatalf("Unexpected tunnel status: %+v", infos[0])
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/utils"
+)
+
+// Upper bounds in seconds of the trigger latency histogram buckets.
+var triggerBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// histogram is a cumulative histogram in the prometheus style.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := d.Seconds()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+var triggerLatency = newHistogram(triggerBuckets)
+
+// metricsWriter writes metrics in the prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value of name. labels are name value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(m.w, "%s %s\n", name, formatValue(value))
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	fmt.Fprintf(m.w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatValue(value))
+}
+
+func (m *metricsWriter) histogram(name string, h *histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		m.sample(name+"_bucket", float64(h.counts[i]), "le", formatValue(b))
+	}
+	m.sample(name+"_bucket", float64(h.count), "le", "+Inf")
+	m.sample(name+"_sum", h.sum)
+	m.sample(name+"_count", float64(h.count))
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// saCounters are the counters of one xfrm state. Added is when the state
+// was added in seconds since the epoch.
+type saCounters struct {
+	reqid   int
+	spi     int
+	dst     net.IP
+	bytes   uint64
+	packets uint64
+	added   uint64
+}
+
+// xfrmCounters dumps the byte and packet counters of every xfrm state. The
+// netlink library does not return them with the states.
+func xfrmCounters() ([]saCounters, error) {
+	req := nl.NewNetlinkRequest(nl.XFRM_MSG_GETSA, syscall.NLM_F_DUMP)
+	msgs, err := req.Execute(syscall.NETLINK_XFRM, nl.XFRM_MSG_NEWSA)
+	if err != nil {
+		return nil, err
+	}
+	counters := make([]saCounters, 0, len(msgs))
+	for _, m := range msgs {
+		msg := nl.DeserializeXfrmUsersaInfo(m)
+		counters = append(counters, saCounters{
+			reqid:   int(msg.Reqid),
+			spi:     int(nl.Swap32(msg.Id.Spi)),
+			dst:     msg.Id.Daddr.ToIP(),
+			bytes:   msg.Curlft.Bytes,
+			packets: msg.Curlft.Packets,
+			added:   msg.Curlft.AddTime,
+		})
+	}
+	return counters, nil
+}
+
+func writeSegmentMetrics(m *metricsWriter) {
+	all := allSegments()
+	stats := make([]client.SegmentStats, 0, len(all))
+	triggered := 0
+	for _, s := range all {
+		stats = append(stats, s.Stats())
+		if s.isTriggered() {
+			triggered++
+		}
+	}
+	sort.Sort(statsById(stats))
+
+	m.family("wormhole_segments", "gauge", "Number of segments.")
+	m.sample("wormhole_segments", float64(len(stats)))
+	m.family("wormhole_segments_triggered", "gauge", "Number of segments whose triggers have run.")
+	m.sample("wormhole_segments_triggered", float64(triggered))
+
+	counters := []struct {
+		name, kind, help string
+		value            func(s *client.SegmentStats) float64
+	}{
+		{"wormhole_segment_connections_accepted_total", "counter", "Connections accepted by the segment.",
+			func(s *client.SegmentStats) float64 { return float64(s.Accepted) }},
+		{"wormhole_segment_connections_active", "gauge", "Connections open through the segment.",
+			func(s *client.SegmentStats) float64 { return float64(s.Active) }},
+		{"wormhole_segment_connections_failed_total", "counter", "Connections that could not reach a tail.",
+			func(s *client.SegmentStats) float64 { return float64(s.Failed) }},
+		{"wormhole_segment_dials_total", "counter", "Successful dials to tails.",
+			func(s *client.SegmentStats) float64 { return float64(s.Dials) }},
+		{"wormhole_segment_dial_seconds_total", "counter", "Time spent on successful dials to tails.",
+			func(s *client.SegmentStats) float64 { return s.DialTime.Seconds() }},
+		{"wormhole_segment_triggers_total", "counter", "Times the trigger commands of the segment have run.",
+			func(s *client.SegmentStats) float64 { return float64(s.Triggers) }},
+		{"wormhole_segment_trigger_errors_total", "counter", "Times the trigger commands of the segment have failed.",
+			func(s *client.SegmentStats) float64 { return float64(s.TriggerErrors) }},
+		{"wormhole_segment_trigger_seconds_total", "counter", "Time spent running the trigger commands of the segment.",
+			func(s *client.SegmentStats) float64 { return s.TriggerTime.Seconds() }},
+	}
+	for _, c := range counters {
+		m.family(c.name, c.kind, c.help)
+		for i := range stats {
+			m.sample(c.name, c.value(&stats[i]), "segment", stats[i].Id)
+		}
+	}
+	m.family("wormhole_segment_bytes_total", "counter", "Bytes proxied by the segment. Direction in is from clients to tails.")
+	for _, s := range stats {
+		m.sample("wormhole_segment_bytes_total", float64(s.BytesIn), "segment", s.Id, "direction", "in")
+		m.sample("wormhole_segment_bytes_total", float64(s.BytesOut), "segment", s.Id, "direction", "out")
+	}
+	m.family("wormhole_trigger_duration_seconds", "histogram", "Time taken by trigger commands.")
+	m.histogram("wormhole_trigger_duration_seconds", triggerLatency)
+}
+
+func writeTunnelMetrics(m *metricsWriter) {
+	tunnelsMutex.Lock()
+	reqids := make(map[int]string)
+	spis := make(map[int]int)
+	hosts := make([]string, 0, len(tunnels))
+	status := make(map[string]tunnelLiveness)
+	for key, t := range tunnels {
+		reqids[t.Reqid] = key
+		spis[t.Reqid] = t.SpiValue()
+		hosts = append(hosts, key)
+		status[key] = getLiveness(key)
+	}
+	tunnelsMutex.Unlock()
+	sort.Strings(hosts)
+	m.family("wormhole_tunnels", "gauge", "Number of tunnels.")
+	m.sample("wormhole_tunnels", float64(len(reqids)))
+	m.family("wormhole_tunnel_up", "gauge", "Whether echoes through the tunnel succeed. Unchecked tunnels are left out.")
+	for _, host := range hosts {
+		switch status[host].status {
+		case client.TunnelUp:
+			m.sample("wormhole_tunnel_up", 1, "host", host)
+		case client.TunnelDown:
+			m.sample("wormhole_tunnel_up", 0, "host", host)
+		}
+	}
+	m.family("wormhole_tunnel_rebuilds_total", "counter", "Times the tunnel was rebuilt after going down.")
+	for _, host := range hosts {
+		m.sample("wormhole_tunnel_rebuilds_total", float64(status[host].rebuilds), "host", host)
+	}
+
+	all, err := xfrmCounters()
+	if err != nil {
+		glog.Errorf("Failed to read xfrm states: %v", err)
+	}
+	// states that are being replaced by a rekey are left out
+	counters := make([]saCounters, 0, len(all))
+	for _, c := range all {
+		if spi, ok := spis[c.reqid]; ok && spi == c.spi {
+			counters = append(counters, c)
+		}
+	}
+	m.family("wormhole_tunnel_bytes_total", "counter", "Bytes through the ipsec states of a tunnel.")
+	for _, c := range counters {
+		if host, ok := reqids[c.reqid]; ok {
+			m.sample("wormhole_tunnel_bytes_total", float64(c.bytes), "host", host, "direction", direction(host, c.dst))
+		}
+	}
+	m.family("wormhole_tunnel_packets_total", "counter", "Packets through the ipsec states of a tunnel.")
+	for _, c := range counters {
+		if host, ok := reqids[c.reqid]; ok {
+			m.sample("wormhole_tunnel_packets_total", float64(c.packets), "host", host, "direction", direction(host, c.dst))
+		}
+	}
+
+	used := 0
+	if overlayIPs != nil {
+		used = overlayIPs.Used()
+	}
+	ones, bits := opts.cidr.Mask.Size()
+	m.family("wormhole_tunnel_ips_used", "gauge", "Overlay ips assigned to tunnels.")
+	m.sample("wormhole_tunnel_ips_used", float64(used))
+	m.family("wormhole_tunnel_ips_total", "gauge", "Overlay ips in the tunnel cidr.")
+	m.sample("wormhole_tunnel_ips_total", math.Ldexp(1, bits-ones))
+
+	unusedPortsMutex.Lock()
+	free := len(unusedPorts)
+	unusedPortsMutex.Unlock()
+	m.family("wormhole_tunnel_ports_free", "gauge", "Udp encapsulation ports that are not in use.")
+	m.sample("wormhole_tunnel_ports_free", float64(free))
+	m.family("wormhole_tunnel_ports_total", "gauge", "Udp encapsulation ports in the port range.")
+	m.sample("wormhole_tunnel_ports_total", float64(opts.udpEndPort-opts.udpStartPort+1))
+}
+
+// direction is out for states that send to host.
+func direction(host string, dst net.IP) string {
+	if dst.Equal(net.ParseIP(host)) {
+		return "out"
+	}
+	return "in"
+}
+
+type statsById []client.SegmentStats
+
+func (a statsById) Len() int           { return len(a) }
+func (a statsById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a statsById) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+func newMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m := &metricsWriter{w}
+		writeSegmentMetrics(m)
+		writeTunnelMetrics(m)
+	})
+	return mux
+}
+
+var metricsListener net.Listener
+
+// listenMetrics creates a listener for host without tls so scrapers that
+// do not have the key can connect.
+func listenMetrics(host string) (net.Listener, error) {
+	proto, address := utils.ParseAddr(host)
+	if proto == "unix" {
+		return listenUnix(address, opts.group)
+	}
+	return net.Listen(proto, address)
+}
+
+func serveMetrics() {
+	var err error
+	metricsListener, err = listenMetrics(opts.metricsHost)
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+	glog.Infof("Serving metrics on %s", opts.metricsHost)
+	err = http.Serve(metricsListener, newMetricsHandler())
+	if err != nil {
+		glog.Infof("Metrics stopped: %v", err)
+	}
+}
+
+func shutdownMetrics() {
+	if metricsListener != nil {
+		metricsListener.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/wormhole/pkg/ipam"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	h.observe(500 * time.Millisecond)
+	h.observe(5 * time.Second)
+	h.observe(time.Minute)
+	if h.count != 3 || h.counts[0] != 1 || h.counts[1] != 2 || h.sum != 65.5 {
+		t.Fatalf("Unexpected histogram: %+v", h)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	_, cidr, _ := net.ParseCIDR("100.65.0.0/24")
+	opts = &options{cidr: cidr, udpStartPort: 4500, udpEndPort: 4509}
+	tunnels = nil
+	overlayIPs, _ = ipam.New(cidr, "")
+	overlayIPs.Reserve("10.0.0.2", net.ParseIP("100.65.0.1"), net.ParseIP("100.65.0.2"))
+	defer func() { overlayIPs = nil }()
+	unusedPorts = []int{4501, 4502, 4503}
+
+	initSegments()
+	seg := NewSegment()
+	seg.Id = "foo"
+	addSegment(seg.Id, seg)
+	defer removeSegment(seg.Id)
+
+	ts := httptest.NewServer(newMetricsHandler())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE wormhole_segments gauge",
+		"wormhole_segments 1",
+		`wormhole_segment_connections_accepted_total{segment="foo"} 0`,
+		`wormhole_segment_bytes_total{segment="foo",direction="in"} 0`,
+		`wormhole_trigger_duration_seconds_bucket{le="+Inf"}`,
+		"wormhole_tunnels 0",
+		"wormhole_tunnel_ips_used 2",
+		"wormhole_tunnel_ips_total 256",
+		"wormhole_tunnel_ports_free 3",
+		"wormhole_tunnel_ports_total 10",
+	} {
+		if !strings.Contains(string(body), line+"\n") && !strings.Contains(string(body), line+" ") {
+			t.Fatalf("Metrics missing %s:\n%s", line, body)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, cidr, _ := net.ParseCIDR("100.65.0.0/24")
+	opts = &options{cidr: cidr, metricsHost: "tcp://" + addr}
+	initSegments()
+
+	go serveMetrics()
+	defer shutdownMetrics()
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		res, err = http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "wormhole_segments 0") {
+		t.Fatalf("Unexpected metrics %v:\n%s", res.Status, body)
+	}
+}
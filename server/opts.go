@@ -8,9 +8,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/raff/tls-ext"
 	"github.com/raff/tls-psk"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/pkg/docker"
 	"github.com/vishvananda/wormhole/utils"
 )
 
@@ -22,6 +25,18 @@ type options struct {
 	config       *tls.Config
 	udpStartPort int
 	udpEndPort   int
+	stateFile    string
+	httpHost     string
+	metricsHost  string
+	group        string
+	dockerHost   string
+	drain        time.Duration
+	ciphers      []string
+	driver       string
+	rekeyTime    time.Duration
+	rekeyBytes   uint64
+	tunnelCheck  time.Duration
+	pins         map[string]net.IP
 }
 
 var opts *options
@@ -32,8 +47,21 @@ func parseFlags() {
 	external := flag.String("E", "", "External Ip for tunnel (defaults to src of default route)")
 	cidr := flag.String("C", "100.65.0.0/14", "Cidr for overlay ips (must be the same on all hosts)")
 	ports := flag.String("P", "4500-4599", "Inclusive port range for udp tunnels")
+	stateFile := flag.String("S", "/var/lib/wormhole/state.json", "File for persisting segments and tunnels (empty disables)")
+	httpHost := flag.String("J", "", "tcp://host:port or unix://path/to/socket to bind for the http/json api (disabled if empty)")
+	metricsHost := flag.String("metrics", "", "tcp://host:port or unix://path/to/socket to serve prometheus /metrics on (disabled if empty)")
 	hosts := utils.NewListOpts(utils.ValidateAddr)
 	flag.Var(&hosts, "H", "Multiple tcp://host:port or unix://path/to/socket to bind")
+	pins := utils.NewListOpts(nil)
+	flag.Var(&pins, "pin", "Multiple HOST=IP to give the tunnel to the peer with external ip HOST the overlay ips IP and IP+1")
+	group := flag.String("G", "", "Group for unix sockets (defaults to the group of wormholed)")
+	dockerHost := flag.String("D", docker.DefaultHost, "Docker engine api unix://path/to/socket or tcp://host:port")
+	ciphers := flag.String("ciphers", strings.Join(client.Ciphers, ","), "Comma separated tunnel ciphers in order of preference")
+	driver := flag.String("driver", client.DriverXfrm, "Driver for tunnels that do not specify one (xfrm or wireguard)")
+	rekeyTime := flag.Duration("rekey", 0, "Replace the keys of tunnels after this long (0 disables, peers must support rekeying)")
+	rekeyBytes := flag.Uint64("rekey-bytes", 0, "Replace the keys of tunnels after this many bytes in either direction (0 disables)")
+	tunnelCheck := flag.Duration("tunnel-check", 30*time.Second, "How often to echo the peer of each tunnel and rebuild tunnels that are down (0 disables)")
+	drain := flag.Duration("drain", 10*time.Second, "How long open connections may finish on shutdown before they are closed")
 
 	flag.Parse()
 	if hosts.Len() == 0 {
@@ -64,10 +92,40 @@ func parseFlags() {
 			log.Fatalf("Invalid external IP for tunnels: %v", external)
 		}
 	}
+	if *httpHost != "" {
+		var err error
+		*httpHost, err = utils.ValidateAddr(*httpHost)
+		if err != nil {
+			log.Fatalf("Failed to parse -J: %v", err)
+		}
+	}
+	if *metricsHost != "" {
+		var err error
+		*metricsHost, err = utils.ValidateAddr(*metricsHost)
+		if err != nil {
+			log.Fatalf("Failed to parse -metrics: %v", err)
+		}
+	}
+	cipherList, err := parseCiphers(*ciphers)
+	if err != nil {
+		log.Fatalf("Failed to parse -ciphers: %v", err)
+	}
+	_, err = getDriver(*driver)
+	if err != nil {
+		log.Fatalf("Failed to parse -driver: %v", err)
+	}
 	_, cidrNet, err := net.ParseCIDR(*cidr)
 	if err != nil {
 		log.Fatalf("Failed to parse -C: %v", err)
 	}
+	pinIPs := make(map[string]net.IP)
+	for _, pin := range pins.GetAll() {
+		parts := strings.SplitN(pin, "=", 2)
+		if len(parts) != 2 || net.ParseIP(parts[0]) == nil || net.ParseIP(parts[1]) == nil {
+			log.Fatalf("Pin %s is not valid, expected HOST=IP", pin)
+		}
+		pinIPs[net.ParseIP(parts[0]).String()] = net.ParseIP(parts[1])
+	}
 	portParts := strings.Split(*ports, "-")
 	startPort, err := strconv.Atoi(portParts[0])
 	if err != nil {
@@ -116,5 +174,17 @@ func parseFlags() {
 		config:       config,
 		udpStartPort: startPort,
 		udpEndPort:   endPort,
+		stateFile:    *stateFile,
+		httpHost:     *httpHost,
+		metricsHost:  *metricsHost,
+		group:        *group,
+		dockerHost:   *dockerHost,
+		drain:        *drain,
+		ciphers:      cipherList,
+		driver:       *driver,
+		rekeyTime:    *rekeyTime,
+		rekeyBytes:   *rekeyBytes,
+		tunnelCheck:  *tunnelCheck,
+		pins:         pinIPs,
 	}
 }
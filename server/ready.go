@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netns"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/pkg/proxy"
+)
+
+// How often readiness is polled.
+const readyInterval = 100 * time.Millisecond
+
+// readiness is a policy that must be satisfied by the tail of a segment
+// before connections are proxied to it.
+type readiness struct {
+	policy  string
+	pattern *regexp.Regexp
+	timeout time.Duration
+}
+
+// parseReady parses TIMEOUT POLICY where POLICY is one of health, tcp or
+// log:PATTERN.
+func parseReady(arg string) (*readiness, error) {
+	parts := strings.SplitN(arg, " ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Ready requires a timeout and a policy: %s", arg)
+	}
+	timeout, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	r := &readiness{policy: parts[1], timeout: timeout}
+	switch {
+	case r.policy == "health", r.policy == "tcp":
+	case strings.HasPrefix(r.policy, "log:"):
+		r.pattern, err = regexp.Compile(strings.TrimPrefix(r.policy, "log:"))
+		if err != nil {
+			return nil, err
+		}
+		r.policy = "log"
+	default:
+		return nil, fmt.Errorf("Ready policy %s not recognized", parts[1])
+	}
+	return r, nil
+}
+
+func executeReady(command *client.SegmentCommand, seg *Segment) error {
+	r, err := parseReady(command.Arg)
+	if err != nil {
+		return err
+	}
+	seg.ready = r
+	return nil
+}
+
+// wait blocks until the tail of seg satisfies the policy or the timeout
+// expires.
+func (r *readiness) wait(seg *Segment) error {
+	glog.Infof("Waiting up to %v for %s readiness of segment %s", r.timeout, r.policy, seg.Id)
+	deadline := time.Now().Add(r.timeout)
+	var err error
+	switch r.policy {
+	case "health":
+		err = waitHealthy(lastContainer(seg), deadline)
+	case "tcp":
+		for _, t := range seg.Tails {
+			network := "tcp"
+			if t.Proto == "unix" {
+				network = "unix"
+			}
+			err = waitConnect(t.Ns, network, t.address(), deadline)
+			if err != nil {
+				break
+			}
+		}
+	case "log":
+		err = waitLog(lastContainer(seg), r.pattern, deadline)
+	}
+	if err != nil {
+		return fmt.Errorf("Segment %s not ready: %v", seg.Id, err)
+	}
+	glog.Infof("Segment %s is ready", seg.Id)
+	return nil
+}
+
+func lastContainer(seg *Segment) string {
+	if len(seg.DockerIds) == 0 {
+		return ""
+	}
+	return seg.DockerIds[len(seg.DockerIds)-1]
+}
+
+func waitHealthy(id string, deadline time.Time) error {
+	if id == "" {
+		return fmt.Errorf("No container to check health")
+	}
+	for {
+		container, err := dockerClient.Inspect(id)
+		if err != nil {
+			return err
+		}
+		if container.State.Health == nil {
+			return fmt.Errorf("Container %s has no health check", id)
+		}
+		if container.State.Health.Status == "healthy" {
+			return nil
+		}
+		if !container.State.Running {
+			return fmt.Errorf("Container %s is not running", id)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out with health %s", container.State.Health.Status)
+		}
+		time.Sleep(readyInterval)
+	}
+}
+
+func waitConnect(ns netns.NsHandle, network string, host string, deadline time.Time) error {
+	for {
+		conn, err := proxy.DialInNs(ns, network, host, deadline.Sub(time.Now()))
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out connecting to %s: %v", host, err)
+		}
+		time.Sleep(readyInterval)
+	}
+}
+
+func waitLog(id string, pattern *regexp.Regexp, deadline time.Time) error {
+	if id == "" {
+		return fmt.Errorf("No container to read logs from")
+	}
+	logs, err := dockerClient.Logs(id, true)
+	if err != nil {
+		return err
+	}
+	// closing the stream unblocks the scanner when the deadline passes
+	timer := time.AfterFunc(deadline.Sub(time.Now()), func() { logs.Close() })
+	defer timer.Stop()
+	defer logs.Close()
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		if pattern.MatchString(scanner.Text()) {
+			return nil
+		}
+	}
+	if time.Now().After(deadline) {
+		return fmt.Errorf("Timed out waiting for log matching %s", pattern)
+	}
+	return fmt.Errorf("Log ended without matching %s", pattern)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/pkg/docker"
+)
+
+func TestParseReady(t *testing.T) {
+	r, err := parseReady("30s log:ready for connections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.policy != "log" || r.timeout != 30*time.Second || !r.pattern.MatchString("mysqld: ready for connections.") {
+		t.Fatalf("Unexpected readiness: %+v", r)
+	}
+	for _, arg := range []string{"30s", "tcp 30s", "30s bogus", "30s log:("} {
+		_, err := parseReady(arg)
+		if err == nil {
+			t.Fatalf("No error for %q", arg)
+		}
+	}
+}
+
+func TestWaitTcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = waitConnect(netns.None(), "tcp", l.Addr().String(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	err = waitConnect(netns.None(), "tcp", addr, time.Now().Add(300*time.Millisecond))
+	if err == nil {
+		t.Fatal("No error waiting for closed port")
+	}
+}
+
+func TestWaitLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("starting\nready for connections\n"))
+	}))
+	defer ts.Close()
+	var err error
+	dockerClient, err = docker.NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	err = waitLog("abc", regexp.MustCompile("ready for"), deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitLog("abc", regexp.MustCompile("never"), deadline)
+	if err == nil {
+		t.Fatal("No error for log that never matches")
+	}
+}
+
+func TestReadyAfterScaleDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	seg := NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1"})
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.READY, Arg: "300ms tcp"})
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.IDLE, Arg: "1m remove"})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: fmt.Sprintf("tcp://%s", l.Addr()), Tail: true})
+	seg.trigTemplate = copyCommands(seg.Trig)
+	err = seg.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.initTails = append([]Tail(nil), seg.Tails...)
+	err = seg.Trigger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(seg.done)
+
+	seg.scaleDown()
+	l.Close()
+	err = seg.Trigger()
+	if err == nil || seg.Triggered {
+		t.Fatal("Trigger after scale down did not wait for readiness")
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/utils"
+)
+
+// Rekeying installs states with a fresh spi and keys next to the current
+// ones. The kernel sends with the newest outbound state and receives on
+// any state with a matching spi, so the old states are only removed after
+// rekeyGrace.
+const (
+	rekeyGrace = 30 * time.Second
+	rekeyCheck = time.Minute
+	// spis below 256 are reserved
+	minSpi = 256
+)
+
+// rekeyMutex serializes rekeys so a tunnel is never rekeyed twice at once.
+var rekeyMutex sync.Mutex
+
+// rekeys checks the tunnels every rekeyCheck and rekeys those whose keys
+// are older than -rekey or have protected more than -rekey-bytes.
+func rekeys() {
+	for {
+		time.Sleep(rekeyCheck)
+		checkRekeys()
+	}
+}
+
+func checkRekeys() {
+	var counters []saCounters
+	if opts.rekeyBytes > 0 {
+		var err error
+		counters, err = xfrmCounters()
+		if err != nil {
+			glog.Errorf("Failed to read xfrm states: %v", err)
+		}
+	}
+	tunnelsMutex.Lock()
+	keys := make([]string, 0)
+	for key, tunnel := range tunnels {
+		if needsRekey(tunnel, counters) {
+			keys = append(keys, key)
+		}
+	}
+	tunnelsMutex.Unlock()
+	for _, key := range keys {
+		err := rekeyTunnel(key)
+		if err != nil {
+			glog.Errorf("Failed to rekey tunnel to %s: %v", key, err)
+		}
+	}
+}
+
+// needsRekey returns true if tunnel is due for new keys. Only the end with
+// the lower overlay ip rekeys so both ends do not rekey at the same time.
+func needsRekey(tunnel *client.Tunnel, counters []saCounters) bool {
+	// wireguard rotates its session keys by itself
+	if tunnel.DriverName() != client.DriverXfrm {
+		return false
+	}
+	if bytes.Compare(tunnel.Src.To16(), tunnel.Dst.To16()) > 0 {
+		return false
+	}
+	if opts.rekeyTime > 0 && time.Since(tunnel.KeyTime) >= opts.rekeyTime {
+		return true
+	}
+	if opts.rekeyBytes > 0 {
+		for _, c := range counters {
+			if c.reqid == tunnel.Reqid && c.spi == tunnel.SpiValue() && c.bytes >= opts.rekeyBytes {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomSpi() (int, error) {
+	value, err := rand.Int(rand.Reader, big.NewInt(int64(^uint32(0))-minSpi))
+	if err != nil {
+		return 0, err
+	}
+	return int(value.Int64()) + minSpi, nil
+}
+
+// newKeys returns a copy of tunnel with a new spi and keys.
+func newKeys(tunnel *client.Tunnel) (*client.Tunnel, error) {
+	rekeyed := *tunnel
+	for rekeyed.SpiValue() == tunnel.SpiValue() {
+		var err error
+		rekeyed.Spi, err = randomSpi()
+		if err != nil {
+			return nil, err
+		}
+	}
+	rekeyed.AuthKey = randomKey()
+	rekeyed.EncKey = randomKey()
+	err := setCipher(&rekeyed, rekeyed.CipherName())
+	if err != nil {
+		return nil, err
+	}
+	rekeyed.KeyTime = time.Now()
+	return &rekeyed, nil
+}
+
+// rekeyTunnel replaces the keys of the tunnel to the peer with external ip
+// key. The new inbound state is added before the peer is asked to switch,
+// and the new outbound state after it has.
+func rekeyTunnel(key string) error {
+	rekeyMutex.Lock()
+	defer rekeyMutex.Unlock()
+	old := getTunnel(key)
+	if old == nil {
+		return fmt.Errorf("Failed to find tunnel to dst %s", key)
+	}
+	dst := net.ParseIP(key)
+	tunnel, err := newKeys(old)
+	if err != nil {
+		return err
+	}
+	host, err := utils.ValidateAddr(key)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Rekeying tunnel: %v, %v", tunnel.Src, tunnel.Dst)
+	states := getStates(opts.src, dst, tunnel)
+	out, in := states[0], states[1]
+	err = netlink.XfrmStateAdd(&in)
+	if err != nil {
+		return err
+	}
+
+	// tunnel dst and src are reversed from remote
+	c, err := client.NewClient(host, opts.config)
+	if err == nil {
+		err = c.RekeyTunnel(opts.external, reverseTunnel(tunnel))
+		c.Close()
+	}
+	if err != nil {
+		deleteStates([]netlink.XfrmState{in})
+		return err
+	}
+
+	// the remote end has switched so the new keys are kept even if the
+	// outbound state cannot be added
+	updateTunnel(key, tunnel)
+	err = netlink.XfrmStateAdd(&out)
+	if err != nil {
+		return err
+	}
+	retireStates(old, tunnel, getStates(opts.src, dst, old))
+	glog.Infof("Finished rekeying tunnel: %v, %v", tunnel.Src, tunnel.Dst)
+	return nil
+}
+
+// installRekey adds the states for the new keys sent by the peer with
+// external ip dst.
+func installRekey(dst net.IP, remote *client.Tunnel) error {
+	key := dst.String()
+	old := getTunnel(key)
+	if old == nil {
+		return fmt.Errorf("Failed to find tunnel to dst %s", key)
+	}
+	if old.DriverName() != client.DriverXfrm {
+		return fmt.Errorf("Tunnel to dst %s cannot be rekeyed", key)
+	}
+	if remote.Reqid != old.Reqid || remote.CipherName() != old.CipherName() {
+		return fmt.Errorf("Rekey does not match tunnel to dst %s", key)
+	}
+	tunnel := *old
+	tunnel.Spi = remote.Spi
+	tunnel.AuthKey = remote.AuthKey
+	tunnel.EncKey = remote.EncKey
+	tunnel.KeyTime = remote.KeyTime
+	glog.Infof("Installing new keys for tunnel: %v, %v", tunnel.Src, tunnel.Dst)
+	states := getStates(opts.src, dst, &tunnel)
+	added := make([]netlink.XfrmState, 0, len(states))
+	// add the inbound state first
+	for i := len(states) - 1; i >= 0; i-- {
+		err := netlink.XfrmStateAdd(&states[i])
+		if err != nil && err != syscall.EEXIST {
+			deleteStates(added)
+			return err
+		}
+		added = append(added, states[i])
+	}
+	retireStates(old, &tunnel, getStates(opts.src, dst, old))
+	updateTunnel(key, &tunnel)
+	return nil
+}
+
+// retireStates deletes the states of old after rekeyGrace unless the spi
+// did not change.
+func retireStates(old *client.Tunnel, tunnel *client.Tunnel, states []netlink.XfrmState) {
+	if old.SpiValue() == tunnel.SpiValue() {
+		return
+	}
+	time.AfterFunc(rekeyGrace, func() {
+		deleteStates(states)
+	})
+}
+
+// staleStates returns the states in states that belong to the tunnel with
+// reqid to the peer with external ip dst but not to its current spi.
+func staleStates(states []netlink.XfrmState, dst net.IP, reqid int, spi int) []netlink.XfrmState {
+	stale := make([]netlink.XfrmState, 0)
+	for _, state := range states {
+		if state.Reqid != reqid || state.Spi == spi {
+			continue
+		}
+		if state.Dst.Equal(dst) || state.Src.Equal(dst) {
+			stale = append(stale, state)
+		}
+	}
+	return stale
+}
+
+// retireStale deletes the states of tunnel that were replaced by a rekey
+// but not removed because wormholed restarted during rekeyGrace. They are
+// given a new rekeyGrace in case the peer still uses them.
+func retireStale(dst net.IP, tunnel *client.Tunnel) {
+	if tunnel.DriverName() != client.DriverXfrm {
+		return
+	}
+	states, err := netlink.XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		glog.Warningf("Failed to get xfrm states: %v", err)
+		return
+	}
+	stale := staleStates(states, dst, tunnel.Reqid, tunnel.SpiValue())
+	if len(stale) == 0 {
+		return
+	}
+	glog.Infof("Retiring %d stale states of tunnel to %s", len(stale), dst)
+	time.AfterFunc(rekeyGrace, func() {
+		deleteStates(stale)
+	})
+}
+
+// newestFirst orders states so the most recently added come first. After
+// a rekey the newest state to a peer has the current keys.
+func newestFirst(states []netlink.XfrmState, counters []saCounters) {
+	added := func(state netlink.XfrmState) uint64 {
+		for _, c := range counters {
+			if c.reqid == state.Reqid && c.spi == state.Spi && c.dst.Equal(state.Dst) {
+				return c.added
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return added(states[i]) > added(states[j])
+	})
+}
+
+func deleteStates(states []netlink.XfrmState) {
+	for _, state := range states {
+		err := netlink.XfrmStateDel(&state)
+		if err != nil {
+			glog.Warningf("Failed to delete state %v: %v", state, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestNewKeys(t *testing.T) {
+	tunnel := &client.Tunnel{Reqid: 7, Cipher: client.CipherAesGcm, EncKey: make([]byte, 36)}
+	rekeyed, err := newKeys(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed.SpiValue() == 7 || rekeyed.SpiValue() < minSpi || rekeyed.Reqid != 7 {
+		t.Fatalf("Unexpected spi: %+v", rekeyed)
+	}
+	if rekeyed.AuthKey != nil || len(rekeyed.EncKey) != 36 || rekeyed.KeyTime.IsZero() {
+		t.Fatalf("Unexpected keys: %+v", rekeyed)
+	}
+	if tunnel.Spi != 0 || !tunnel.KeyTime.IsZero() {
+		t.Fatalf("Original tunnel was modified: %+v", tunnel)
+	}
+	if rekeyed.Equal(tunnel) {
+		t.Fatalf("Rekeyed tunnel equals the original")
+	}
+}
+
+func TestNeedsRekey(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	opts = &options{rekeyTime: time.Hour, rekeyBytes: 1000}
+
+	tunnel := &client.Tunnel{Reqid: 7, Src: net.ParseIP("100.65.0.1"), Dst: net.ParseIP("100.65.0.2"), KeyTime: time.Now()}
+	if needsRekey(tunnel, nil) {
+		t.Fatalf("New keys should not be rekeyed")
+	}
+	if !needsRekey(tunnel, []saCounters{{reqid: 7, spi: 7, bytes: 1000}}) {
+		t.Fatalf("Expected rekey after byte limit")
+	}
+	if needsRekey(tunnel, []saCounters{{reqid: 7, spi: 300, bytes: 1000}}) {
+		t.Fatalf("Retired states should not cause a rekey")
+	}
+	tunnel.KeyTime = time.Now().Add(-2 * time.Hour)
+	if !needsRekey(tunnel, nil) {
+		t.Fatalf("Expected rekey after lifetime")
+	}
+	tunnel.Src, tunnel.Dst = tunnel.Dst, tunnel.Src
+	if needsRekey(tunnel, nil) {
+		t.Fatalf("Only the end with the lower ip should rekey")
+	}
+}
+
+func TestStaleStates(t *testing.T) {
+	local := net.ParseIP("10.0.0.1")
+	peer := net.ParseIP("10.0.0.2")
+	states := []netlink.XfrmState{
+		{Src: local, Dst: peer, Reqid: 7, Spi: 300},
+		{Src: peer, Dst: local, Reqid: 7, Spi: 300},
+		{Src: local, Dst: peer, Reqid: 7, Spi: 400},
+		{Src: peer, Dst: local, Reqid: 7, Spi: 400},
+		{Src: local, Dst: net.ParseIP("10.0.0.3"), Reqid: 7, Spi: 300},
+		{Src: local, Dst: peer, Reqid: 8, Spi: 300},
+	}
+	stale := staleStates(states, peer, 7, 400)
+	if len(stale) != 2 || stale[0].Spi != 300 || stale[1].Spi != 300 {
+		t.Fatalf("Unexpected stale states: %v", stale)
+	}
+
+	newestFirst(states, []saCounters{
+		{reqid: 7, spi: 300, dst: peer, added: 100},
+		{reqid: 7, spi: 400, dst: peer, added: 200},
+	})
+	if states[0].Spi != 400 || !states[0].Dst.Equal(peer) {
+		t.Fatalf("Newest state is not first: %v", states)
+	}
+}
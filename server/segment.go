@@ -3,14 +3,17 @@ package server
 import (
 	"fmt"
 	"net"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/vishvananda/netns"
 	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/pkg/docker"
 	"github.com/vishvananda/wormhole/pkg/proxy"
 	"github.com/vishvananda/wormhole/utils"
 )
@@ -18,23 +21,42 @@ import (
 var segmentsMutex sync.Mutex
 var segments map[string]*Segment
 
+var dockerClient *docker.Client
+
+// Containers started by docker-run are labeled with the id of the segment.
+const segmentLabel = "wormhole.segment"
+
+func initDocker() {
+	var err error
+	dockerClient, err = docker.NewClient(opts.dockerHost)
+	if err != nil {
+		glog.Fatalf("Failed to create docker client: %v", err)
+	}
+}
+
 func initSegments() {
 	segments = make(map[string]*Segment)
 }
 
-func cleanupSegments() {
-	for id, s := range segments {
+func cleanupSegments(drain time.Duration) {
+	segmentsMutex.Lock()
+	all := segments
+	segments = make(map[string]*Segment)
+	segmentsMutex.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range all {
+		wg.Add(1)
+		go func(s *Segment) {
+			defer wg.Done()
+			s.Drain(drain, true)
+		}(s)
+	}
+	wg.Wait()
+	for id, s := range all {
 		glog.Infof("Cleaning segment %s", id)
 		s.Cleanup()
 		glog.Infof("Finished cleaning segment %s", id)
 	}
-	segmentsMutex.Lock()
-	defer segmentsMutex.Unlock()
-	for id, _ := range segments {
-		glog.Infof("Deleting segment %s", id)
-		delete(segments, id)
-		glog.Infof("Finished deleting segment %s", id)
-	}
 }
 
 func addSegment(key string, segment *Segment) {
@@ -44,34 +66,190 @@ func addSegment(key string, segment *Segment) {
 }
 
 func getSegment(key string) *Segment {
+	segmentsMutex.Lock()
+	defer segmentsMutex.Unlock()
 	return segments[key]
 }
 
+// allSegments returns the current segments. Segments must not be locked
+// while segmentsMutex is held because triggers add child segments with
+// the segment locked.
+func allSegments() []*Segment {
+	segmentsMutex.Lock()
+	defer segmentsMutex.Unlock()
+	all := make([]*Segment, 0, len(segments))
+	for _, s := range segments {
+		all = append(all, s)
+	}
+	return all
+}
+
+func listSegments() []client.SegmentInfo {
+	all := allSegments()
+	infos := make([]client.SegmentInfo, 0, len(all))
+	for _, s := range all {
+		infos = append(infos, s.Info())
+	}
+	sort.Sort(byId(infos))
+	return infos
+}
+
+func getSegmentInfo(id string) (*client.SegmentInfo, error) {
+	s := getSegment(id)
+	if s == nil {
+		return nil, fmt.Errorf("Segment %s does not exist", id)
+	}
+	info := s.Info()
+	return &info, nil
+}
+
+func getSegmentStats(id string) (*client.SegmentStats, error) {
+	s := getSegment(id)
+	if s == nil {
+		return nil, fmt.Errorf("Segment %s does not exist", id)
+	}
+	stats := s.Stats()
+	return &stats, nil
+}
+
+type byId []client.SegmentInfo
+
+func (a byId) Len() int           { return len(a) }
+func (a byId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byId) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+// takeSegment removes the segment with id and returns it so only one
+// caller cleans it up.
+func takeSegment(id string) *Segment {
+	segmentsMutex.Lock()
+	defer segmentsMutex.Unlock()
+	s := segments[id]
+	delete(segments, id)
+	return s
+}
+
 func removeSegment(key string) {
 	segmentsMutex.Lock()
 	defer segmentsMutex.Unlock()
 	delete(segments, key)
 }
 
+// ConnectionInfo is one end of a segment. For unix sockets Hostname is the
+// path of the socket and Root is the directory it is relative to, which is
+// the root of the container for docker-ns and docker-run.
 type ConnectionInfo struct {
 	Proto    string
 	Ns       netns.NsHandle
 	Hostname string
 	Port     int
+	Root     string
+}
+
+// address returns the address to listen on or dial for c.
+func (c ConnectionInfo) address() string {
+	if c.Proto == "unix" {
+		return filepath.Join("/", c.Root, c.Hostname)
+	}
+	return net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port))
+}
+
+func (c ConnectionInfo) Info() client.ConnectionInfo {
+	info := client.ConnectionInfo{Proto: c.Proto, Hostname: c.Hostname, Port: c.Port}
+	if c.Ns.IsOpen() {
+		info.Ns = c.Ns.String()
+	}
+	return info
+}
+
+// Tail is one of the ends a segment connects to. ChildHost and ChildId
+// identify the segment created for the tail by child, chain, remote and
+// tunnel commands.
+type Tail struct {
+	ConnectionInfo
+	Weight    int
+	ChildHost string
+	ChildId   string
+}
+
+func (t Tail) Info() client.TailInfo {
+	return client.TailInfo{
+		ConnectionInfo: t.ConnectionInfo.Info(),
+		Weight:         t.Weight,
+		ChildHost:      t.ChildHost,
+		ChildId:        t.ChildId,
+	}
+}
+
+func (t *Tail) cleanupChild() {
+	if t.ChildId == "" {
+		return
+	}
+	if t.ChildHost == "" {
+		deleteSegment(t.ChildId, 0, true)
+	} else {
+		c, err := client.NewClient(t.ChildHost, opts.config)
+		if err != nil {
+			glog.Errorf("Failed to connect to child host at %s: %v", t.ChildHost, err)
+		} else {
+			err = c.DeleteSegment(t.ChildId, 0, true)
+			c.Close()
+			if err != nil {
+				glog.Errorf("Failed to delete child segment %s on %s: %v", t.ChildId, t.ChildHost, err)
+			} else {
+				forgetChild(t.ChildId)
+			}
+		}
+	}
+	t.ChildId = ""
+	t.ChildHost = ""
 }
 
 type Segment struct {
+	Id        string
 	Head      ConnectionInfo
-	Tail      ConnectionInfo
+	Tails     []Tail
 	Init      []client.SegmentCommand
 	Trig      []client.SegmentCommand
-	ChildHost string
-	ChildId   string
 	Proxy     *proxy.Proxier
 	DockerIds []string
+	Triggered bool
+	balance   string
+	balancer  *proxy.Balancer
+	ready     *readiness
+	idle      *idlePolicy
+	// trigTemplate, initTails and initDockers are used to re-arm the
+	// segment after an idle scale down. Containers stopped by the scale
+	// down are kept in stopped and started again by the next trigger.
+	trigTemplate  []client.SegmentCommand
+	initTails     []Tail
+	initDockers   int
+	stopped       []string
+	deleted       bool
+	mu            sync.Mutex // serializes Trigger, scaleDown, Cleanup, Info and Stats
+	done          chan struct{}
+	statsMu       sync.Mutex // protects triggers, triggerTime and triggerErrors
+	triggers      uint64
+	triggerTime   time.Duration
+	triggerErrors uint64
+}
+
+// tail returns the tail numbered index, adding empty tails as needed.
+func (s *Segment) tail(index int) *Tail {
+	for len(s.Tails) <= index {
+		s.Tails = append(s.Tails, Tail{ConnectionInfo: ConnectionInfo{Ns: netns.None()}})
+	}
+	return &s.Tails[index]
+}
+
+// target returns the connection modified by command.
+func (s *Segment) target(command *client.SegmentCommand) *ConnectionInfo {
+	if command.Tail {
+		return &s.tail(command.TailIndex).ConnectionInfo
+	}
+	return &s.Head
 }
 
-func (s Segment) String() string {
+func (s *Segment) String() string {
 	var initstring, trigstring string
 	for _, a := range s.Init {
 		initstring += fmt.Sprintf("%s: %v ", client.CommandName[a.Type], a)
@@ -79,52 +257,174 @@ func (s Segment) String() string {
 	for _, a := range s.Trig {
 		trigstring += fmt.Sprintf("%s: %v ", client.CommandName[a.Type], a)
 	}
-	return fmt.Sprintf("{%v %v [%s] [%s]}", s.Head, s.Tail, strings.TrimSpace(initstring), strings.TrimSpace(trigstring))
+	return fmt.Sprintf("{%v %v [%s] [%s]}", s.Head, s.Tails, strings.TrimSpace(initstring), strings.TrimSpace(trigstring))
+}
+
+func clientStats(stats proxy.Stats) client.Stats {
+	return client.Stats{
+		Accepted:    stats.Accepted,
+		Active:      stats.Active,
+		Failed:      stats.Failed,
+		BytesIn:     stats.BytesIn,
+		BytesOut:    stats.BytesOut,
+		Dials:       stats.Dials,
+		DialTime:    stats.DialTime,
+		MaxDialTime: stats.MaxDialTime,
+	}
+}
+
+// Stats returns the counters of the segment and its tails.
+func (s *Segment) Stats() client.SegmentStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := client.SegmentStats{Id: s.Id}
+	s.statsMu.Lock()
+	stats.Triggers = s.triggers
+	stats.TriggerTime = s.triggerTime
+	stats.TriggerErrors = s.triggerErrors
+	s.statsMu.Unlock()
+	stats.Tails = make([]client.Stats, len(s.Tails))
+	if s.Proxy == nil {
+		return stats
+	}
+	pstats, endpoints, err := s.Proxy.Stats("segment")
+	if err != nil {
+		return stats
+	}
+	stats.Stats = clientStats(pstats)
+	for i, e := range s.endpoints() {
+		for _, es := range endpoints {
+			if es.Address == e.Address && es.Ns.Equal(e.Ns) {
+				stats.Tails[i] = clientStats(es.Stats)
+			}
+		}
+	}
+	return stats
+}
+
+// Info returns a copy of the segment state suitable for returning over rpc.
+func (s *Segment) Info() client.SegmentInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := client.SegmentInfo{
+		Id:        s.Id,
+		Head:      s.Head.Info(),
+		Balance:   s.balance,
+		Triggered: s.Triggered,
+	}
+	endpoints := s.endpoints()
+	for i, t := range s.Tails {
+		tinfo := t.Info()
+		if health, ok := s.balancer.Health(endpoints[i]); ok {
+			tinfo.Health = "unhealthy"
+			if health.Healthy {
+				tinfo.Health = "healthy"
+			}
+			tinfo.HealthError = health.LastError
+		}
+		info.Tails = append(info.Tails, tinfo)
+	}
+	info.Init = append(info.Init, s.Init...)
+	info.Trig = append(info.Trig, s.Trig...)
+	info.DockerIds = append(info.DockerIds, s.DockerIds...)
+	info.DockerIds = append(info.DockerIds, s.stopped...)
+	return info
+}
+
+// isTriggered returns true if the triggers of the segment have run.
+func (s *Segment) isTriggered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Triggered
+}
+
+func (s *Segment) cleanupChildren() {
+	for i := range s.Tails {
+		s.Tails[i].cleanupChild()
+	}
+}
+
+// Drain refuses new connections and waits up to timeout for the open ones
+// to finish. Connections still open after timeout are closed if force is
+// set, otherwise an error is returned and they are left open.
+func (s *Segment) Drain(timeout time.Duration, force bool) error {
+	// connections waiting for a trigger hold s.mu, so it is not held
+	// while draining
+	s.mu.Lock()
+	p := s.Proxy
+	s.mu.Unlock()
+	if p == nil || timeout <= 0 {
+		return nil
+	}
+	open, err := p.DrainProxy("segment", timeout, force)
+	if err != nil {
+		glog.Errorf("Error draining segment %s: %v", s.Id, err)
+	} else if open != 0 && force {
+		glog.Infof("Closed %d connections to segment %s", open, s.Id)
+	} else if open != 0 {
+		return fmt.Errorf("Segment %s still has %d open connections after %v", s.Id, open, timeout)
+	}
+	return nil
 }
 
+// Cleanup releases everything created for the segment. Triggers and scale
+// downs that run after it do nothing.
 func (s *Segment) Cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleted {
+		return
+	}
+	s.deleted = true
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
 	if s.Proxy != nil {
 		s.Proxy.StopProxy("segment")
 		s.Proxy = nil
 	}
-	if s.ChildId != "" {
-		if s.ChildHost == "" {
-			deleteSegment(s.ChildId)
-		} else {
-			c, err := client.NewClient(s.ChildHost, opts.config)
-			if err != nil {
-				glog.Errorf("Failed to connect to child host at %s: %v", s.ChildHost, err)
-			} else {
-				c.DeleteSegment(s.ChildId)
-			}
-		}
-	}
-	if len(s.DockerIds) != 0 {
-		args := []string{"rm", "-f"}
-		args = append(args, s.DockerIds...)
-		out, err := exec.Command("docker", args...).CombinedOutput()
+	s.balancer.Stop()
+	s.cleanupChildren()
+	for _, id := range append(s.DockerIds, s.stopped...) {
+		err := dockerClient.Remove(id, true)
 		if err != nil {
-			glog.Errorf("Error deleting docker container %v: %s", err, out)
+			glog.Errorf("Error deleting docker container %s: %v", id, err)
 		}
 	}
 	if s.Head.Ns.IsOpen() {
 		s.Head.Ns.Close()
 	}
-	if s.Tail.Ns.IsOpen() {
-		s.Tail.Ns.Close()
+	for _, t := range s.Tails {
+		if t.Ns.IsOpen() {
+			t.Ns.Close()
+		}
 	}
 }
 
+// How connections are balanced between tails by default.
+const defaultBalance = "round-robin"
+
 func NewSegment() *Segment {
-	return &Segment{Head: ConnectionInfo{Ns: netns.None()}, Tail: ConnectionInfo{Ns: netns.None()}}
+	s := &Segment{Head: ConnectionInfo{Ns: netns.None()}, balance: defaultBalance}
+	strategy, _ := proxy.NewStrategy(defaultBalance)
+	s.balancer = proxy.NewBalancer(strategy)
+	s.tail(0)
+	return s
 }
 
 func createSegment(id string, init []client.SegmentCommand, trig []client.SegmentCommand) (string, error) {
+	saved := &savedSegment{}
+	saved.Id = id
+	saved.Init = copyCommands(init)
+	saved.Trig = copyCommands(trig)
 	cinfo, err := createSegmentLocal(id, init, trig, nil)
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%s://%s:%d", cinfo.Proto, cinfo.Hostname, cinfo.Port), nil
+	saved.Url = cinfo.Info().String()
+	saveSegment(saved)
+	return saved.Url, nil
 }
 
 func createSegmentLocal(id string, init []client.SegmentCommand, trig []client.SegmentCommand, cinfo *ConnectionInfo) (*ConnectionInfo, error) {
@@ -134,33 +434,50 @@ func createSegmentLocal(id string, init []client.SegmentCommand, trig []client.S
 	}
 	glog.Infof("Creating segment %s", id)
 	s := NewSegment()
+	s.Id = id
 	if cinfo != nil {
 		s.Head = *cinfo
 	}
 	s.Init = init
 	s.Trig = trig
+	s.trigTemplate = copyCommands(trig)
 	err := s.Initialize()
 	if err != nil {
 		return nil, err
 	}
-	s.Proxy = proxy.NewProxier(s, s.Head.Hostname)
+	s.initTails = append([]Tail(nil), s.Tails...)
+	s.initDockers = len(s.DockerIds)
+	address := s.Head.Hostname
+	if s.Head.Proto == "unix" {
+		address = s.Head.address()
+	}
+	s.Proxy = proxy.NewProxier(s, address)
 	s.Proxy.SetNs(s.Head.Ns)
 	s.Head.Port, err = s.Proxy.AddService("segment", s.Head.Proto, s.Head.Port)
 	if err != nil {
 		return nil, err
 	}
+	s.startIdleWatch()
 	addSegment(id, s)
 	glog.Infof("Finished creating segment %s", id)
 	return &s.Head, nil
 }
 
-func deleteSegment(id string) error {
+func deleteSegment(id string, drain time.Duration, force bool) error {
 	glog.Infof("Deleting segment %s", id)
 	s := getSegment(id)
+	if s != nil {
+		err := s.Drain(drain, force)
+		if err != nil {
+			glog.Errorf("Failed to delete segment %s: %v", id, err)
+			return err
+		}
+	}
+	s = takeSegment(id)
 	if s != nil {
 		s.Cleanup()
 	}
-	removeSegment(id)
+	forgetSegment(id)
 	glog.Infof("Finished deleting segment %s", id)
 	return nil
 }
@@ -187,6 +504,18 @@ func executeCommands(commands *[]client.SegmentCommand, seg *Segment) error {
 			err = executeTunnel(&(*commands)[i], seg, true)
 		case client.URL:
 			err = executeUrl(&(*commands)[i], seg)
+		case client.READY:
+			err = executeReady(&(*commands)[i], seg)
+		case client.IDLE:
+			err = executeIdle(&(*commands)[i], seg)
+		case client.BALANCE:
+			err = executeBalance(&(*commands)[i], seg)
+		case client.WEIGHT:
+			err = executeWeight(&(*commands)[i], seg)
+		case client.AFFINITY:
+			err = executeAffinity(&(*commands)[i], seg)
+		case client.HEALTH:
+			err = executeHealth(&(*commands)[i], seg)
 		default:
 			err = fmt.Errorf("Command type %d recognized", (*commands)[i].Type)
 		}
@@ -208,6 +537,9 @@ func (s *Segment) Initialize() error {
 		s.Head.Proto = "tcp"
 	}
 	if s.Head.Hostname == "" {
+		if s.Head.Proto == "unix" {
+			return fmt.Errorf("Unix socket path is required")
+		}
 		s.Head.Hostname = "127.0.0.1"
 	}
 	return nil
@@ -243,45 +575,127 @@ func hostEqual(proto string, h1 string, h2 string) bool {
 }
 
 func (s *Segment) Trigger() error {
+	if s.deleted {
+		return fmt.Errorf("Segment %s was deleted", s.Id)
+	}
 	err := executeCommands(&s.Trig, s)
 	if err != nil {
 		return err
 	}
+	s.tail(0)
+	for i := range s.Tails {
+		err = s.tailDefaults(&s.Tails[i])
+		if err != nil {
+			return err
+		}
+	}
+	s.startIdleWatch()
+	// the policy is kept so triggers after an idle scale down wait too
+	if s.ready != nil && !s.Triggered {
+		err = s.ready.wait(s)
+		if err != nil {
+			return err
+		}
+	}
+	if !s.Triggered {
+		s.balancer.SetEndpoints(s.endpoints())
+	}
+	s.Triggered = true
+	return nil
+}
+
+// tailDefaults fills in the values of t that were not set by commands and
+// checks that t can be proxied to.
+func (s *Segment) tailDefaults(t *Tail) error {
 	// Tail proto defaults to Head proto if not set
-	if s.Tail.Proto == "" {
-		s.Tail.Proto = s.Head.Proto
+	if t.Proto == "" {
+		t.Proto = s.Head.Proto
+	}
+	if t.Proto == "unix" {
+		// Tail path defaults to Head path if not set
+		if t.Hostname == "" && s.Head.Proto == "unix" {
+			t.Hostname = s.Head.Hostname
+		}
+		if t.Hostname == "" {
+			return fmt.Errorf("Unix socket path is required")
+		}
 	}
-	if s.Tail.Hostname == "" {
-		s.Tail.Hostname = "127.0.0.1"
+	if t.Hostname == "" {
+		t.Hostname = "127.0.0.1"
 	}
 	// Tail port defaults to Head port if not set
-	if s.Tail.Port == 0 {
-		s.Tail.Port = s.Head.Port
+	if t.Port == 0 && t.Proto != "unix" {
+		t.Port = s.Head.Port
+	}
+	if (s.Head.Proto == "udp") != (t.Proto == "udp") {
+		return fmt.Errorf("Cannot proxy between %s and %s", s.Head.Proto, t.Proto)
 	}
-	host1 := net.JoinHostPort(s.Head.Hostname, strconv.Itoa(s.Head.Port))
-	host2 := net.JoinHostPort(s.Tail.Hostname, strconv.Itoa(s.Tail.Port))
+	host1 := s.Head.address()
+	host2 := t.address()
 
-	if hostEqual(s.Head.Proto, host1, host2) && s.Head.Ns.Equal(s.Tail.Ns) {
+	if s.Head.Proto == t.Proto && hostEqual(s.Head.Proto, host1, host2) &&
+		(s.Head.Proto == "unix" || s.Head.Ns.Equal(t.Ns)) {
 		return fmt.Errorf("Cannot proxy to self")
 	}
 	return nil
 }
 
+// endpoints returns the tails in the form used by the balancer.
+func (s *Segment) endpoints() []proxy.Endpoint {
+	endpoints := make([]proxy.Endpoint, 0, len(s.Tails))
+	for _, t := range s.Tails {
+		address := t.address()
+		if t.Proto == "unix" {
+			address = "unix://" + address
+		}
+		endpoints = append(endpoints, proxy.Endpoint{Ns: t.Ns, Address: address, Weight: t.Weight})
+	}
+	return endpoints
+}
+
 // NextEndpoint is an implementation of the loadbalancer interface for proxy.
 func (s *Segment) NextEndpoint(service string, srcAddr net.Addr) (netns.NsHandle, string, error) {
+	s.mu.Lock()
+	start := time.Now()
+	triggering := !s.Triggered
 	err := s.Trigger()
+	if triggering {
+		elapsed := time.Since(start)
+		s.statsMu.Lock()
+		s.triggers++
+		s.triggerTime += elapsed
+		if err != nil {
+			s.triggerErrors++
+		}
+		s.statsMu.Unlock()
+		triggerLatency.observe(elapsed)
+	}
+	s.mu.Unlock()
 	if err != nil {
 		return netns.None(), "", err
 	}
-	host := net.JoinHostPort(s.Tail.Hostname, strconv.Itoa(s.Tail.Port))
-	return s.Tail.Ns, host, nil
+	return s.balancer.NextEndpoint(service, srcAddr)
+}
+
+// ConnectionClosed is an implementation of the connection tracker
+// interface for proxy.
+func (s *Segment) ConnectionClosed(service string, ns netns.NsHandle, endpoint string) {
+	s.balancer.ConnectionClosed(service, ns, endpoint)
+}
+
+// NextEndpointExcluding is an implementation of the failover interface for
+// proxy. The triggers have already run for the first endpoint.
+func (s *Segment) NextEndpointExcluding(service string, srcAddr net.Addr, tried []proxy.Endpoint) (netns.NsHandle, string, error) {
+	return s.balancer.NextEndpointExcluding(service, srcAddr, tried)
+}
+
+// DialResult is an implementation of the dial tracker interface for proxy.
+func (s *Segment) DialResult(service string, ns netns.NsHandle, endpoint string, err error) {
+	s.balancer.DialResult(service, ns, endpoint, err)
 }
 
 func executeUrl(command *client.SegmentCommand, seg *Segment) error {
-	ci := &seg.Head
-	if command.Tail {
-		ci = &seg.Tail
-	}
+	ci := seg.target(command)
 	proto, ns, hostname, port, err := utils.ParseUrl(command.Arg)
 	if err != nil {
 		return err
@@ -306,44 +720,81 @@ func executeUrl(command *client.SegmentCommand, seg *Segment) error {
 }
 
 func executeDockerNs(command *client.SegmentCommand, seg *Segment) error {
-	ci := &seg.Head
-	if command.Tail {
-		ci = &seg.Tail
+	ci := seg.target(command)
+	container, err := dockerClient.Inspect(command.Arg)
+	if err != nil {
+		return err
 	}
-	var err error
-	ci.Ns, err = netns.GetFromDocker(command.Arg)
+	ci.Ns, err = netns.GetFromPid(container.State.Pid)
+	ci.Root = containerRoot(container.State.Pid)
 	return err
 }
 
+// containerRoot returns a path to the root filesystem of the container
+// running pid as seen from the host.
+func containerRoot(pid int) string {
+	return fmt.Sprintf("/proc/%d/root", pid)
+}
+
 func executeDockerRun(command *client.SegmentCommand, seg *Segment) error {
-	ci := &seg.Head
-	if command.Tail {
-		ci = &seg.Tail
-	}
-	args := strings.Fields(command.Arg)
-	// TODO: use the api here instead of shelling out
-	args = append([]string{"run", "-d"}, args...)
-	out, err := exec.Command("docker", args...).Output()
+	ci := seg.target(command)
+	runOpts, err := docker.ParseRun(command.Arg)
 	if err != nil {
 		return err
 	}
-	id := strings.TrimSpace(string(out))
+	if runOpts.Labels == nil {
+		runOpts.Labels = make(map[string]string)
+	}
+	runOpts.Labels[segmentLabel] = seg.Id
+	id := restartStopped(seg)
+	if id == "" {
+		id, err = dockerClient.Run(runOpts)
+		if err != nil {
+			return err
+		}
+	}
 	seg.DockerIds = append(seg.DockerIds, id)
 
-	ci.Ns, err = netns.GetFromDocker(id)
+	container, err := dockerClient.Inspect(id)
+	if err != nil {
+		return err
+	}
+	ci.Ns, err = netns.GetFromPid(container.State.Pid)
+	ci.Root = containerRoot(container.State.Pid)
 	return err
 }
 
+// restartStopped starts the next container stopped by an idle scale down
+// and returns its id. Triggers run in the same order every time, so it is
+// the container of the docker-run command being executed. An empty id is
+// returned if there is none or it could not be started.
+func restartStopped(seg *Segment) string {
+	if len(seg.stopped) == 0 {
+		return ""
+	}
+	id := seg.stopped[0]
+	seg.stopped = seg.stopped[1:]
+	err := dockerClient.Start(id)
+	if err != nil {
+		glog.Warningf("Failed to restart docker container %s, running a new one: %v", id, err)
+		dockerClient.Remove(id, true)
+		return ""
+	}
+	glog.Infof("Restarted docker container %s", id)
+	return id
+}
+
 func executeChild(command *client.SegmentCommand, seg *Segment, chain bool) error {
 	id := utils.Uuid()
-	cinfo, err := createSegmentLocal(id, command.ChildInit, command.ChildTrig, &seg.Tail)
+	t := seg.tail(command.TailIndex)
+	cinfo, err := createSegmentLocal(id, command.ChildInit, command.ChildTrig, &t.ConnectionInfo)
 	if err != nil {
 		return err
 	}
 	if chain {
-		seg.Tail = *cinfo
+		t.ConnectionInfo = *cinfo
 	}
-	seg.ChildId = id
+	t.ChildId = id
 	return nil
 }
 
@@ -363,23 +814,39 @@ func executeRemote(command *client.SegmentCommand, seg *Segment) error {
 	if err != nil {
 		return err
 	}
-	seg.Tail.Proto, _, seg.Tail.Hostname, seg.Tail.Port, err = utils.ParseUrl(url)
+	saveChild(id, command.Arg)
+	t := seg.tail(command.TailIndex)
+	t.Proto, _, t.Hostname, t.Port, err = utils.ParseUrl(url)
 	if err != nil {
 		return err
 	}
-	seg.ChildHost = command.Arg
-	seg.ChildId = id
+	t.ChildHost = command.Arg
+	t.ChildId = id
 	return nil
 }
 
+// tunnelArg splits the arg of a tunnel command into the host and the
+// driver, which is empty if the daemon default should be used.
+func tunnelArg(arg string) (string, string) {
+	parts := strings.Fields(arg)
+	if len(parts) == 0 {
+		return "", ""
+	}
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
 func executeTunnel(command *client.SegmentCommand, seg *Segment, udp bool) error {
-	_, dst, err := createTunnel(command.Arg, udp)
+	host, driver := tunnelArg(command.Arg)
+	_, dst, err := createTunnel(host, udp, driver)
 	if err != nil {
 		return err
 	}
 	urlCommand := client.SegmentCommand{Type: client.URL, Arg: dst.String()}
 	command.ChildInit = append(command.ChildInit, urlCommand)
-	c, err := client.NewClient(command.Arg, opts.config)
+	c, err := client.NewClient(host, opts.config)
 	if err != nil {
 		return err
 	}
@@ -388,11 +855,56 @@ func executeTunnel(command *client.SegmentCommand, seg *Segment, udp bool) error
 	if err != nil {
 		return err
 	}
-	seg.Tail.Proto, _, seg.Tail.Hostname, seg.Tail.Port, err = utils.ParseUrl(url)
+	saveChild(id, host)
+	t := seg.tail(command.TailIndex)
+	t.Proto, _, t.Hostname, t.Port, err = utils.ParseUrl(url)
+	if err != nil {
+		return err
+	}
+	t.ChildHost = host
+	t.ChildId = id
+	return nil
+}
+
+func executeBalance(command *client.SegmentCommand, seg *Segment) error {
+	strategy, err := proxy.NewStrategy(command.Arg)
+	if err != nil {
+		return err
+	}
+	seg.balancer.SetStrategy(strategy)
+	seg.balance = command.Arg
+	return nil
+}
+
+func executeWeight(command *client.SegmentCommand, seg *Segment) error {
+	if !command.Tail {
+		return fmt.Errorf("Weight can only be set on a tail")
+	}
+	weight, err := strconv.Atoi(command.Arg)
+	if err != nil {
+		return err
+	}
+	if weight <= 0 {
+		return fmt.Errorf("Weight must be positive: %s", command.Arg)
+	}
+	seg.tail(command.TailIndex).Weight = weight
+	return nil
+}
+
+func executeAffinity(command *client.SegmentCommand, seg *Segment) error {
+	ttl, err := time.ParseDuration(command.Arg)
+	if err != nil {
+		return err
+	}
+	seg.balancer.SetAffinity(ttl)
+	return nil
+}
+
+func executeHealth(command *client.SegmentCommand, seg *Segment) error {
+	check, err := proxy.ParseHealthCheck(command.Arg)
 	if err != nil {
 		return err
 	}
-	seg.ChildHost = command.Arg
-	seg.ChildId = id
+	seg.balancer.SetHealthCheck(check)
 	return nil
 }
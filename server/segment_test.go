@@ -1,6 +1,14 @@
 package server
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/vishvananda/wormhole/client"
 	"testing"
 )
@@ -18,7 +26,7 @@ func TestInitializeModifyTail(t *testing.T) {
 	seg := Segment{}
 	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1", Tail: true})
 	seg.Initialize()
-	if seg.Tail.Port != 1 {
+	if seg.Tails[0].Port != 1 {
 		t.Fatal("Command did not modify value")
 	}
 }
@@ -41,3 +49,314 @@ func TestInitializeEmpties(t *testing.T) {
 		t.Fatal("Initialize commands still in queue")
 	}
 }
+
+func TestInfoTriggered(t *testing.T) {
+	seg := NewSegment()
+	seg.Id = "foo"
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1"})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: ":2", Tail: true})
+	seg.Initialize()
+	info := seg.Info()
+	if info.Id != "foo" || info.Head.Port != 1 {
+		t.Fatalf("Info does not match segment: %v", info)
+	}
+	if info.Triggered || len(info.Trig) != 1 {
+		t.Fatal("Segment reported as triggered before Trigger")
+	}
+	err := seg.Trigger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = seg.Info()
+	if !info.Triggered || len(info.Trig) != 0 || info.Tails[0].Port != 2 {
+		t.Fatalf("Info not updated after Trigger: %v", info)
+	}
+}
+
+func TestCleanupStopsTrigger(t *testing.T) {
+	seg := NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1"})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: ":2", Tail: true})
+	seg.Initialize()
+	seg.Cleanup()
+	if seg.Trigger() == nil {
+		t.Fatal("Trigger succeeded after Cleanup")
+	}
+	if seg.Triggered || len(seg.Trig) != 1 {
+		t.Fatalf("Trigger ran commands after Cleanup: %v", seg)
+	}
+	// a second cleanup does nothing
+	seg.Cleanup()
+}
+
+func TestNextEndpointConcurrent(t *testing.T) {
+	seg := NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1"})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: ":2", Tail: true})
+	seg.Initialize()
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, host, err := seg.NextEndpoint("segment", nil)
+			if err == nil && host != "127.0.0.1:2" {
+				err = fmt.Errorf("Unexpected endpoint %s", host)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnixHead(t *testing.T) {
+	initSegments()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "head.sock")
+
+	init := []client.SegmentCommand{{Type: client.URL, Arg: "unix://" + path}}
+	trig := []client.SegmentCommand{{Type: client.URL, Arg: "tcp://" + l.Addr().String(), Tail: true}}
+	cinfo, err := createSegmentLocal("unix", init, trig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeSegment("unix")
+	defer getSegment("unix").Cleanup()
+	if cinfo.Info().String() != "unix://"+path {
+		t.Fatalf("Unexpected head: %v", cinfo.Info())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "foo" {
+		t.Fatalf("Echo through unix head failed: %q %v", buf, err)
+	}
+}
+
+func TestUnixTailDefaults(t *testing.T) {
+	seg := NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: "unix:///run/foo.sock"})
+	seg.Initialize()
+	seg.Tails[0].Root = "/proc/1/root"
+	err := seg.Trigger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, host, _ := seg.NextEndpoint("segment", nil)
+	if host != "unix:///proc/1/root/run/foo.sock" {
+		t.Fatalf("Unexpected endpoint %s", host)
+	}
+
+	seg = NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: "unix:///run/foo.sock"})
+	seg.Initialize()
+	if seg.Trigger() == nil {
+		t.Fatal("Proxy to self not detected")
+	}
+
+	seg = NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: "udp://:53"})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: "unix:///run/foo.sock", Tail: true})
+	seg.Initialize()
+	if seg.Trigger() == nil {
+		t.Fatal("Proxy from udp to unix not rejected")
+	}
+}
+
+func TestNextEndpointTails(t *testing.T) {
+	seg := NewSegment()
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":1"})
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.BALANCE, Arg: "weighted"})
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.URL, Arg: ":2", Tail: true})
+	seg.Init = append(seg.Init, client.SegmentCommand{Type: client.WEIGHT, Arg: "2", Tail: true})
+	seg.Trig = append(seg.Trig, client.SegmentCommand{Type: client.URL, Arg: ":3", Tail: true, TailIndex: 1})
+	err := seg.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		_, host, err := seg.NextEndpoint("segment", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts[host]++
+	}
+	if hosts["127.0.0.1:2"] != 4 || hosts["127.0.0.1:3"] != 2 {
+		t.Fatalf("Connections not balanced by weight: %v", hosts)
+	}
+	info := seg.Info()
+	if len(info.Tails) != 2 || info.Tails[0].Weight != 2 || info.Balance != "weighted" {
+		t.Fatalf("Unexpected info: %v", info)
+	}
+}
+
+// echoSegment creates a segment from a unix socket in a temporary directory
+// to a tcp echo server. The returned function removes both.
+func echoSegment(t *testing.T, id string) (*Segment, string, func()) {
+	initSegments()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "head.sock")
+
+	init := []client.SegmentCommand{{Type: client.URL, Arg: "unix://" + path}}
+	trig := []client.SegmentCommand{{Type: client.URL, Arg: "tcp://" + l.Addr().String(), Tail: true}}
+	_, err = createSegmentLocal(id, init, trig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := getSegment(id)
+	return s, path, func() {
+		s.Cleanup()
+		removeSegment(id)
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSegmentDrain(t *testing.T) {
+	s, path, cleanup := echoSegment(t, "drain")
+	defer cleanup()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Drain(50*time.Millisecond, false)
+	if err == nil {
+		t.Fatal("Drain without force succeeded with an open connection")
+	}
+	_, err = conn.Write([]byte("foo"))
+	if err == nil {
+		_, err = io.ReadFull(conn, buf)
+	}
+	if err != nil {
+		t.Fatalf("Drain without force closed the connection: %v", err)
+	}
+
+	start := time.Now()
+	err = s.Drain(100*time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("Drain returned before the timeout with an open connection")
+	}
+	_, err = net.Dial("unix", path)
+	if err == nil {
+		t.Fatal("Drained segment accepted a new connection")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(buf)
+	if err == nil {
+		t.Fatal("Connection still open after drain")
+	}
+}
+
+func TestSegmentStats(t *testing.T) {
+	s, path, cleanup := echoSegment(t, "stats")
+	defer cleanup()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bytes are counted after they have been written
+	stats := s.Stats()
+	for i := 0; i < 50 && stats.Tails[0].BytesOut != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats = s.Stats()
+	}
+	if stats.Triggers != 1 || stats.Accepted != 1 || stats.Active != 1 {
+		t.Fatalf("Unexpected segment stats: %+v", stats)
+	}
+	if len(stats.Tails) != 1 || stats.Tails[0].BytesOut != 3 || stats.Tails[0].Dials != 1 {
+		t.Fatalf("Unexpected tail stats: %+v", stats.Tails)
+	}
+	conn.Close()
+}
+
+func TestTunnelArg(t *testing.T) {
+	tests := []struct {
+		arg    string
+		host   string
+		driver string
+	}{
+		{"tcp://foo:9999", "tcp://foo:9999", ""},
+		{"tcp://foo:9999 wireguard", "tcp://foo:9999", client.DriverWireguard},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		host, driver := tunnelArg(test.arg)
+		if host != test.host || driver != test.driver {
+			t.Fatalf("Incorrect split of %q: %q, %q", test.arg, host, driver)
+		}
+	}
+}
@@ -48,17 +48,35 @@ func Main() {
 	signal.Notify(csig, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 	go func() {
 		<-csig
-		cleanupSegments()
+		cleanupSegments(opts.drain)
 		cleanupTunnels()
+		shutdownHTTP()
+		shutdownMetrics()
 		shutdownAPI()
 		os.Exit(0)
 	}()
 
+	initState()
+
 	initTunnels()
 	defer cleanupTunnels()
+	if opts.rekeyTime > 0 || opts.rekeyBytes > 0 {
+		go rekeys()
+	}
+	if opts.tunnelCheck > 0 {
+		go monitorTunnels()
+	}
 
+	initDocker()
 	initSegments()
-	defer cleanupSegments()
+	defer cleanupSegments(opts.drain)
+	go restoreSegments()
 
+	if opts.httpHost != "" {
+		go serveHTTP()
+	}
+	if opts.metricsHost != "" {
+		go serveMetrics()
+	}
 	serveAPI()
 }
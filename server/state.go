@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/wormhole/client"
+	"github.com/vishvananda/wormhole/utils"
+)
+
+// savedSegment records the arguments a segment was created with along
+// with the url it was given so it can be recreated on the same port.
+type savedSegment struct {
+	client.CreateSegmentArgs
+	Url string `json:"url"`
+}
+
+// savedState is the content of the state file. Children maps the ids of
+// child segments created on other hosts to those hosts.
+type savedState struct {
+	Segments map[string]*savedSegment  `json:"segments"`
+	Tunnels  map[string]*client.Tunnel `json:"tunnels"`
+	Children map[string]string         `json:"children,omitempty"`
+}
+
+var storeMutex sync.Mutex
+var store *savedState
+
+func stateEnabled() bool {
+	return opts.stateFile != ""
+}
+
+// ipamFile returns where the overlay ip allocations are kept, next to the
+// state file.
+func ipamFile() string {
+	if !stateEnabled() {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(opts.stateFile), "ipam.json")
+}
+
+func initState() {
+	store = &savedState{
+		Segments: make(map[string]*savedSegment),
+		Tunnels:  make(map[string]*client.Tunnel),
+		Children: make(map[string]string),
+	}
+	if !stateEnabled() {
+		return
+	}
+	err := loadState(opts.stateFile, store)
+	if err != nil {
+		glog.Errorf("Failed to load state from %s: %v", opts.stateFile, err)
+	}
+}
+
+func loadState(path string, s *savedState) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, s)
+}
+
+// writeState atomically replaces the state file at path.
+func writeState(path string, s *savedState) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistState must be called with storeMutex held.
+func persistState() {
+	if !stateEnabled() {
+		return
+	}
+	err := writeState(opts.stateFile, store)
+	if err != nil {
+		glog.Errorf("Failed to write state to %s: %v", opts.stateFile, err)
+	}
+}
+
+func saveSegment(saved *savedSegment) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	store.Segments[saved.Id] = saved
+	persistState()
+}
+
+func forgetSegment(id string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if _, ok := store.Segments[id]; !ok {
+		return
+	}
+	delete(store.Segments, id)
+	persistState()
+}
+
+func saveTunnel(key string, tunnel *client.Tunnel) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	store.Tunnels[key] = tunnel
+	persistState()
+}
+
+func forgetTunnel(key string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if _, ok := store.Tunnels[key]; !ok {
+		return
+	}
+	delete(store.Tunnels, key)
+	persistState()
+}
+
+func saveChild(id string, host string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store.Children == nil {
+		store.Children = make(map[string]string)
+	}
+	store.Children[id] = host
+	persistState()
+}
+
+func forgetChild(id string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if _, ok := store.Children[id]; !ok {
+		return
+	}
+	delete(store.Children, id)
+	persistState()
+}
+
+func savedChildren() map[string]string {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	result := make(map[string]string, len(store.Children))
+	for id, host := range store.Children {
+		result[id] = host
+	}
+	return result
+}
+
+func savedSegments() []*savedSegment {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	result := make([]*savedSegment, 0, len(store.Segments))
+	for _, saved := range store.Segments {
+		result = append(result, saved)
+	}
+	return result
+}
+
+func savedTunnels() map[string]*client.Tunnel {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	result := make(map[string]*client.Tunnel, len(store.Tunnels))
+	for key, tunnel := range store.Tunnels {
+		t := *tunnel
+		result[key] = &t
+	}
+	return result
+}
+
+// copyCommands makes a deep copy of commands. Executing commands modifies
+// them in place so a copy is needed to record the original request.
+func copyCommands(commands []client.SegmentCommand) []client.SegmentCommand {
+	if commands == nil {
+		return nil
+	}
+	result := make([]client.SegmentCommand, len(commands))
+	for i, c := range commands {
+		result[i] = c
+		result[i].ChildInit = copyCommands(c.ChildInit)
+		result[i].ChildTrig = copyCommands(c.ChildTrig)
+	}
+	return result
+}
+
+// restoreSegments recreates the saved segments with the same ids. An extra
+// url command pins each segment to the port it was originally given.
+func restoreSegments() {
+	deleteSavedChildren()
+	for _, saved := range savedSegments() {
+		glog.Infof("Restoring segment %s", saved.Id)
+		init := copyCommands(saved.Init)
+		_, _, _, port, err := utils.ParseUrl(saved.Url)
+		if err == nil && port != 0 {
+			pin := client.SegmentCommand{Type: client.URL, Arg: fmt.Sprintf(":%d", port)}
+			init = append(init, pin)
+		}
+		_, err = createSegmentLocal(saved.Id, init, copyCommands(saved.Trig), nil)
+		if err != nil {
+			glog.Errorf("Failed to restore segment %s: %v", saved.Id, err)
+		}
+	}
+}
+
+// deleteSavedChildren deletes the child segments that were created on other
+// hosts before the restart. The peers restore them from their own state
+// files, so they would leak when the segments here create new children.
+// Children that cannot be deleted are kept to be retried on the next start.
+func deleteSavedChildren() {
+	for id, host := range savedChildren() {
+		glog.Infof("Deleting child segment %s on %s", id, host)
+		c, err := client.NewClient(host, opts.config)
+		if err != nil {
+			glog.Errorf("Failed to connect to child host at %s: %v", host, err)
+			continue
+		}
+		err = c.DeleteSegment(id, 0, true)
+		c.Close()
+		if err != nil {
+			glog.Errorf("Failed to delete child segment %s on %s: %v", id, host, err)
+			continue
+		}
+		forgetChild(id)
+	}
+}
+
+// restoreTunnels rebuilds the saved tunnels. Kernel state that survived the
+// restart is left in place and missing pieces are recreated.
+func restoreTunnels() {
+	glog.Infof("Restoring saved tunnels")
+	for key, tunnel := range savedTunnels() {
+		dst := net.ParseIP(key)
+		if dst == nil {
+			glog.Warningf("Invalid key for saved tunnel: %s", key)
+			continue
+		}
+		err := overlayIPs.Reserve(key, tunnel.Src, tunnel.Dst)
+		if err != nil {
+			glog.Warningf("Duplicate tunnel ips detected: %v", err)
+		}
+		if tunnel.SrcPort != 0 {
+			reservePort(tunnel.SrcPort)
+		}
+		_, _, err = buildTunnelLocal(dst, tunnel)
+		if err != nil {
+			glog.Errorf("Failed to restore tunnel to %s: %v", key, err)
+			continue
+		}
+		retireStale(dst, tunnel)
+		glog.Infof("Restored tunnel between %v and %v over %v", tunnel.Src, tunnel.Dst, dst)
+	}
+	glog.Infof("Finished restoring saved tunnels")
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "state.json")
+
+	s := &savedState{
+		Segments: make(map[string]*savedSegment),
+		Tunnels:  make(map[string]*client.Tunnel),
+		Children: map[string]string{"baz": "tcp://10.0.0.2:9999"},
+	}
+	saved := &savedSegment{Url: "tcp://127.0.0.1:40"}
+	saved.Id = "foo"
+	saved.Init = []client.SegmentCommand{{Type: client.REMOTE, Arg: "bar", ChildInit: []client.SegmentCommand{{Type: client.URL, Arg: ":1"}}}}
+	s.Segments["foo"] = saved
+	s.Tunnels["10.0.0.1"] = &client.Tunnel{Reqid: 5, AuthKey: []byte{1, 2}, EncKey: []byte{3, 4}, Src: net.ParseIP("100.65.0.1"), Dst: net.ParseIP("100.65.0.2")}
+	err = writeState(path, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &savedState{}
+	err = loadState(path, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := loaded.Segments["foo"]
+	if seg == nil || seg.Url != saved.Url || len(seg.Init) != 1 || len(seg.Init[0].ChildInit) != 1 {
+		t.Fatalf("Segment did not survive round trip: %v", seg)
+	}
+	tunnel := loaded.Tunnels["10.0.0.1"]
+	if tunnel == nil || !tunnel.Equal(s.Tunnels["10.0.0.1"]) {
+		t.Fatalf("Tunnel did not survive round trip: %v", tunnel)
+	}
+	if loaded.Children["baz"] != "tcp://10.0.0.2:9999" {
+		t.Fatalf("Children did not survive round trip: %v", loaded.Children)
+	}
+}
+
+type deleteRecorder struct {
+	deleted []string
+}
+
+func (d *deleteRecorder) DeleteSegment(args *client.DeleteSegmentArgs, reply *client.DeleteSegmentReply) error {
+	d.deleted = append(d.deleted, args.Id)
+	return nil
+}
+
+func TestDeleteSavedChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	recorder := &deleteRecorder{}
+	server := rpc.NewServer()
+	server.RegisterName("Api", recorder)
+	go server.Accept(l)
+
+	saved := opts
+	defer func() { opts = saved }()
+	opts = &options{}
+	store = &savedState{Children: map[string]string{
+		"foo": "unix://" + path,
+		"bar": "unix://" + filepath.Join(dir, "missing.sock"),
+	}}
+	deleteSavedChildren()
+	if len(recorder.deleted) != 1 || recorder.deleted[0] != "foo" {
+		t.Fatalf("Unexpected deletes: %v", recorder.deleted)
+	}
+	children := savedChildren()
+	if len(children) != 1 || children["bar"] == "" {
+		t.Fatalf("Only the unreachable child should be kept: %v", children)
+	}
+}
+
+func TestLoadStateMissing(t *testing.T) {
+	s := &savedState{}
+	err := loadState("/nonexistent/wormhole/state.json", s)
+	if err != nil {
+		t.Fatalf("Missing state file should not be an error: %v", err)
+	}
+}
+
+func TestCopyCommands(t *testing.T) {
+	orig := []client.SegmentCommand{{Type: client.TUNNEL, Arg: "foo"}}
+	c := copyCommands(orig)
+	c[0].ChildInit = append(c[0].ChildInit, client.SegmentCommand{Type: client.URL})
+	if len(orig[0].ChildInit) != 0 {
+		t.Fatal("Modifying copy modified original")
+	}
+}
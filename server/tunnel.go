@@ -3,49 +3,95 @@ package server
 import (
 	"crypto/rand"
 	"fmt"
+	"log"
 	"math/big"
 	"net"
+	"sort"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/wormhole/client"
-	"github.com/vishvananda/wormhole/pkg/netaddr"
+	"github.com/vishvananda/wormhole/pkg/ipam"
 )
 
 var tunnelsMutex sync.Mutex
 var tunnels map[string]*client.Tunnel
 var listeners map[string]int
 
-var usedIPsMutex sync.Mutex
-var usedIPs map[string]bool
+// discovered holds the keys of tunnels that were found in the kernel when
+// wormholed started instead of being created by it.
+var discovered map[string]bool
+
+// liveness holds the status of each tunnel that has been checked.
+var liveness map[string]*tunnelLiveness
+
+// overlayIPs holds the overlay ips of every tunnel by peer.
+var overlayIPs *ipam.Allocator
 
 var unusedPortsMutex sync.Mutex
 var unusedPorts []int
 
-type IPInUse error
 type NoPortsAvailable error
 
 func initTunnels() {
 	tunnels = make(map[string]*client.Tunnel)
 	listeners = make(map[string]int)
-	usedIPs = make(map[string]bool)
+	discovered = make(map[string]bool)
+	liveness = make(map[string]*tunnelLiveness)
+	var err error
+	overlayIPs, err = ipam.New(opts.cidr, ipamFile())
+	if err != nil {
+		log.Fatalf("Failed to load overlay ip allocations: %v", err)
+	}
+	for host, first := range opts.pins {
+		err = overlayIPs.Pin(host, first)
+		if err != nil {
+			log.Fatalf("Failed to pin overlay ips: %v", err)
+		}
+	}
 	for p := opts.udpStartPort; p <= opts.udpEndPort; p++ {
 		unusedPorts = append(unusedPorts, p)
 	}
-	discoverTunnels()
+	if stateEnabled() {
+		restoreTunnels()
+	} else {
+		discoverTunnels()
+	}
 }
 
 func cleanupTunnels() {
 	// Currently we leave tunnels in place
 }
 
-func addTunnel(key string, tunnel *client.Tunnel, listener int) {
+func addTunnel(key string, tunnel *client.Tunnel, listener int, found bool) {
 	tunnelsMutex.Lock()
 	defer tunnelsMutex.Unlock()
 	tunnels[key] = tunnel
 	listeners[key] = listener
+	if found {
+		discovered[key] = true
+	} else {
+		delete(discovered, key)
+	}
+	saveTunnel(key, tunnel)
+}
+
+// updateTunnel replaces the tunnel for key after it has been rekeyed.
+func updateTunnel(key string, tunnel *client.Tunnel) {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	tunnels[key] = tunnel
+	saveTunnel(key, tunnel)
+}
+
+// setListener records the udp encapsulation socket of the tunnel for key.
+func setListener(key string, socket int) {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	listeners[key] = socket
 }
 
 func getTunnel(key string) *client.Tunnel {
@@ -61,25 +107,43 @@ func removeTunnel(key string) {
 	defer tunnelsMutex.Unlock()
 	delete(tunnels, key)
 	delete(listeners, key)
+	delete(discovered, key)
+	delete(liveness, key)
+	forgetTunnel(key)
 }
 
-func reserveIP(ip net.IP) error {
-	usedIPsMutex.Lock()
-	defer usedIPsMutex.Unlock()
-	ipStr := ip.String()
-	exists := usedIPs[ipStr]
-	if exists {
-		return IPInUse(fmt.Errorf("IP %s is in use", ip))
+// listTunnels describes every tunnel ordered by host. Keys are left out
+// unless keys is set.
+func listTunnels(keys bool) []client.TunnelInfo {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	infos := make([]client.TunnelInfo, 0, len(tunnels))
+	for key, tunnel := range tunnels {
+		l := getLiveness(key)
+		info := client.TunnelInfo{
+			Host:       key,
+			Tunnel:     *tunnel,
+			Discovered: discovered[key],
+			Status:     l.status,
+			StatusTime: l.since,
+			Rebuilds:   l.rebuilds,
+		}
+		if !keys {
+			info.AuthKey = nil
+			info.EncKey = nil
+			info.PrivateKey = nil
+		}
+		infos = append(infos, info)
 	}
-	usedIPs[ipStr] = true
-	return nil
+	sort.Sort(byHost(infos))
+	return infos
 }
 
-func unreserveIP(ip net.IP) {
-	usedIPsMutex.Lock()
-	defer usedIPsMutex.Unlock()
-	delete(usedIPs, ip.String())
-}
+type byHost []client.TunnelInfo
+
+func (a byHost) Len() int           { return len(a) }
+func (a byHost) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byHost) Less(i, j int) bool { return a[i].Host < a[j].Host }
 
 func allocatePort() (int, error) {
 	unusedPortsMutex.Lock()
@@ -93,6 +157,18 @@ func allocatePort() (int, error) {
 	return port, nil
 }
 
+// reservePort removes a specific port from the unused ports.
+func reservePort(port int) {
+	unusedPortsMutex.Lock()
+	defer unusedPortsMutex.Unlock()
+	for i, p := range unusedPorts {
+		if p == port {
+			unusedPorts = append(unusedPorts[:i], unusedPorts[i+1:]...)
+			return
+		}
+	}
+}
+
 func releasePort(port int) {
 	unusedPortsMutex.Lock()
 	defer unusedPortsMutex.Unlock()
@@ -126,14 +202,17 @@ func discoverTunnels() {
 		glog.Errorf("Failed to get xfrm states: %v", err)
 		return
 	}
+	// states replaced by a rekey may still be around so the newest state
+	// of each tunnel is used
+	counters, err := xfrmCounters()
+	if err != nil {
+		glog.Warningf("Failed to get xfrm state times: %v", err)
+	}
+	newestFirst(states, counters)
 	for _, addr := range addrs {
 		if opts.cidr.Contains(addr.IP) {
 			tunnel := client.Tunnel{}
 			tunnel.Src = addr.IP
-			err := reserveIP(tunnel.Src)
-			if err != nil {
-				glog.Warningf("Duplicate tunnel ip detected: %v", tunnel.Src)
-			}
 			tunnel.Dst = nil
 			glog.Infof("Potential tunnel found from %s", tunnel.Src)
 			for _, route := range routes {
@@ -147,10 +226,6 @@ func discoverTunnels() {
 				glog.Warningf("could not find dst for tunnel src %s", tunnel.Src)
 				continue
 			}
-			err = reserveIP(tunnel.Dst)
-			if err != nil {
-				glog.Warningf("Duplicate tunnel ip detected: %v", tunnel.Dst)
-			}
 			var dst net.IP
 			for _, policy := range policies {
 				if !policy.Dst.IP.Equal(tunnel.Dst) {
@@ -167,34 +242,36 @@ func discoverTunnels() {
 				glog.Warningf("could not find ip for tunnel between %s and %s", tunnel.Src, tunnel.Dst)
 				continue
 			}
+			err := overlayIPs.Reserve(dst.String(), tunnel.Src, tunnel.Dst)
+			if err != nil {
+				glog.Warningf("Duplicate tunnel ips detected: %v", err)
+			}
 			for _, state := range states {
 				if !state.Dst.Equal(dst) {
 					continue
 				}
 				tunnel.Reqid = state.Reqid
-				if state.Auth == nil {
-					glog.Warningf("Tunnel state has no associated authentication entry")
-					continue
-				}
-				tunnel.AuthKey = state.Auth.Key
-				if state.Crypt == nil {
-					glog.Warningf("Tunnel state has no associated encryption entry")
+				tunnel.Spi = state.Spi
+				tunnel.KeyTime = time.Now()
+				tunnel.Cipher, tunnel.AuthKey, tunnel.EncKey, err = stateCipher(&state)
+				if err != nil {
+					glog.Warningf("%v", err)
 					continue
 				}
-				tunnel.EncKey = state.Crypt.Key
 				if state.Encap != nil {
 					tunnel.SrcPort = state.Encap.SrcPort
-					tunnel.SrcPort = state.Encap.DstPort
+					tunnel.DstPort = state.Encap.DstPort
 				}
 				glog.Infof("Discovered tunnel between %v and %v over %v", tunnel.Src, tunnel.Dst, dst)
 				var socket int
 				if tunnel.SrcPort != 0 {
-					socket, err = createEncapListener(tunnel.Src, tunnel.SrcPort)
+					socket, err = createEncapListener(opts.src, tunnel.SrcPort)
 					if err != nil {
 						glog.Warningf("Failed to create udp listener: %v", err)
 					}
 				}
-				addTunnel(dst.String(), &tunnel, socket)
+				addTunnel(dst.String(), &tunnel, socket, true)
+				retireStale(dst, &tunnel)
 				break
 			}
 		}
@@ -233,18 +310,6 @@ func getSrcIP(dst net.IP) (net.IP, error) {
 	}
 }
 
-func randomIPPair(cidr *net.IPNet) (first net.IP, second net.IP, err error) {
-	ones, total := cidr.Mask.Size()
-	max := int64((1 << uint64(total-ones-1)))
-	value, err := rand.Int(rand.Reader, big.NewInt(max))
-	if err != nil {
-		return
-	}
-	first = netaddr.IPAdd(cidr.IP, value.Uint64()*2+1)
-	second = netaddr.IPAdd(first, 1)
-	return
-}
-
 func randomKey() []byte {
 	value := make([]byte, 32)
 	rand.Read(value)
@@ -256,7 +321,34 @@ func getUnusedPort() int {
 	return 4500
 }
 
-func createTunnel(host string, udp bool) (net.IP, net.IP, error) {
+// publicTunnel returns a copy of tunnel without its private key.
+func publicTunnel(tunnel *client.Tunnel) *client.Tunnel {
+	public := *tunnel
+	public.PrivateKey = nil
+	return &public
+}
+
+// reverseTunnel returns tunnel as the peer sees it, without the private key.
+func reverseTunnel(tunnel *client.Tunnel) *client.Tunnel {
+	reversed := publicTunnel(tunnel)
+	reversed.Src, reversed.Dst = tunnel.Dst, tunnel.Src
+	reversed.SrcPort, reversed.DstPort = tunnel.DstPort, tunnel.SrcPort
+	reversed.PublicKey, reversed.PeerKey = tunnel.PeerKey, tunnel.PublicKey
+	return reversed
+}
+
+func createTunnel(host string, udp bool, driverName string) (net.IP, net.IP, error) {
+	if driverName == "" {
+		driverName = opts.driver
+	}
+	driver, err := getDriver(driverName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if driverName == client.DriverXfrm {
+		driverName = ""
+	}
+
 	c, err := client.NewClient(host, opts.config)
 	if err != nil {
 		return nil, nil, err
@@ -266,20 +358,20 @@ func createTunnel(host string, udp bool) (net.IP, net.IP, error) {
 	dst, err := c.GetSrcIP(nil)
 
 	tunnel := &client.Tunnel{}
+	// the private key of this end is never sent to the remote
+	var privateKey []byte
 
 	exists := getTunnel(dst.String())
 	if exists != nil {
 		glog.Infof("Tunnel already exists: %v, %v", exists.Src, exists.Dst)
 		// tunnel dst and src are reversed from remote
-		tunnel.Reqid = exists.Reqid
-		tunnel.Src = exists.Dst
-		tunnel.Dst = exists.Src
-		tunnel.AuthKey = exists.AuthKey
-		tunnel.EncKey = exists.EncKey
-		tunnel.SrcPort = exists.DstPort
-		tunnel.SrcPort = exists.SrcPort
+		tunnel = reverseTunnel(exists)
+		if exists.DriverName() == client.DriverXfrm {
+			tunnel.Cipher = exists.CipherName()
+		}
+		privateKey = exists.PrivateKey
 	} else {
-		tunnel = &client.Tunnel{}
+		tunnel = &client.Tunnel{Driver: driverName}
 		if udp {
 			var err error
 			tunnel.DstPort, err = allocatePort()
@@ -290,8 +382,12 @@ func createTunnel(host string, udp bool) (net.IP, net.IP, error) {
 			glog.Infof("Using %d for encap port", tunnel.DstPort)
 		}
 
-		tunnel.AuthKey = randomKey()
-		tunnel.EncKey = randomKey()
+		err = driver.offer(tunnel)
+		if err != nil {
+			glog.Errorf("Failed to offer tunnel: %v", err)
+			return nil, nil, err
+		}
+		privateKey, tunnel.PrivateKey = tunnel.PrivateKey, nil
 		// random number between 1 and 2^32
 		bigreq, err := rand.Int(rand.Reader, big.NewInt(int64(^uint32(0))))
 		if err != nil {
@@ -301,41 +397,30 @@ func createTunnel(host string, udp bool) (net.IP, net.IP, error) {
 		tunnel.Reqid = int(bigreq.Int64()) + 1
 	}
 
+	key := dst.String()
+	// pairs that the remote already uses
+	conflicts := make([]ipam.Pair, 0)
 	// While tail not created
 	for {
 		if tunnel.Src == nil {
-			// Select random pair of addresses from cidr
-			for {
-				tunnel.Dst, tunnel.Src, err = randomIPPair(opts.cidr)
-				if err != nil {
-					return nil, nil, err
-				}
-				err = reserveIP(tunnel.Dst)
-				if err != nil {
-					glog.Infof("IP in use: %v", tunnel.Dst)
-					continue
-				}
-				err = reserveIP(tunnel.Src)
-				if err != nil {
-					unreserveIP(tunnel.Dst)
-					glog.Infof("IP in use: %v", tunnel.Src)
-					continue
-				}
-				break
+			pair, err := overlayIPs.Allocate(key, conflicts...)
+			if err != nil {
+				glog.Errorf("Failed to allocate tunnel ips: %v", err)
+				return nil, nil, err
 			}
+			tunnel.Dst, tunnel.Src = pair.First, pair.Second
 		}
 		// create tail of tunnel
 		var out *client.Tunnel
-		dst, out, err = c.BuildTunnel(opts.external, tunnel)
+		dst, out, err = c.BuildTunnel(opts.external, tunnel, opts.ciphers)
 		if err != nil {
-			_, ok := err.(IPInUse)
-			if ok {
-				unreserveIP(tunnel.Dst)
-				unreserveIP(tunnel.Src)
+			if ipam.IsInUse(err) {
+				glog.Infof("Remote ip conflict: %v", err)
+				conflicts = append(conflicts, ipam.NewPair(tunnel.Dst, tunnel.Src))
 				tunnel.Src = nil
 				if exists != nil {
 					glog.Warningf("Destroying local tunnel due to remote ip conflict")
-					destroyTunnel(dst)
+					destroyTunnel(net.ParseIP(key))
 					exists = nil
 				}
 				continue
@@ -343,8 +428,20 @@ func createTunnel(host string, udp bool) (net.IP, net.IP, error) {
 			glog.Errorf("Remote BuildTunnel failed: %v", err)
 			// cleanup partial tunnel
 			c.DestroyTunnel(opts.external)
+			if exists == nil {
+				overlayIPs.Release(key)
+			}
 			return nil, nil, err
 		}
+		if out.DriverName() != tunnel.DriverName() {
+			// older peers ignore the driver and build an xfrm tunnel
+			glog.Errorf("Remote built a %s tunnel instead of %s", out.DriverName(), tunnel.DriverName())
+			c.DestroyTunnel(opts.external)
+			if exists == nil {
+				overlayIPs.Release(key)
+			}
+			return nil, nil, fmt.Errorf("Remote does not support the %s driver", tunnel.DriverName())
+		}
 		if exists != nil && !out.Equal(tunnel) {
 			glog.Warningf("Destroying remote mismatched tunnel")
 			c.DestroyTunnel(opts.external)
@@ -355,9 +452,10 @@ func createTunnel(host string, udp bool) (net.IP, net.IP, error) {
 	}
 
 	// tunnel dst and src are reversed from remote
-	tunnel.Src, tunnel.Dst = tunnel.Dst, tunnel.Src
-	tunnel.SrcPort, tunnel.DstPort = tunnel.DstPort, tunnel.SrcPort
-	if exists == nil {
+	tunnel = reverseTunnel(tunnel)
+	tunnel.PrivateKey = privateKey
+	// a remote that was rebuilt for an existing tunnel may have new keys
+	if exists == nil || !tunnel.Equal(exists) {
 		_, tunnel, err = buildTunnelLocal(dst, tunnel)
 		if err != nil {
 			glog.Errorf("Local buildTunnel failed: %v", err)
@@ -383,51 +481,41 @@ func deleteTunnel(host string) error {
 	return nil
 }
 
+// createEncapListener opens an espinudp socket on ip and port. The family
+// of the socket follows ip, which must be an address of the underlay.
 func createEncapListener(ip net.IP, port int) (int, error) {
 	const (
 		UDP_ENCAP          = 100
 		UDP_ENCAP_ESPINUDP = 2
 	)
-	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
-	if err != nil {
-		return 0, err
-	}
-	err = syscall.SetsockoptInt(s, syscall.IPPROTO_UDP, UDP_ENCAP, UDP_ENCAP_ESPINUDP)
-	if err != nil {
-		return 0, err
-	}
-	var family int
-	if len(ip) <= net.IPv4len {
-		family = syscall.AF_INET
-	} else if ip.To4() != nil {
-		family = syscall.AF_INET
-	} else {
-		family = syscall.AF_INET6
-	}
+	family := syscall.AF_INET
 	var bindaddr syscall.Sockaddr
-	switch family {
-	case syscall.AF_INET:
-		if len(ip) == 0 {
-			ip = net.IPv4zero
-		}
+	if ip4 := ip.To4(); ip4 != nil || len(ip) == 0 {
 		sa := new(syscall.SockaddrInet4)
-		for i := 0; i < net.IPv4len; i++ {
-			sa.Addr[i] = ip[i]
-		}
+		copy(sa.Addr[:], ip4)
 		sa.Port = port
 		bindaddr = sa
-	case syscall.AF_INET6:
+	} else {
+		family = syscall.AF_INET6
 		sa := new(syscall.SockaddrInet6)
-		for i := 0; i < net.IPv6len; i++ {
-			sa.Addr[i] = ip[i]
-		}
+		copy(sa.Addr[:], ip.To16())
 		sa.Port = port
 		// TODO: optionally allow zone for ipv6
 		// sa.ZoneId = uint32(zoneToInt(zone))
 		bindaddr = sa
 	}
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = syscall.SetsockoptInt(s, syscall.IPPROTO_UDP, UDP_ENCAP, UDP_ENCAP_ESPINUDP)
+	if err != nil {
+		syscall.Close(s)
+		return 0, err
+	}
 	err = syscall.Bind(s, bindaddr)
 	if err != nil {
+		syscall.Close(s)
 		return 0, err
 	}
 	return s, nil
@@ -440,13 +528,20 @@ func deleteEncapListener(socket int) {
 	}
 }
 
-func buildTunnel(dst net.IP, tunnel *client.Tunnel) (net.IP, *client.Tunnel, error) {
+func buildTunnel(dst net.IP, tunnel *client.Tunnel, ciphers []string) (net.IP, *client.Tunnel, error) {
 	exists := getTunnel(dst.String())
 	if exists != nil {
 		glog.Infof("Tunnel already exists: %v, %v", exists.Src, exists.Dst)
-		return opts.external, exists, nil
+		return opts.external, publicTunnel(exists), nil
+	}
+	driver, err := getDriver(tunnel.Driver)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = driver.accept(tunnel, ciphers)
+	if err != nil {
+		return nil, nil, err
 	}
-	var err error
 	if tunnel.DstPort != 0 {
 		tunnel.SrcPort, err = allocatePort()
 		if err != nil {
@@ -455,94 +550,36 @@ func buildTunnel(dst net.IP, tunnel *client.Tunnel) (net.IP, *client.Tunnel, err
 		}
 		glog.Infof("Using %d for encap port", tunnel.SrcPort)
 	}
-	err = reserveIP(tunnel.Dst)
+	err = overlayIPs.Reserve(dst.String(), tunnel.Src, tunnel.Dst)
 	if err != nil {
-		glog.Infof("IP in use: %v", tunnel.Dst)
+		glog.Infof("Failed to reserve tunnel ips: %v", err)
+		if tunnel.SrcPort != 0 {
+			releasePort(tunnel.SrcPort)
+		}
 		return nil, nil, err
 	}
-	err = reserveIP(tunnel.Src)
+	src, tunnel, err := buildTunnelLocal(dst, tunnel)
 	if err != nil {
-		unreserveIP(tunnel.Dst)
-		glog.Infof("IP in use: %v", tunnel.Src)
 		return nil, nil, err
 	}
-	return buildTunnelLocal(dst, tunnel)
+	return src, publicTunnel(tunnel), nil
 }
 
 func buildTunnelLocal(dst net.IP, tunnel *client.Tunnel) (net.IP, *client.Tunnel, error) {
-	var socket int
-	if tunnel.SrcPort != 0 {
-		var err error
-		socket, err = createEncapListener(tunnel.Src, tunnel.SrcPort)
-		if err != nil {
-			glog.Errorf("Failed to create udp listener: %v", err)
-			return nil, nil, err
-		}
-	}
-	addTunnel(dst.String(), tunnel, socket)
-
-	src := opts.src
-
-	srcNet := netlink.NewIPNet(tunnel.Src)
-	dstNet := netlink.NewIPNet(tunnel.Dst)
-
-	glog.Infof("Building tunnel: %v, %v", tunnel.Src, tunnel.Dst)
-	// add IP address to loopback device
-	lo, err := netlink.LinkByName("lo")
+	driver, err := getDriver(tunnel.Driver)
 	if err != nil {
-		glog.Errorf("Failed to get loopback device: %v", err)
 		return nil, nil, err
 	}
-	err = netlink.AddrAdd(lo, &netlink.Addr{IPNet: srcNet})
-	if err != nil {
-		glog.Errorf("Failed to add %v to loopback: %v", tunnel.Src, err)
-		return nil, nil, err
+	if tunnel.KeyTime.IsZero() {
+		tunnel.KeyTime = time.Now()
 	}
+	addTunnel(dst.String(), tunnel, 0, false)
 
-	index, err := getLinkIndex(src)
-	if err != nil {
-		glog.Errorf("Failed to get link for address: %v", err)
-		return nil, nil, err
-	}
-	// add source route to tunnel ips device
-	route := &netlink.Route{
-		Scope: netlink.SCOPE_LINK,
-		Src:   tunnel.Src,
-		Dst:   dstNet,
-		LinkIndex:  index,
-	}
-	err = netlink.RouteAdd(route)
+	glog.Infof("Building %s tunnel: %v, %v", tunnel.DriverName(), tunnel.Src, tunnel.Dst)
+	err = driver.build(dst, tunnel)
 	if err != nil {
-		glog.Errorf("Failed to add route %v: %v", route, err)
 		return nil, nil, err
 	}
-
-	for _, policy := range getPolicies(tunnel.Reqid, src, dst, srcNet, dstNet) {
-		glog.Infof("building Policy: %v", policy)
-		// create xfrm policy rules
-		err = netlink.XfrmPolicyAdd(&policy)
-		if err != nil {
-			if err == syscall.EEXIST {
-				glog.Infof("Skipped adding policy %v because it already exists", policy)
-			} else {
-				glog.Errorf("Failed to add policy %v: %v", policy, err)
-				return nil, nil, err
-			}
-		}
-	}
-	for _, state := range getStates(tunnel.Reqid, src, dst, tunnel.SrcPort, tunnel.DstPort, tunnel.AuthKey, tunnel.EncKey) {
-		glog.Infof("building State: %v", state)
-		// crate xfrm state rules
-		err = netlink.XfrmStateAdd(&state)
-		if err != nil {
-			if err == syscall.EEXIST {
-				glog.Infof("Skipped adding state %v because it already exists", state)
-			} else {
-				glog.Errorf("Failed to add state %v: %v", state, err)
-				return nil, nil, err
-			}
-		}
-	}
 	glog.Infof("Finished building tunnel: %v, %v", tunnel.Src, tunnel.Dst)
 	return opts.external, tunnel, nil
 }
@@ -557,63 +594,21 @@ func destroyTunnel(dst net.IP) (net.IP, error) {
 		return nil, fmt.Errorf(s)
 	}
 
-	src := opts.src
-
-	srcNet := netlink.NewIPNet(tunnel.Src)
-	dstNet := netlink.NewIPNet(tunnel.Dst)
-
 	glog.Infof("Destroying Tunnel: %v, %v", tunnel.Src, tunnel.Dst)
 
-	for _, state := range getStates(tunnel.Reqid, src, dst, 0, 0, nil, nil) {
-		// crate xfrm state rules
-		err := netlink.XfrmStateDel(&state)
-		if err != nil {
-			glog.Errorf("Failed to delete state %v: %v", state, err)
-		}
-	}
-
-	for _, policy := range getPolicies(tunnel.Reqid, src, dst, srcNet, dstNet) {
-		// create xfrm policy rules
-		err := netlink.XfrmPolicyDel(&policy)
-		if err != nil {
-			glog.Errorf("Failed to delete policy %v: %v", policy, err)
-		}
-	}
-
-	index, err := getLinkIndex(src)
-	if err != nil {
-		glog.Errorf("Failed to get link for address: %v", err)
-	} else {
-
-		// del source route to tunnel ips device
-		route := &netlink.Route{
-			Scope: netlink.SCOPE_LINK,
-			Src:   tunnel.Src,
-			Dst:   dstNet,
-			LinkIndex:  index,
-		}
-		err = netlink.RouteDel(route)
-		if err != nil {
-			glog.Errorf("Failed to delete route %v: %v", route, err)
-		}
-	}
-
-	// del IP address to loopback device
-	lo, err := netlink.LinkByName("lo")
+	driver, err := getDriver(tunnel.Driver)
 	if err != nil {
-		glog.Errorf("Failed to get loopback device: %v", err)
+		glog.Errorf("Failed to destroy tunnel: %v", err)
 	} else {
-		err = netlink.AddrDel(lo, &netlink.Addr{IPNet: srcNet})
-		if err != nil {
-			glog.Errorf("Failed to delete %v from loopback: %v", tunnel.Src, err)
-		}
+		driver.destroy(dst, tunnel)
 	}
 	if tunnel.SrcPort != 0 {
-		deleteEncapListener(getListener(key))
+		if socket := getListener(key); socket != 0 {
+			deleteEncapListener(socket)
+		}
 		releasePort(tunnel.SrcPort)
 	}
-	unreserveIP(tunnel.Src)
-	unreserveIP(tunnel.Dst)
+	overlayIPs.Release(key)
 	removeTunnel(key)
 	glog.Infof("Finished destroying tunnel: %v, %v", tunnel.Src, tunnel.Dst)
 	return opts.external, nil
@@ -652,25 +647,26 @@ func getPolicies(reqid int, src net.IP, dst net.IP, srcNet *net.IPNet, dstNet *n
 	return policies
 }
 
-func getStates(reqid int, src net.IP, dst net.IP, srcPort int, dstPort int, authKey []byte, encKey []byte) []netlink.XfrmState {
+// getStates returns the outbound and inbound states of tunnel.
+func getStates(src net.IP, dst net.IP, tunnel *client.Tunnel) []netlink.XfrmState {
+	reqid := tunnel.Reqid
+	spi := tunnel.SpiValue()
+	srcPort := tunnel.SrcPort
+	dstPort := tunnel.DstPort
+	cipher := tunnel.CipherName()
+	authKey := tunnel.AuthKey
+	encKey := tunnel.EncKey
 	states := make([]netlink.XfrmState, 0)
 	out := netlink.XfrmState{
 		Src:          src,
 		Dst:          dst,
 		Proto:        netlink.XFRM_PROTO_ESP,
 		Mode:         netlink.XFRM_MODE_TUNNEL,
-		Spi:          reqid,
+		Spi:          spi,
 		Reqid:        reqid,
 		ReplayWindow: 32,
-		Auth: &netlink.XfrmStateAlgo{
-			Name: "hmac(sha256)",
-			Key:  authKey,
-		},
-		Crypt: &netlink.XfrmStateAlgo{
-			Name: "cbc(aes)",
-			Key:  encKey,
-		},
 	}
+	setStateAlgos(&out, cipher, authKey, encKey)
 	if srcPort != 0 && dstPort != 0 {
 		out.Encap = &netlink.XfrmStateEncap{
 			Type:    netlink.XFRM_ENCAP_ESPINUDP,
@@ -684,18 +680,11 @@ func getStates(reqid int, src net.IP, dst net.IP, srcPort int, dstPort int, auth
 		Dst:          src,
 		Proto:        netlink.XFRM_PROTO_ESP,
 		Mode:         netlink.XFRM_MODE_TUNNEL,
-		Spi:          reqid,
+		Spi:          spi,
 		Reqid:        reqid,
 		ReplayWindow: 32,
-		Auth: &netlink.XfrmStateAlgo{
-			Name: "hmac(sha256)",
-			Key:  authKey,
-		},
-		Crypt: &netlink.XfrmStateAlgo{
-			Name: "cbc(aes)",
-			Key:  encKey,
-		},
 	}
+	setStateAlgos(&in, cipher, authKey, encKey)
 	if srcPort != 0 && dstPort != 0 {
 		in.Encap = &netlink.XfrmStateEncap{
 			Type:    netlink.XFRM_ENCAP_ESPINUDP,
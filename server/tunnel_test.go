@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestListTunnels(t *testing.T) {
+	tunnels = map[string]*client.Tunnel{
+		"10.0.0.2": {Reqid: 2, AuthKey: []byte{1}, EncKey: []byte{2}, Src: net.ParseIP("100.65.0.3"), Dst: net.ParseIP("100.65.0.4")},
+		"10.0.0.1": {Reqid: 1, AuthKey: []byte{3}, EncKey: []byte{4}, Src: net.ParseIP("100.65.0.1"), Dst: net.ParseIP("100.65.0.2"), SrcPort: 4500, DstPort: 4501},
+	}
+	discovered = map[string]bool{"10.0.0.2": true}
+	defer func() {
+		tunnels = nil
+		discovered = nil
+	}()
+
+	infos := listTunnels(false)
+	if len(infos) != 2 || infos[0].Host != "10.0.0.1" || infos[1].Host != "10.0.0.2" {
+		t.Fatalf("Unexpected tunnel list: %v", infos)
+	}
+	if infos[0].Discovered || !infos[1].Discovered || infos[0].Reqid != 1 || infos[0].DstPort != 4501 {
+		t.Fatalf("Unexpected tunnel info: %+v", infos)
+	}
+	for _, info := range infos {
+		if info.AuthKey != nil || info.EncKey != nil {
+			t.Fatalf("Keys were not redacted: %+v", info)
+		}
+	}
+	if tunnels["10.0.0.1"].AuthKey == nil {
+		t.Fatalf("Redacting modified the tunnel")
+	}
+
+	infos = listTunnels(true)
+	if len(infos[0].AuthKey) != 1 || len(infos[1].EncKey) != 1 {
+		t.Fatalf("Keys were redacted: %+v", infos)
+	}
+}
+
+func TestEncapListenerFamily(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		socket, err := createEncapListener(net.ParseIP(ip), 0)
+		if err != nil {
+			t.Skipf("Unable to create espinudp socket: %v", err)
+		}
+		sa, err := syscall.Getsockname(socket)
+		deleteEncapListener(socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ipv6 := sa.(*syscall.SockaddrInet6)
+		if ipv6 != (net.ParseIP(ip).To4() == nil) {
+			t.Fatalf("Listener on %s has the wrong family: %T", ip, sa)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// Unix sockets are served without tls. Access is restricted by the mode
+// and group of the socket file and each peer is checked with SO_PEERCRED.
+const unixSocketMode = 0660
+
+// unixListener rejects connections from peers that are not root, the user
+// running wormholed, or a member of the group that owns the socket.
+type unixListener struct {
+	*net.UnixListener
+	gid int
+}
+
+func listenUnix(path string, group string) (net.Listener, error) {
+	gid := os.Getegid()
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// remove stale socket from a previous run
+		os.Remove(path)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chown(path, os.Geteuid(), gid)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	err = os.Chmod(path, unixSocketMode)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{l, gid}, nil
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		err = authorizePeer(conn, l.gid)
+		if err != nil {
+			glog.Warningf("Rejected connection on %s: %v", l.Addr(), err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func peerCred(conn *net.UnixConn) (*syscall.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+func authorizePeer(conn *net.UnixConn, gid int) error {
+	cred, err := peerCred(conn)
+	if err != nil {
+		return fmt.Errorf("Failed to get peer credentials: %v", err)
+	}
+	if cred.Uid == 0 || int(cred.Uid) == os.Geteuid() || int(cred.Gid) == gid {
+		return nil
+	}
+	groups, err := processGroups(int(cred.Pid))
+	if err != nil {
+		return fmt.Errorf("Failed to get groups for pid %d: %v", cred.Pid, err)
+	}
+	for _, g := range groups {
+		if g == gid {
+			return nil
+		}
+	}
+	return fmt.Errorf("Peer uid %d gid %d is not authorized", cred.Uid, cred.Gid)
+}
+
+// processGroups returns the supplementary groups of the process pid.
+func processGroups(pid int) ([]int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		groups := make([]int, 0)
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			g, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, g)
+		}
+		return groups, nil
+	}
+	return nil, scanner.Err()
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+
+	l, err := listenUnix(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != unixSocketMode {
+		t.Fatalf("Unexpected socket mode: %v", fi.Mode())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = <-done
+	if err != nil {
+		t.Fatalf("Connection from same user was not accepted: %v", err)
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	_, err := processGroups(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
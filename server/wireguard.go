@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/wormhole/client"
+)
+
+// Generic netlink interface of the wireguard module, from
+// include/uapi/linux/wireguard.h.
+const (
+	wgGenlName     = "wireguard"
+	wgGenlVersion  = 1
+	wgCmdSetDevice = 1
+
+	wgDeviceIfindex    = 1
+	wgDevicePrivateKey = 3
+	wgDeviceFlags      = 5
+	wgDeviceListenPort = 6
+	wgDevicePeers      = 8
+
+	wgDeviceReplacePeers = 1
+
+	wgPeerPublicKey           = 1
+	wgPeerEndpoint            = 4
+	wgPeerPersistentKeepalive = 5
+	wgPeerAllowedIPs          = 9
+
+	wgAllowedIPFamily   = 1
+	wgAllowedIPAddr     = 2
+	wgAllowedIPCidrMask = 3
+)
+
+const (
+	wgKeyLen = 32
+	// wgKeepalive keeps nat mappings open between the peers, in seconds
+	wgKeepalive = 25
+)
+
+// wireguardDriver builds a wireguard link for each tunnel. The peers only
+// exchange public keys; each end keeps its private key to itself.
+type wireguardDriver struct{}
+
+func newWireguardKeys() ([]byte, []byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+// offer generates the keys of this end. The tunnel is in the view of the
+// peer, so our public key is the PeerKey and our port is the DstPort.
+func (wireguardDriver) offer(tunnel *client.Tunnel) error {
+	var err error
+	tunnel.PrivateKey, tunnel.PeerKey, err = newWireguardKeys()
+	if err != nil {
+		return err
+	}
+	if tunnel.DstPort == 0 {
+		tunnel.DstPort, err = allocatePort()
+		if err != nil {
+			glog.Errorf("No ports available: %v", err)
+			return err
+		}
+		glog.Infof("Using %d for wireguard port", tunnel.DstPort)
+	}
+	return nil
+}
+
+func (wireguardDriver) accept(tunnel *client.Tunnel, ciphers []string) error {
+	if len(tunnel.PeerKey) != wgKeyLen {
+		return fmt.Errorf("Wireguard tunnel has no peer key")
+	}
+	if tunnel.DstPort == 0 {
+		return fmt.Errorf("Wireguard tunnel has no peer port")
+	}
+	var err error
+	tunnel.PrivateKey, tunnel.PublicKey, err = newWireguardKeys()
+	return err
+}
+
+func wireguardLinkName(reqid int) string {
+	return fmt.Sprintf("wh%08x", uint32(reqid))
+}
+
+func (wireguardDriver) build(dst net.IP, tunnel *client.Tunnel) error {
+	if len(tunnel.PrivateKey) != wgKeyLen || len(tunnel.PeerKey) != wgKeyLen {
+		return fmt.Errorf("Wireguard tunnel to %s is missing keys", dst)
+	}
+	name := wireguardLinkName(tunnel.Reqid)
+	err := netlink.LinkAdd(&netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		LinkType:  "wireguard",
+	})
+	if err != nil && err != syscall.EEXIST {
+		glog.Errorf("Failed to add wireguard link %s: %v", name, err)
+		return err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		glog.Errorf("Failed to get wireguard link %s: %v", name, err)
+		return err
+	}
+	index := link.Attrs().Index
+	err = configureWireguard(index, dst, tunnel)
+	if err != nil {
+		glog.Errorf("Failed to configure wireguard link %s: %v", name, err)
+		return err
+	}
+	err = netlink.AddrAdd(link, &netlink.Addr{IPNet: netlink.NewIPNet(tunnel.Src)})
+	if err != nil && err != syscall.EEXIST {
+		glog.Errorf("Failed to add %v to %s: %v", tunnel.Src, name, err)
+		return err
+	}
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		glog.Errorf("Failed to set %s up: %v", name, err)
+		return err
+	}
+	route := &netlink.Route{
+		Scope:     netlink.SCOPE_LINK,
+		Src:       tunnel.Src,
+		Dst:       netlink.NewIPNet(tunnel.Dst),
+		LinkIndex: index,
+	}
+	err = netlink.RouteAdd(route)
+	if err != nil && err != syscall.EEXIST {
+		glog.Errorf("Failed to add route %v: %v", route, err)
+		return err
+	}
+	return nil
+}
+
+// destroy deletes the link, which takes its address and route with it.
+func (wireguardDriver) destroy(dst net.IP, tunnel *client.Tunnel) {
+	name := wireguardLinkName(tunnel.Reqid)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		glog.Errorf("Failed to get wireguard link %s: %v", name, err)
+		return
+	}
+	err = netlink.LinkDel(link)
+	if err != nil {
+		glog.Errorf("Failed to delete wireguard link %s: %v", name, err)
+	}
+}
+
+// configureWireguard sets the key, port and only peer of the wireguard link
+// with index.
+func configureWireguard(index int, dst net.IP, tunnel *client.Tunnel) error {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return fmt.Errorf("Failed to find wireguard netlink family: %v", err)
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), syscall.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	for _, attr := range wireguardAttrs(index, dst, tunnel) {
+		req.AddData(attr)
+	}
+	_, err = req.Execute(syscall.NETLINK_GENERIC, 0)
+	return err
+}
+
+// wireguardAttrs returns the attributes of a set device request that
+// replaces the peers of the link with the other end of tunnel.
+func wireguardAttrs(index int, dst net.IP, tunnel *client.Tunnel) []*nl.RtAttr {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(wgDeviceIfindex, nl.Uint32Attr(uint32(index))),
+		nl.NewRtAttr(wgDevicePrivateKey, tunnel.PrivateKey),
+		nl.NewRtAttr(wgDeviceFlags, nl.Uint32Attr(wgDeviceReplacePeers)),
+		nl.NewRtAttr(wgDeviceListenPort, nl.Uint16Attr(uint16(tunnel.SrcPort))),
+	}
+	peers := nl.NewRtAttr(wgDevicePeers|nl.NLA_F_NESTED, nil)
+	peer := nl.NewRtAttrChild(peers, nl.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(peer, wgPeerPublicKey, tunnel.PeerKey)
+	nl.NewRtAttrChild(peer, wgPeerEndpoint, sockaddr(dst, tunnel.DstPort))
+	nl.NewRtAttrChild(peer, wgPeerPersistentKeepalive, nl.Uint16Attr(wgKeepalive))
+	ips := nl.NewRtAttrChild(peer, wgPeerAllowedIPs|nl.NLA_F_NESTED, nil)
+	ip := nl.NewRtAttrChild(ips, nl.NLA_F_NESTED, nil)
+	family, addr := syscall.AF_INET, tunnel.Dst.To4()
+	if addr == nil {
+		family, addr = syscall.AF_INET6, tunnel.Dst.To16()
+	}
+	nl.NewRtAttrChild(ip, wgAllowedIPFamily, nl.Uint16Attr(uint16(family)))
+	nl.NewRtAttrChild(ip, wgAllowedIPAddr, []byte(addr))
+	nl.NewRtAttrChild(ip, wgAllowedIPCidrMask, nl.Uint8Attr(uint8(len(addr)*8)))
+	return append(attrs, peers)
+}
+
+// sockaddr encodes ip and port as a struct sockaddr_in or sockaddr_in6.
+func sockaddr(ip net.IP, port int) []byte {
+	native := nl.NativeEndian()
+	if ip4 := ip.To4(); ip4 != nil {
+		b := make([]byte, syscall.SizeofSockaddrInet4)
+		native.PutUint16(b[0:2], syscall.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], uint16(port))
+		copy(b[4:8], ip4)
+		return b
+	}
+	b := make([]byte, syscall.SizeofSockaddrInet6)
+	native.PutUint16(b[0:2], syscall.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], uint16(port))
+	copy(b[8:24], ip.To16())
+	return b
+}
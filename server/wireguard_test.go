@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/wormhole/client"
+)
+
+func TestGetDriver(t *testing.T) {
+	for _, name := range []string{"", client.DriverXfrm, client.DriverWireguard} {
+		_, err := getDriver(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := getDriver("gre")
+	if err == nil {
+		t.Fatalf("Expected error for unknown driver")
+	}
+}
+
+func publicKeyOf(t *testing.T, private []byte) []byte {
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey().Bytes()
+}
+
+func TestWireguardKeyExchange(t *testing.T) {
+	unusedPorts = []int{51820}
+	defer func() {
+		unusedPorts = nil
+	}()
+	driver := wireguardDriver{}
+
+	// the offer is made in the view of the remote end
+	offered := &client.Tunnel{Driver: client.DriverWireguard, Src: net.ParseIP("100.65.0.2"), Dst: net.ParseIP("100.65.0.1")}
+	err := driver.offer(offered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offered.DstPort != 51820 || !bytes.Equal(offered.PeerKey, publicKeyOf(t, offered.PrivateKey)) {
+		t.Fatalf("Unexpected offer: %+v", offered)
+	}
+	private := offered.PrivateKey
+
+	remote := publicTunnel(offered)
+	if remote.PrivateKey != nil {
+		t.Fatalf("Private key would be sent")
+	}
+	err = driver.accept(remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(remote.PublicKey, publicKeyOf(t, remote.PrivateKey)) {
+		t.Fatalf("Remote public key does not match its private key")
+	}
+	remote.SrcPort = 51821
+
+	local := reverseTunnel(remote)
+	local.PrivateKey = private
+	if local.PrivateKey == nil || bytes.Equal(local.PrivateKey, remote.PrivateKey) {
+		t.Fatalf("Ends share a private key")
+	}
+	if !bytes.Equal(local.PublicKey, publicKeyOf(t, local.PrivateKey)) || !bytes.Equal(local.PeerKey, remote.PublicKey) {
+		t.Fatalf("Keys were not reversed: %+v", local)
+	}
+	if !local.Src.Equal(remote.Dst) || local.SrcPort != 51820 || local.DstPort != 51821 {
+		t.Fatalf("Tunnel was not reversed: %+v", local)
+	}
+
+	err = driver.accept(&client.Tunnel{DstPort: 51820}, nil)
+	if err == nil {
+		t.Fatalf("Expected error without a peer key")
+	}
+}
+
+func TestSockaddr(t *testing.T) {
+	b := sockaddr(net.ParseIP("10.0.0.1"), 51820)
+	if len(b) != syscall.SizeofSockaddrInet4 || nl.NativeEndian().Uint16(b) != syscall.AF_INET ||
+		!bytes.Equal(b[2:8], []byte{0xca, 0x6c, 10, 0, 0, 1}) {
+		t.Fatalf("Unexpected sockaddr_in: %v", b)
+	}
+	b = sockaddr(net.ParseIP("fd00::1"), 51820)
+	if len(b) != syscall.SizeofSockaddrInet6 || nl.NativeEndian().Uint16(b) != syscall.AF_INET6 ||
+		!bytes.Equal(b[2:4], []byte{0xca, 0x6c}) || b[8] != 0xfd || b[23] != 1 {
+		t.Fatalf("Unexpected sockaddr_in6: %v", b)
+	}
+}
+
+func TestWireguardAttrs(t *testing.T) {
+	tunnel := &client.Tunnel{
+		Driver:     client.DriverWireguard,
+		PrivateKey: bytes.Repeat([]byte{1}, wgKeyLen),
+		PublicKey:  bytes.Repeat([]byte{2}, wgKeyLen),
+		PeerKey:    bytes.Repeat([]byte{3}, wgKeyLen),
+		Src:        net.ParseIP("100.65.0.1"),
+		Dst:        net.ParseIP("100.65.0.2"),
+		SrcPort:    51820,
+		DstPort:    51821,
+	}
+	attrs := wireguardAttrs(5, net.ParseIP("10.0.0.2"), tunnel)
+	peers := attrs[len(attrs)-1]
+	if peers.Type != wgDevicePeers|nl.NLA_F_NESTED {
+		t.Fatalf("Peers are not nested: %d", peers.Type)
+	}
+	b := peers.Serialize()
+	if !bytes.Contains(b, tunnel.PeerKey) || bytes.Contains(b, tunnel.PublicKey) {
+		t.Fatalf("Peer does not have the peer key")
+	}
+	if !bytes.Contains(b, sockaddr(net.ParseIP("10.0.0.2"), 51821)) || !bytes.Contains(b, []byte{100, 65, 0, 2}) {
+		t.Fatalf("Peer does not have the endpoint and allowed ip")
+	}
+	device := attrs[1].Serialize()
+	if !bytes.Contains(device, tunnel.PrivateKey) {
+		t.Fatalf("Device does not have the private key")
+	}
+}
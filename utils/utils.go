@@ -3,6 +3,7 @@ package utils
 import (
 	"crypto/rand"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -97,7 +98,24 @@ func ValidateAddr(addr string) (string, error) {
 		proto = "tcp"
 	}
 
-	if proto != "unix" && strings.Contains(addr, ":") {
+	if proto != "unix" && net.ParseIP(addr) != nil {
+		// bare ipv6 address
+		host = addr
+		port = DEFAULT_PORT
+	} else if proto != "unix" && strings.HasPrefix(addr, "[") {
+		if strings.HasSuffix(addr, "]") {
+			addr += ":"
+		}
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("Invalid bind address format: %s", addr)
+		}
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port == 0 {
+			port = DEFAULT_PORT
+		}
+	} else if proto != "unix" && strings.Contains(addr, ":") {
 		hostParts := strings.Split(addr, ":")
 		if len(hostParts) != 2 {
 			return "", fmt.Errorf("Invalid bind address format: %s", addr)
@@ -121,7 +139,7 @@ func ValidateAddr(addr string) (string, error) {
 	if proto == "unix" {
 		return fmt.Sprintf("%s://%s", proto, host), nil
 	}
-	return fmt.Sprintf("%s://%s:%d", proto, host, port), nil
+	return fmt.Sprintf("%s://%s", proto, net.JoinHostPort(host, strconv.Itoa(port))), nil
 }
 
 func ParseAddr(host string) (string, string) {
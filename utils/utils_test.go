@@ -62,3 +62,26 @@ func TestParseUrlErrors(t *testing.T) {
 	errors(t, "::1:40")
 	errors(t, "[bad]bracketing")
 }
+
+func TestValidateAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"":                       "tcp://:9999",
+		"foo":                    "tcp://foo:9999",
+		"foo:40":                 "tcp://foo:40",
+		"tcp://10.0.0.1":         "tcp://10.0.0.1:9999",
+		"2001:db8::1":            "tcp://[2001:db8::1]:9999",
+		"[2001:db8::1]":          "tcp://[2001:db8::1]:9999",
+		"tcp://[2001:db8::1]:40": "tcp://[2001:db8::1]:40",
+		"unix://":                "unix:///var/run/wormhole",
+	} {
+		actual, err := ValidateAddr(addr)
+		if err != nil || actual != expected {
+			t.Fatalf("ValidateAddr(%q) = %q, %v (Expected: %q)", addr, actual, err, expected)
+		}
+	}
+	for _, addr := range []string{"foo:40:50", "[2001:db8::1", "udp://foo"} {
+		if _, err := ValidateAddr(addr); err == nil {
+			t.Fatalf("No error for %v", addr)
+		}
+	}
+}